@@ -0,0 +1,1142 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cache implements a LRU cache.
+//
+// TwoQueueCacheKeyUint64 is a simplified 2Q cache: new elements enter a small
+// probationary "recent" queue and are only promoted to the main "frequent"
+// queue when accessed again. A scan touching many keys once therefore only
+// churns the recent queue and leaves the working set in the frequent queue
+// alone. Both queues are LRU lists sharing a single capacity.
+package lru
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	key "github.com/0studio/storage_key"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// twoQueueRecentRatio is the share of the capacity reserved for the recent
+// queue before it starts evicting its own elements.
+const twoQueueRecentRatio = 4 // 1/4
+
+// TwoQueueCacheKeyUint64 is an alternative to LRUCacheKeyUint64 that resists
+// scan pollution. It has the same methods, with the same contracts, except
+// for the ones tied to a single LRU list: SetPromoteAfterAccesses (the 2Q
+// queues are its own promotion policy), SetCapacityGradual, ResetCount and
+// the count mode, EnableNegativeCache, SetDetachedClear, ResetPerKeyHits,
+// ItemsCtx, and the debug modes (SetCheckSizes, SetRecordWriters,
+// DebugHandler, Verify). Where LRUCacheKeyUint64 lists entries from most to
+// least recently used, it lists the frequent queue then the recent queue,
+// each from most to least recently used. Note the capacity is not the number
+// of items, but the total sum of the Size() of each item.
+type TwoQueueCacheKeyUint64 struct {
+	mu sync.RWMutex
+
+	// recent & frequent lists of *twoQueueKeyUint64Entry objects, and the
+	// table indexing both
+	recent   *list.List
+	frequent *list.List
+	table    map[key.KeyUint64]*list.Element
+
+	// Our current size, and the part of it held by the recent queue. size
+	// is only changed with mu held, but atomic so that SizeApprox can read
+	// it without.
+	size       atomic.Int64
+	recentSize int64
+
+	// How much we are limiting the cache to.
+	capacity int64
+	onMiss   OnMissHandlerKeyUint64
+	onEvict  OnEvictHandlerKeyUint64
+
+	// Called when the capacity changes, see OnCapacityChange.
+	onCapacityChange func(old, new int64)
+
+	// At most this many onMiss calls in flight, see SetMaxConcurrentLoads.
+	maxConcurrentLoads int
+
+	// Every entry weighs at least this much, see SetMinEntrySize.
+	minEntrySize int64
+
+	// Entries younger than this are not evicted, see SetMinResidency.
+	minResidency time.Duration
+
+	// When set, capacity evictions are appended to it, see
+	// SetReturningEvicted.
+	evictedSink *[]KeyUint64Item
+
+	// Capacity evictions are sent to it when there is room, see
+	// EvictionChannel.
+	evictionCh           chan KeyUint64Item
+	droppedNotifications int64
+
+	// While set, nothing is evicted, see PauseEviction.
+	evictionPaused bool
+
+	// Optional structured logger, see SetLogger, and whether it is told
+	// about misses, see SetLogMisses.
+	logger    func(event string, fields map[string]interface{})
+	logMisses bool
+
+	// Monotonic counters, see StatsStruct.
+	hits      int64
+	misses    int64
+	evictions int64
+}
+type twoQueueKeyUint64Entry struct {
+	key      key.KeyUint64
+	value    Cacheable
+	size     int64
+	frequent bool
+	inserted time.Time // only recorded when minResidency is set
+	hits     int64     // successful Gets since insertion
+}
+
+// NewTwoQueueCacheKeyUint64 creates a new empty cache with the given capacity.
+func NewTwoQueueCacheKeyUint64(capacity int64) *TwoQueueCacheKeyUint64 {
+	return &TwoQueueCacheKeyUint64{
+		recent:       list.New(),
+		frequent:     list.New(),
+		table:        make(map[key.KeyUint64]*list.Element),
+		capacity:     capacity,
+		minEntrySize: defaultMinEntrySize,
+	}
+}
+
+// Get returns a value from the cache. An entry in the recent queue is
+// promoted to the frequent queue, an entry already there is marked as most
+// recently used.
+func (lru *TwoQueueCacheKeyUint64) Get(k key.KeyUint64) (v Cacheable, ok bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	v, _, ok = lru.get(k)
+	return
+}
+
+// GetWithMeta is like Get, but also returns how many times the entry has been
+// hit since it was stored, including this call. A value loaded through onMiss
+// has not been hit yet.
+func (lru *TwoQueueCacheKeyUint64) GetWithMeta(k key.KeyUint64) (v Cacheable, hits int64, ok bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return lru.get(k)
+}
+func (lru *TwoQueueCacheKeyUint64) get(k key.KeyUint64) (v Cacheable, hits int64, ok bool) {
+	element := lru.table[k]
+	if element == nil {
+		lru.misses++
+		lru.logMiss(k)
+		if lru.onMiss == nil {
+			return nil, 0, false
+		}
+		v, ok = lru.onMiss(k)
+		if v == nil {
+			// a nil value is reported as a miss rather than cached
+			ok = false
+		}
+		if ok {
+			lru.set(k, v)
+		}
+		return
+	}
+	lru.hits++
+	entry := element.Value.(*twoQueueKeyUint64Entry)
+	entry.hits++
+	lru.touch(element)
+	return entry.value, entry.hits, true
+}
+
+// GetMultiStats returns the values of keys found in the cache, marking them
+// as accessed like Get does, along with how many of keys hit and missed.
+// onMiss is not consulted. A key listed more than once is looked up and
+// counted only once, so hits is the length of results.
+func (lru *TwoQueueCacheKeyUint64) GetMultiStats(keys []key.KeyUint64) (results map[key.KeyUint64]Cacheable, hits, misses int) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	results = make(map[key.KeyUint64]Cacheable, len(keys))
+	seen := make(map[key.KeyUint64]bool, len(keys))
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if element := lru.table[k]; element != nil {
+			hits++
+			lru.touch(element)
+			results[k] = element.Value.(*twoQueueKeyUint64Entry).value
+		} else {
+			misses++
+			lru.logMiss(k)
+		}
+	}
+	lru.hits += int64(hits)
+	lru.misses += int64(misses)
+	return results, hits, misses
+}
+
+// GetMultiCtx returns the values of keys found in the cache. Missing keys are
+// loaded concurrently through onMiss, at most SetMaxConcurrentLoads at a
+// time, outside the lock, and stored. Keys whose load has not completed when
+// ctx is done are omitted from the result: the loads in flight are left to
+// finish in the background and their results discarded, the others are not
+// started. A key listed more than once is looked up, counted and loaded only
+// once.
+func (lru *TwoQueueCacheKeyUint64) GetMultiCtx(ctx context.Context, keys []key.KeyUint64) map[key.KeyUint64]Cacheable {
+	results := make(map[key.KeyUint64]Cacheable, len(keys))
+	var missing []key.KeyUint64
+
+	lru.mu.Lock()
+	seen := make(map[key.KeyUint64]bool, len(keys))
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if element := lru.table[k]; element != nil {
+			lru.hits++
+			lru.touch(element)
+			results[k] = element.Value.(*twoQueueKeyUint64Entry).value
+		} else {
+			lru.misses++
+			lru.logMiss(k)
+			missing = append(missing, k)
+		}
+	}
+	onMiss, workers := lru.onMiss, lru.maxConcurrentLoads
+	lru.mu.Unlock()
+
+	if onMiss == nil || len(missing) == 0 {
+		return results
+	}
+	loaded := loadKeyUint64s(ctx, onMiss, missing, workers)
+	for i := 0; i < len(missing); i++ {
+		select {
+		case <-ctx.Done():
+			return results
+		case l := <-loaded:
+			if l.Value != nil {
+				lru.Set(l.Key, l.Value)
+				results[l.Key] = l.Value
+			}
+		}
+	}
+	return results
+}
+
+// GetMultiOrLoad returns the values of keys, loading all the missing ones
+// with a single call to loader, outside the lock, instead of one onMiss call
+// per key. The values returned by loader are stored; missing keys it leaves
+// out, or returns a nil value for, are not found. Keys loader returns that
+// were not asked for are ignored. loader is not called when every key hits.
+func (lru *TwoQueueCacheKeyUint64) GetMultiOrLoad(keys []key.KeyUint64, loader func(missing []key.KeyUint64) map[key.KeyUint64]Cacheable) map[key.KeyUint64]Cacheable {
+	results := make(map[key.KeyUint64]Cacheable, len(keys))
+	var missing []key.KeyUint64
+
+	lru.mu.Lock()
+	seen := make(map[key.KeyUint64]bool, len(keys))
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if element := lru.table[k]; element != nil {
+			lru.hits++
+			lru.touch(element)
+			results[k] = element.Value.(*twoQueueKeyUint64Entry).value
+		} else {
+			lru.misses++
+			lru.logMiss(k)
+			missing = append(missing, k)
+		}
+	}
+	lru.mu.Unlock()
+
+	if len(missing) == 0 {
+		return results
+	}
+	loaded := loader(missing)
+
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	for _, k := range missing {
+		if v := loaded[k]; v != nil {
+			lru.set(k, v)
+			results[k] = v
+		}
+	}
+	return results
+}
+
+// Preload warms the cache: every key of keys not already cached is loaded
+// through onMiss, concurrently, at most SetMaxConcurrentLoads at a time, and
+// outside the lock, and stored in the recent queue if found. Each key is
+// loaded at most once, values stored meanwhile by Set are kept, and the hit
+// and miss counters are left alone. It returns once every load has
+// completed.
+func (lru *TwoQueueCacheKeyUint64) Preload(keys []key.KeyUint64) {
+	lru.mu.RLock()
+	onMiss, workers := lru.onMiss, lru.maxConcurrentLoads
+	var missing []key.KeyUint64
+	seen := make(map[key.KeyUint64]bool, len(keys))
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if lru.table[k] == nil {
+			missing = append(missing, k)
+		}
+	}
+	lru.mu.RUnlock()
+
+	if onMiss == nil {
+		return
+	}
+	loaded := loadKeyUint64s(context.Background(), onMiss, missing, workers)
+	for range missing {
+		if l := <-loaded; l.Value != nil {
+			lru.SetIfAbsent(l.Key, l.Value)
+		}
+	}
+}
+
+// Peek returns a value from the cache without affecting its position and
+// without consulting onMiss. It only takes the read lock, so concurrent
+// Peeks do not block each other.
+func (lru *TwoQueueCacheKeyUint64) Peek(k key.KeyUint64) (v Cacheable, ok bool) {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	element := lru.table[k]
+	if element == nil {
+		return nil, false
+	}
+	return element.Value.(*twoQueueKeyUint64Entry).value, true
+}
+
+// Contains reports whether k is in the cache, without affecting its position
+// and without consulting onMiss.
+func (lru *TwoQueueCacheKeyUint64) Contains(k key.KeyUint64) bool {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	_, ok := lru.table[k]
+	return ok
+}
+
+// Set sets a value in the cache.
+func (lru *TwoQueueCacheKeyUint64) Set(k key.KeyUint64, value Cacheable) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.set(k, value)
+}
+func (lru *TwoQueueCacheKeyUint64) set(k key.KeyUint64, value Cacheable) {
+	if element := lru.table[k]; element != nil {
+		lru.updateInplace(element, value)
+	} else {
+		lru.addNew(k, value)
+	}
+}
+
+// SetReturningEvicted is like Set, but returns the entries evicted to make
+// room for value, in eviction order. When value is rejected instead, for
+// being larger than the capacity or because the capacity is <= 0, it is the
+// one returned.
+func (lru *TwoQueueCacheKeyUint64) SetReturningEvicted(k key.KeyUint64, value Cacheable) []KeyUint64Item {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	var evicted []KeyUint64Item
+	lru.evictedSink = &evicted
+	lru.set(k, value)
+	lru.evictedSink = nil
+	return evicted
+}
+
+// SetIfAbsent will set the value in the cache if not present. If the
+// value exists in the cache, we don't set it.
+func (lru *TwoQueueCacheKeyUint64) SetIfAbsent(k key.KeyUint64, value Cacheable) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	if element := lru.table[k]; element != nil {
+		lru.moveToFront(element)
+	} else {
+		lru.addNew(k, value)
+	}
+}
+
+// Delete removes an twoQueueKeyUint64Entry from the cache, and returns if the twoQueueKeyUint64Entry existed.
+func (lru *TwoQueueCacheKeyUint64) Delete(k key.KeyUint64) bool {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element := lru.table[k]
+	if element == nil {
+		return false
+	}
+
+	lru.remove(element)
+	lru.purge(element.Value.(*twoQueueKeyUint64Entry), PURGE_REASON_DELETE)
+	return true
+}
+
+// Remove is like Delete, but also returns the value removed. It has been
+// purged with PURGE_REASON_DELETE when it is returned.
+func (lru *TwoQueueCacheKeyUint64) Remove(k key.KeyUint64) (Cacheable, bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element := lru.table[k]
+	if element == nil {
+		return nil, false
+	}
+
+	entry := element.Value.(*twoQueueKeyUint64Entry)
+	lru.remove(element)
+	lru.purge(entry, PURGE_REASON_DELETE)
+	return entry.value, true
+}
+
+// DeleteMulti removes all of keys present in the cache under a single lock
+// acquisition, and returns how many entries were removed.
+func (lru *TwoQueueCacheKeyUint64) DeleteMulti(keys []key.KeyUint64) int {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	removed := 0
+	for _, k := range keys {
+		element := lru.table[k]
+		if element == nil {
+			continue
+		}
+		lru.remove(element)
+		lru.purge(element.Value.(*twoQueueKeyUint64Entry), PURGE_REASON_DELETE)
+		removed++
+	}
+	return removed
+}
+
+// DeleteFunc removes every entry for which pred returns true, and returns
+// how many entries were removed.
+//
+// pred is called with lru.mu held: it must not call back into the cache,
+// otherwise it will deadlock.
+func (lru *TwoQueueCacheKeyUint64) DeleteFunc(pred func(k key.KeyUint64, v Cacheable) bool) int {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	removed := 0
+	for _, l := range []*list.List{lru.frequent, lru.recent} {
+		for e := l.Front(); e != nil; {
+			next := e.Next()
+			entry := e.Value.(*twoQueueKeyUint64Entry)
+			if pred(entry.key, entry.value) {
+				lru.remove(e)
+				lru.purge(entry, PURGE_REASON_DELETE)
+				removed++
+			}
+			e = next
+		}
+	}
+	return removed
+}
+
+// Clear will clear the entire cache.
+func (lru *TwoQueueCacheKeyUint64) Clear() {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.clear()
+}
+
+// clear empties the cache before firing the purge callbacks of the removed
+// entries, so that the cache is consistent even if one of them panics.
+func (lru *TwoQueueCacheKeyUint64) clear() {
+	frequent, recent := lru.frequent, lru.recent
+	lru.recent = list.New()
+	lru.frequent = list.New()
+	lru.table = make(map[key.KeyUint64]*list.Element)
+	lru.size.Store(0)
+	lru.recentSize = 0
+
+	for _, l := range []*list.List{frequent, recent} {
+		for e := l.Front(); e != nil; e = e.Next() {
+			lru.purge(e.Value.(*twoQueueKeyUint64Entry), PURGE_REASON_CLEAR_ALL)
+		}
+	}
+}
+
+// Drain empties the cache like Clear, but removes the entries one at a time
+// in the reverse of the Keys order, the recent queue first, so that
+// write-back done in OnPurge or OnEvict processes the coldest entries first.
+func (lru *TwoQueueCacheKeyUint64) Drain() {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	for _, l := range []*list.List{lru.recent, lru.frequent} {
+		for delElem := l.Back(); delElem != nil; delElem = l.Back() {
+			lru.remove(delElem)
+			lru.purge(delElem.Value.(*twoQueueKeyUint64Entry), PURGE_REASON_CLEAR_ALL)
+		}
+	}
+}
+
+// Clone returns an independent copy of the cache with the same entries in
+// the same queues and order, and the same configuration: capacity,
+// SetMinEntrySize, SetMinResidency, SetMaxConcurrentLoads, PauseEviction and
+// SetLogMisses. Values are shared, not copied. Hooks (OnMiss, OnEvict,
+// OnCapacityChange, SetLogger, EvictionChannel) are not carried over, and
+// counters start from zero.
+func (lru *TwoQueueCacheKeyUint64) Clone() *TwoQueueCacheKeyUint64 {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	clone := NewTwoQueueCacheKeyUint64(lru.capacity)
+	clone.minEntrySize = lru.minEntrySize
+	clone.minResidency = lru.minResidency
+	clone.maxConcurrentLoads = lru.maxConcurrentLoads
+	clone.evictionPaused = lru.evictionPaused
+	clone.logMisses = lru.logMisses
+	for _, l := range [][2]*list.List{{lru.frequent, clone.frequent}, {lru.recent, clone.recent}} {
+		for e := l[0].Front(); e != nil; e = e.Next() {
+			entry := *e.Value.(*twoQueueKeyUint64Entry)
+			clone.table[entry.key] = l[1].PushBack(&entry)
+		}
+	}
+	clone.size.Store(lru.size.Load())
+	clone.recentSize = lru.recentSize
+	return clone
+}
+
+// Snapshot returns a copy of all the entries, in the same order as Keys,
+// suitable for Restore. It is the same as Items.
+func (lru *TwoQueueCacheKeyUint64) Snapshot() []KeyUint64Item {
+	return lru.Items()
+}
+
+// Restore clears the cache then loads items into the recent queue, preserving
+// their order: the first item is the most recently used. Which queue the
+// items were in is not known, so they have to be accessed again to be
+// promoted. If a key appears more than once only its first occurrence is
+// kept. Items are admitted as by Set: a value larger than the capacity, or
+// any value when the capacity is <= 0, is evicted with
+// PURGE_REASON_CACHEFULL instead. Items that do not fit in the capacity are
+// evicted from the end of the list.
+func (lru *TwoQueueCacheKeyUint64) Restore(items []KeyUint64Item) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.clear()
+	for _, item := range items {
+		if _, ok := lru.table[item.Key]; ok {
+			continue
+		}
+		newEntry := &twoQueueKeyUint64Entry{key: item.Key, value: item.Value, size: lru.entrySize(item.Value)}
+		if !lru.admit(newEntry) {
+			continue
+		}
+		lru.table[item.Key] = lru.recent.PushBack(newEntry)
+		lru.size.Add(newEntry.size)
+		lru.recentSize += newEntry.size
+	}
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+// SetCapacity will set the capacity of the cache. If the capacity is
+// smaller, and the current cache size exceed that capacity, the cache
+// will be shrank, purging the evicted elements with
+// PURGE_REASON_CAPACITY_SHRINK.
+func (lru *TwoQueueCacheKeyUint64) SetCapacity(capacity int64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	old := lru.capacity
+	lru.capacity = capacity
+	if lru.onCapacityChange != nil && old != capacity {
+		lru.onCapacityChange(old, capacity)
+	}
+	lru.checkCapacity(PURGE_REASON_CAPACITY_SHRINK)
+}
+
+// SetMinEntrySize makes every entry count at least n toward the capacity,
+// so that values reporting a Size() of 0 cannot accumulate without bound.
+// It only applies to entries stored afterwards. The default is
+// defaultMinEntrySize, and n <= 0 counts values exactly as reported.
+func (lru *TwoQueueCacheKeyUint64) SetMinEntrySize(n int64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.minEntrySize = n
+}
+
+// SetMinResidency protects entries inserted less than d ago from capacity
+// eviction: the next entry of the same queue old enough is evicted instead,
+// or failing that one of the other queue. If every entry is too young the
+// cache is allowed to exceed its capacity until they age. A zero d disables
+// the protection.
+func (lru *TwoQueueCacheKeyUint64) SetMinResidency(d time.Duration) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.minResidency = d
+}
+
+// SetMaxConcurrentLoads bounds how many onMiss calls GetMultiCtx and Preload
+// run at once. n <= 0 restores the default, defaultMaxConcurrentLoads.
+func (lru *TwoQueueCacheKeyUint64) SetMaxConcurrentLoads(n int) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.maxConcurrentLoads = n
+}
+
+// PauseEviction stops evicting entries to make room: until ResumeEviction,
+// the size may exceed the capacity.
+func (lru *TwoQueueCacheKeyUint64) PauseEviction() {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.evictionPaused = true
+}
+
+// ResumeEviction undoes PauseEviction, and shrinks the cache down to its
+// capacity.
+func (lru *TwoQueueCacheKeyUint64) ResumeEviction() {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.evictionPaused = false
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+// SetLogger installs a structured logger. It is called with the event
+// "evict" (fields "key", "size", "reason") whenever an entry is deleted,
+// evicted or cleared, and, if enabled with SetLogMisses, with the event
+// "miss" (field "key") on every cache miss. Pass nil to disable logging.
+//
+// Like OnPurge, logger is called with the cache locked and must not call back
+// into the cache.
+func (lru *TwoQueueCacheKeyUint64) SetLogger(logger func(event string, fields map[string]interface{})) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.logger = logger
+}
+
+// SetLogMisses enables the "miss" events of the logger, see SetLogger. They
+// are off by default, since a busy cache may miss far more often than it
+// evicts.
+func (lru *TwoQueueCacheKeyUint64) SetLogMisses(enabled bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.logMisses = enabled
+}
+
+// OnEvict installs a handler called, right after the value's own OnPurge,
+// every time a value leaves the cache or is replaced, with the same reasons.
+// Unlike OnPurger it does not require the value to implement anything.
+//
+// The same contract as OnPurger applies: the entire cache is blocked until
+// onEvict returns, and it must not call back into the cache.
+func (lru *TwoQueueCacheKeyUint64) OnEvict(onEvict OnEvictHandlerKeyUint64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.onEvict = onEvict
+}
+
+// EvictionChannel returns a channel receiving every item evicted to make
+// room, and every new value rejected for being larger than the capacity, or
+// because the capacity is <= 0. It is an alternative to OnEvict for handlers
+// too slow to run with the cache locked. The send never blocks: when the
+// buffer is full, the notification is dropped and counted, see
+// DroppedNotifications. A new call replaces the channel, closing the
+// previous one.
+func (lru *TwoQueueCacheKeyUint64) EvictionChannel(buffer int) <-chan KeyUint64Item {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	if lru.evictionCh != nil {
+		close(lru.evictionCh)
+	}
+	lru.evictionCh = make(chan KeyUint64Item, buffer)
+	return lru.evictionCh
+}
+
+// DroppedNotifications returns the number of evictions not sent to the
+// EvictionChannel because its buffer was full.
+func (lru *TwoQueueCacheKeyUint64) DroppedNotifications() int64 {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+	return lru.droppedNotifications
+}
+
+// OnCapacityChange installs a handler called with the old and new capacity
+// whenever SetCapacity changes it, before the cache is shrunk to fit. Like
+// OnEvict, it is called with the cache locked and must not call back into
+// the cache.
+func (lru *TwoQueueCacheKeyUint64) OnCapacityChange(onCapacityChange func(old, new int64)) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.onCapacityChange = onCapacityChange
+}
+
+// OnMiss sets the handler loading the values missing from the cache. The
+// values it finds are stored, except nil ones, which are reported as misses.
+func (lru *TwoQueueCacheKeyUint64) OnMiss(onMiss OnMissHandlerKeyUint64) {
+	lru.onMiss = onMiss
+}
+
+// Stats returns the gauges of StatsStruct.
+func (lru *TwoQueueCacheKeyUint64) Stats() (length, size, capacity int64) {
+	stats := lru.StatsStruct()
+	return stats.Length, stats.Size, stats.Capacity
+}
+
+// StatsStruct returns the gauges (length, size, capacity) together with the
+// hit, miss and eviction counters.
+func (lru *TwoQueueCacheKeyUint64) StatsStruct() CacheStats {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+	return CacheStats{
+		Length:    int64(len(lru.table)),
+		Size:      lru.size.Load(),
+		Capacity:  lru.capacity,
+		Hits:      lru.hits,
+		Misses:    lru.misses,
+		Evictions: lru.evictions,
+	}
+}
+
+// StatsJSON returns stats as a JSON object in a key.KeyUint64.
+func (lru *TwoQueueCacheKeyUint64) StatsJSON() string {
+	if lru == nil {
+		return "{}"
+	}
+	l, s, c := lru.Stats()
+	return fmt.Sprintf("{\"Length\": %v, \"Size\": %v, \"Capacity\": %v }", l, s, c)
+}
+
+// StatsSince returns the current stats with the counters (hits, misses,
+// evictions) expressed as the delta since prev, a snapshot previously taken
+// with StatsStruct. Gauges (length, size, capacity) are returned as-is.
+func (lru *TwoQueueCacheKeyUint64) StatsSince(prev CacheStats) CacheStats {
+	cur := lru.StatsStruct()
+	cur.Hits -= prev.Hits
+	cur.Misses -= prev.Misses
+	cur.Evictions -= prev.Evictions
+	return cur
+}
+
+// Length returns how many elements are in the cache
+func (lru *TwoQueueCacheKeyUint64) Length() int64 {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+	return int64(len(lru.table))
+}
+
+// Len is like Length but returns an int.
+func (lru *TwoQueueCacheKeyUint64) Len() int {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+	return len(lru.table)
+}
+
+// Size returns the sum of the objects' Size() method.
+func (lru *TwoQueueCacheKeyUint64) Size() int64 {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+	return lru.size.Load()
+}
+
+// SizeApprox is like Size, but reads the size without locking, so that
+// polling it, say from a metrics goroutine, doesn't contend with the cache.
+// It may lag a concurrent Set or Delete.
+func (lru *TwoQueueCacheKeyUint64) SizeApprox() int64 {
+	return lru.size.Load()
+}
+
+// Capacity returns the cache maximum capacity.
+func (lru *TwoQueueCacheKeyUint64) Capacity() int64 {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+	return lru.capacity
+}
+
+// ColdKeys is the converse of RecentKeys: it returns up to n keys in the
+// reverse of the Keys order, starting with the least recently used entry of
+// the recent queue.
+func (lru *TwoQueueCacheKeyUint64) ColdKeys(n int) []key.KeyUint64 {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	if l := len(lru.table); n > l {
+		n = l
+	}
+	if n <= 0 {
+		return []key.KeyUint64{}
+	}
+	ks := make([]key.KeyUint64, 0, n)
+	for _, l := range []*list.List{lru.recent, lru.frequent} {
+		for e := l.Back(); e != nil && len(ks) < n; e = e.Prev() {
+			ks = append(ks, e.Value.(*twoQueueKeyUint64Entry).key)
+		}
+	}
+	return ks
+}
+
+// Config returns the current configuration of the cache, for logging or
+// validating it. The fields of settings it does not support are left zero.
+func (lru *TwoQueueCacheKeyUint64) Config() CacheConfig {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+	return CacheConfig{
+		Capacity:       lru.capacity,
+		ShardCount:     1,
+		MinEntrySize:   lru.minEntrySize,
+		MinResidency:   lru.minResidency,
+		EvictionPaused: lru.evictionPaused,
+	}
+}
+
+// Keys returns all the ks for the cache: the frequent queue then the recent
+// queue, each ordered from most recently used to last recently used.
+func (lru *TwoQueueCacheKeyUint64) Keys() []key.KeyUint64 {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	ks := make([]key.KeyUint64, 0, len(lru.table))
+	lru.walk(func(v *twoQueueKeyUint64Entry) bool {
+		ks = append(ks, v.key)
+		return true
+	})
+	return ks
+}
+
+// RecentKeys is like Keys, but returns only up to the first n keys, without
+// walking or copying the rest of the cache.
+func (lru *TwoQueueCacheKeyUint64) RecentKeys(n int) []key.KeyUint64 {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	if l := len(lru.table); n > l {
+		n = l
+	}
+	if n <= 0 {
+		return []key.KeyUint64{}
+	}
+	ks := make([]key.KeyUint64, 0, n)
+	lru.walk(func(v *twoQueueKeyUint64Entry) bool {
+		ks = append(ks, v.key)
+		return len(ks) < n
+	})
+	return ks
+}
+
+// Items returns all the values for the cache, in the same order as Keys.
+func (lru *TwoQueueCacheKeyUint64) Items() []KeyUint64Item {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	items := make([]KeyUint64Item, 0, len(lru.table))
+	lru.walk(func(v *twoQueueKeyUint64Entry) bool {
+		items = append(items, KeyUint64Item{Key: v.key, Value: v.value})
+		return true
+	})
+	return items
+}
+
+// ItemsOldestFirst is like Items, but in the reverse order, the same as
+// ColdKeys.
+func (lru *TwoQueueCacheKeyUint64) ItemsOldestFirst() []KeyUint64Item {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	items := make([]KeyUint64Item, 0, len(lru.table))
+	for _, l := range []*list.List{lru.recent, lru.frequent} {
+		for e := l.Back(); e != nil; e = e.Prev() {
+			v := e.Value.(*twoQueueKeyUint64Entry)
+			items = append(items, KeyUint64Item{Key: v.key, Value: v.value})
+		}
+	}
+	return items
+}
+
+// ItemsWithSize is like Items but also reports the size stored for each
+// entry at insertion or update time, which may differ from its current
+// Size() if the value is mutable.
+func (lru *TwoQueueCacheKeyUint64) ItemsWithSize() []KeyUint64SizedItem {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	items := make([]KeyUint64SizedItem, 0, len(lru.table))
+	lru.walk(func(v *twoQueueKeyUint64Entry) bool {
+		items = append(items, KeyUint64SizedItem{Key: v.key, Value: v.value, Size: v.size})
+		return true
+	})
+	return items
+}
+
+func (lru *TwoQueueCacheKeyUint64) Values() []Cacheable {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	values := make([]Cacheable, 0, len(lru.table))
+	lru.walk(func(v *twoQueueKeyUint64Entry) bool {
+		values = append(values, v.value)
+		return true
+	})
+	return values
+}
+
+// ForEach calls fn for every entry, in the same order as Keys, and stops as
+// soon as fn returns false.
+//
+// fn is called with lru.mu read-locked: it must not call back into the
+// cache, otherwise it may deadlock.
+func (lru *TwoQueueCacheKeyUint64) ForEach(fn func(k key.KeyUint64, v Cacheable) bool) {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	lru.walk(func(v *twoQueueKeyUint64Entry) bool {
+		return fn(v.key, v.value)
+	})
+}
+
+// RangeSnapshot calls fn for every entry, in the same order as Keys, like
+// ForEach, but on a copy of the entries taken with the lock held only for the
+// copy: the cache is not blocked while fn runs, and fn may call back into
+// it. The entries fn sees may have been updated or removed from the cache
+// meanwhile.
+func (lru *TwoQueueCacheKeyUint64) RangeSnapshot(fn func(k key.KeyUint64, v Cacheable)) {
+	for _, item := range lru.Items() {
+		fn(item.Key, item.Value)
+	}
+}
+
+// UpdateAll calls fn for every entry, in the same order as Keys, without
+// affecting their positions. When fn returns keep and a non-nil newV, the
+// value is replaced with newV and its size recomputed; the old value is only
+// purged with PURGE_REASON_UPDATE if newV is a different value, so fn may
+// return v, say after updating it in place. Otherwise, including when newV is
+// nil, the entry is deleted. The cache is shrunk once the walk is over if the
+// new sizes exceed the capacity.
+//
+// fn is called with lru.mu held: it must not call back into the cache,
+// otherwise it will deadlock.
+func (lru *TwoQueueCacheKeyUint64) UpdateAll(fn func(k key.KeyUint64, v Cacheable) (newV Cacheable, keep bool)) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	for _, l := range []*list.List{lru.frequent, lru.recent} {
+		for e := l.Front(); e != nil; {
+			next := e.Next()
+			entry := e.Value.(*twoQueueKeyUint64Entry)
+			newV, keep := fn(entry.key, entry.value)
+			if !keep || newV == nil {
+				lru.remove(e)
+				lru.purge(entry, PURGE_REASON_DELETE)
+			} else if sameValue(newV, entry.value) {
+				lru.resize(entry, lru.entrySize(newV))
+			} else {
+				lru.replaceValue(entry, newV)
+			}
+			e = next
+		}
+	}
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+func (lru *TwoQueueCacheKeyUint64) walk(fn func(v *twoQueueKeyUint64Entry) bool) {
+	for _, l := range []*list.List{lru.frequent, lru.recent} {
+		for e := l.Front(); e != nil; e = e.Next() {
+			if !fn(e.Value.(*twoQueueKeyUint64Entry)) {
+				return
+			}
+		}
+	}
+}
+
+func (lru *TwoQueueCacheKeyUint64) updateInplace(element *list.Element, value Cacheable) {
+	lru.replaceValue(element.Value.(*twoQueueKeyUint64Entry), value)
+	lru.moveToFront(element)
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+// replaceValue purges the value of entry and stores value in its place,
+// keeping the sizes in step. It does not check the capacity.
+func (lru *TwoQueueCacheKeyUint64) replaceValue(entry *twoQueueKeyUint64Entry, value Cacheable) {
+	valueSize := lru.entrySize(value)
+	lru.purge(entry, PURGE_REASON_UPDATE)
+	entry.value = value
+	lru.resize(entry, valueSize)
+}
+
+// resize makes entry weigh size, keeping the sizes in step. It does not
+// check the capacity.
+func (lru *TwoQueueCacheKeyUint64) resize(entry *twoQueueKeyUint64Entry, size int64) {
+	sizeDiff := size - entry.size
+	entry.size = size
+	lru.size.Add(sizeDiff)
+	if !entry.frequent {
+		lru.recentSize += sizeDiff
+	}
+}
+
+// touch marks element as accessed: an entry in the recent queue is promoted
+// to the frequent queue, an entry already there is marked as most recently
+// used.
+func (lru *TwoQueueCacheKeyUint64) touch(element *list.Element) {
+	entry := element.Value.(*twoQueueKeyUint64Entry)
+	if entry.frequent {
+		lru.frequent.MoveToFront(element)
+		return
+	}
+	lru.recent.Remove(element)
+	lru.recentSize -= entry.size
+	entry.frequent = true
+	lru.table[entry.key] = lru.frequent.PushFront(entry)
+}
+
+// moveToFront marks element as most recently used within its own queue.
+func (lru *TwoQueueCacheKeyUint64) moveToFront(element *list.Element) {
+	if element.Value.(*twoQueueKeyUint64Entry).frequent {
+		lru.frequent.MoveToFront(element)
+	} else {
+		lru.recent.MoveToFront(element)
+	}
+}
+
+func (lru *TwoQueueCacheKeyUint64) addNew(k key.KeyUint64, value Cacheable) {
+	newEntry := &twoQueueKeyUint64Entry{key: k, value: value, size: lru.entrySize(value)}
+	if !lru.admit(newEntry) {
+		return
+	}
+	element := lru.recent.PushFront(newEntry)
+	lru.table[k] = element
+	lru.size.Add(newEntry.size)
+	lru.recentSize += newEntry.size
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+// admit reports whether newEntry may be stored, and stamps its insertion
+// time if so. Otherwise it would only be evicted right away, along with
+// everything else, so it is evicted on its own instead.
+func (lru *TwoQueueCacheKeyUint64) admit(newEntry *twoQueueKeyUint64Entry) bool {
+	if lru.capacity <= 0 || newEntry.size > lru.capacity {
+		lru.evict(newEntry, PURGE_REASON_CACHEFULL)
+		return false
+	}
+	if lru.minResidency > 0 {
+		newEntry.inserted = time.Now()
+	}
+	return true
+}
+
+// entrySize is the weight of value toward the capacity.
+func (lru *TwoQueueCacheKeyUint64) entrySize(value Cacheable) int64 {
+	if size := getSize(value); size > lru.minEntrySize {
+		return size
+	}
+	return lru.minEntrySize
+}
+
+func (lru *TwoQueueCacheKeyUint64) remove(element *list.Element) {
+	entry := element.Value.(*twoQueueKeyUint64Entry)
+	if entry.frequent {
+		lru.frequent.Remove(element)
+	} else {
+		lru.recent.Remove(element)
+		lru.recentSize -= entry.size
+	}
+	delete(lru.table, entry.key)
+	lru.size.Add(-entry.size)
+}
+
+func (lru *TwoQueueCacheKeyUint64) checkCapacity(why PurgeReason) {
+	if lru.evictionPaused {
+		return
+	}
+	var now time.Time
+	if lru.minResidency > 0 {
+		now = time.Now()
+	}
+	recentCapacity := lru.capacity / twoQueueRecentRatio
+	if recentCapacity < 1 {
+		recentCapacity = 1
+	}
+	for lru.size.Load() > lru.capacity {
+		// evict from the recent queue while it is over its share, or when
+		// the frequent queue is empty
+		first, second := lru.frequent, lru.recent
+		if lru.recent.Len() > 0 && (lru.recentSize > recentCapacity || lru.frequent.Len() == 0) {
+			first, second = lru.recent, lru.frequent
+		}
+		delElem := lru.oldestEvictable(first, now)
+		if delElem == nil {
+			delElem = lru.oldestEvictable(second, now)
+		}
+		if delElem == nil {
+			// empty, or everything left is protected by minResidency
+			return
+		}
+		lru.remove(delElem)
+		lru.evict(delElem.Value.(*twoQueueKeyUint64Entry), why)
+	}
+}
+
+// oldestEvictable returns the least recently used element of l that has been
+// resident for at least minResidency, or nil if there is none.
+func (lru *TwoQueueCacheKeyUint64) oldestEvictable(l *list.List, now time.Time) *list.Element {
+	for e := l.Back(); e != nil; e = e.Prev() {
+		if lru.minResidency <= 0 || now.Sub(e.Value.(*twoQueueKeyUint64Entry).inserted) >= lru.minResidency {
+			return e
+		}
+	}
+	return nil
+}
+
+// evict counts entry as an eviction, reports it to SetReturningEvicted and
+// EvictionChannel, and purges it.
+func (lru *TwoQueueCacheKeyUint64) evict(entry *twoQueueKeyUint64Entry, why PurgeReason) {
+	lru.evictions++
+	if lru.evictedSink != nil {
+		*lru.evictedSink = append(*lru.evictedSink, KeyUint64Item{Key: entry.key, Value: entry.value})
+	}
+	if lru.evictionCh != nil {
+		select {
+		case lru.evictionCh <- KeyUint64Item{Key: entry.key, Value: entry.value}:
+		default:
+			lru.droppedNotifications++
+		}
+	}
+	lru.purge(entry, why)
+}
+
+// purge notifies the value, the OnEvict handler and the logger that entry
+// is leaving the cache, or that its value is being replaced.
+func (lru *TwoQueueCacheKeyUint64) purge(entry *twoQueueKeyUint64Entry, why PurgeReason) {
+	if why != PURGE_REASON_UPDATE && lru.logger != nil {
+		lru.logger("evict", map[string]interface{}{"key": entry.key, "size": entry.size, "reason": why})
+	}
+	safeOnPurge(entry.value, why)
+	if lru.onEvict != nil {
+		lru.onEvict(entry.key, entry.value, why)
+	}
+}
+
+func (lru *TwoQueueCacheKeyUint64) logMiss(k key.KeyUint64) {
+	if lru.logger == nil || !lru.logMisses {
+		return
+	}
+	lru.logger("miss", map[string]interface{}{"key": k})
+}
@@ -0,0 +1,294 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lru
+
+import (
+	"context"
+	"encoding/json"
+	key "github.com/0studio/storage_key"
+	"testing"
+	"time"
+)
+
+func TestTwoQueueKeyUint64InitialState(t *testing.T) {
+	cache := NewTwoQueueCacheKeyUint64(5)
+	l, sz, c := cache.Stats()
+	if l != 0 {
+		t.Errorf("length = %v, want 0", l)
+	}
+	if sz != 0 {
+		t.Errorf("size = %v, want 0", sz)
+	}
+	if c != 5 {
+		t.Errorf("capacity = %v, want 5", c)
+	}
+}
+
+func TestTwoQueueKeyUint64SetInsertsValue(t *testing.T) {
+	cache := NewTwoQueueCacheKeyUint64(100)
+	data := &CacheValue{0}
+	var k key.KeyUint64 = 1
+	cache.Set(k, data)
+
+	v, ok := cache.Get(k)
+	if !ok || v.(*CacheValue) != data {
+		t.Errorf("Cache has incorrect value: %v != %v", data, v)
+	}
+
+	keys := cache.Keys()
+	if len(keys) != 1 || keys[0] != k {
+		t.Errorf("Cache.Keys() returned incorrect items: %v", k)
+	}
+	items := cache.Items()
+	if len(items) != 1 || items[0].Key != k {
+		t.Errorf("Cache.Values() returned incorrect items: %v", items)
+	}
+	values := cache.Values()
+	if len(values) != 1 {
+		t.Errorf("Cache.Values() returned incorrect values: %v", values)
+	}
+}
+
+func TestTwoQueueKeyUint64SetIfAbsent(t *testing.T) {
+	cache := NewTwoQueueCacheKeyUint64(100)
+	data := &CacheValue{0}
+	var k key.KeyUint64 = 1
+	cache.SetIfAbsent(k, data)
+	cache.SetIfAbsent(k, &CacheValue{1})
+
+	v, ok := cache.Get(k)
+	if !ok || v.(*CacheValue) != data {
+		t.Errorf("Cache has incorrect value: %v != %v", data, v)
+	}
+}
+
+func TestTwoQueueKeyUint64SetWithOldKeyUpdatesSize(t *testing.T) {
+	cache := NewTwoQueueCacheKeyUint64(100)
+	k := key.KeyUint64(1)
+	cache.Set(k, &CacheValue{0})
+	cache.Set(k, &CacheValue{20})
+	if _, sz, _ := cache.Stats(); sz != 20 {
+		t.Errorf("cache.Size() = %v, expected 20", sz)
+	}
+	cache.Get(k) // promoted to the frequent queue
+	cache.Set(k, &CacheValue{10})
+	if _, sz, _ := cache.Stats(); sz != 10 {
+		t.Errorf("cache.Size() = %v, expected 10", sz)
+	}
+}
+
+func TestTwoQueueKeyUint64Delete(t *testing.T) {
+	cache := NewTwoQueueCacheKeyUint64(100)
+	value := &PurgeCacheValueKeyUint64{}
+	var k key.KeyUint64 = 1
+
+	if cache.Delete(k) {
+		t.Error("Item unexpectedly already in cache.")
+	}
+	cache.Set(k, value)
+	cache.Get(k)
+	purgeReasonFlag4TestKeyUint64 = PURGE_REASON_CACHEFULL // init
+	if !cache.Delete(k) {
+		t.Error("Expected item to be in cache.")
+	}
+	if purgeReasonFlag4TestKeyUint64 != PURGE_REASON_DELETE {
+		t.Errorf("after cache.Delete ,purgeReason should be %d ,but get %d", PURGE_REASON_DELETE, purgeReasonFlag4TestKeyUint64)
+	}
+	if _, sz, _ := cache.Stats(); sz != 0 {
+		t.Errorf("cache.Size() = %v, expected 0", sz)
+	}
+	if _, ok := cache.Get(k); ok {
+		t.Error("Cache returned a value after deletion.")
+	}
+}
+
+func TestTwoQueueKeyUint64Clear(t *testing.T) {
+	cache := NewTwoQueueCacheKeyUint64(100)
+	cache.Set(1, &CacheValue{1})
+	cache.Set(2, &PurgeCacheValueKeyUint64{})
+	cache.Get(2)
+	purgeReasonFlag4TestKeyUint64 = PURGE_REASON_DELETE // init
+	cache.Clear()
+
+	if l, sz, _ := cache.Stats(); l != 0 || sz != 0 {
+		t.Errorf("cache length, size = %v, %v, expected 0 after Clear()", l, sz)
+	}
+	if purgeReasonFlag4TestKeyUint64 != PURGE_REASON_CLEAR_ALL {
+		t.Errorf("after cache.Clear ,purgeReason should be %d ,but get %d", PURGE_REASON_CLEAR_ALL, purgeReasonFlag4TestKeyUint64)
+	}
+}
+
+func TestTwoQueueKeyUint64CapacityIsObeyed(t *testing.T) {
+	size := int64(3)
+	cache := NewTwoQueueCacheKeyUint64(100)
+	cache.SetCapacity(size)
+	value := &CacheValue{1}
+
+	cache.Set(1, value)
+	cache.Set(2, value)
+	cache.Set(3, value)
+	cache.Set(4, value)
+	if _, sz, _ := cache.Stats(); sz != size {
+		t.Errorf("post-evict cache.Size() = %v, expected %v", sz, size)
+	}
+
+	data := cache.StatsJSON()
+	m := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		t.Errorf("cache.StatsJSON() returned bad json data: %v %v", data, err)
+	}
+	if m["Size"].(float64) != float64(size) {
+		t.Errorf("cache.StatsJSON() returned bad size: %v", m)
+	}
+}
+
+func TestTwoQueueKeyUint64ScanResistance(t *testing.T) {
+	cache := NewTwoQueueCacheKeyUint64(8)
+	for k := key.KeyUint64(1); k <= 4; k++ {
+		cache.Set(k, &CacheValue{1})
+		cache.Get(k) // seen twice: promoted to the frequent queue
+	}
+
+	// a scan touching many keys once
+	for k := key.KeyUint64(100); k < 200; k++ {
+		cache.Set(k, &CacheValue{1})
+	}
+
+	for k := key.KeyUint64(1); k <= 4; k++ {
+		if !cache.Contains(k) {
+			t.Errorf("hot key %v was evicted by a scan", k)
+		}
+	}
+	if sz := cache.Size(); sz != 8 {
+		t.Errorf("cache.Size() = %v, expected 8", sz)
+	}
+	if keys := cache.Keys(); len(keys) != 8 || keys[0] != 4 {
+		t.Errorf("cache.Keys() = %v, expected frequent queue first", keys)
+	}
+}
+
+func TestTwoQueueKeyUint64OnMiss(t *testing.T) {
+	cache := NewTwoQueueCacheKeyUint64(1)
+	cache.OnMiss(func(k key.KeyUint64) (Cacheable, bool) {
+		return 1, true
+	})
+	v, ok := cache.Get(1)
+	if !ok || v != 1 {
+		t.Errorf("lru.onMiss is errror")
+	}
+	if _, ok := cache.Peek(1); !ok {
+		t.Error("value loaded by onMiss was not stored")
+	}
+}
+
+func TestTwoQueueKeyUint64StatsStruct(t *testing.T) {
+	cache := NewTwoQueueCacheKeyUint64(2)
+	cache.Set(1, &CacheValue{1})
+	prev := cache.StatsStruct()
+	cache.Get(1)
+	cache.Get(2)
+	cache.Set(2, &CacheValue{1})
+	cache.Set(3, &CacheValue{1})
+
+	want := CacheStats{Length: 2, Size: 2, Capacity: 2, Hits: 1, Misses: 1, Evictions: 1}
+	if stats := cache.StatsSince(prev); stats != want {
+		t.Errorf("cache.StatsSince() = %+v, expected %+v", stats, want)
+	}
+}
+
+func TestTwoQueueKeyUint64SetReturningEvicted(t *testing.T) {
+	cache := NewTwoQueueCacheKeyUint64(2)
+	var evictedByHandler []key.KeyUint64
+	cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+		if why == PURGE_REASON_CACHEFULL {
+			evictedByHandler = append(evictedByHandler, k)
+		}
+	})
+	cache.Set(1, &CacheValue{1})
+	cache.Set(2, &CacheValue{1})
+
+	if evicted := cache.SetReturningEvicted(3, &CacheValue{1}); len(evicted) != 1 || evicted[0].Key != 1 {
+		t.Errorf("SetReturningEvicted(3) = %v, expected key 1", evicted)
+	}
+	big := &CacheValue{3}
+	if evicted := cache.SetReturningEvicted(4, big); len(evicted) != 1 || evicted[0].Value != big {
+		t.Errorf("SetReturningEvicted(4) = %v, expected the oversize value", evicted)
+	}
+	if len(evictedByHandler) != 2 || evictedByHandler[0] != 1 || evictedByHandler[1] != 4 {
+		t.Errorf("OnEvict saw %v, expected [1 4]", evictedByHandler)
+	}
+}
+
+func TestTwoQueueKeyUint64MinResidency(t *testing.T) {
+	cache := NewTwoQueueCacheKeyUint64(2)
+	cache.Set(1, &CacheValue{1})
+	cache.Set(2, &CacheValue{1})
+	cache.SetMinResidency(time.Hour)
+	cache.Set(3, &CacheValue{1})
+
+	if keys := cache.Keys(); len(keys) != 2 || keys[0] != 3 || keys[1] != 2 {
+		t.Errorf("cache.Keys() = %v, expected [3 2]", keys)
+	}
+	cache.Set(4, &CacheValue{1}) // evicts 2, stored before SetMinResidency
+	cache.Set(5, &CacheValue{1})
+	if sz := cache.Size(); sz != 3 {
+		t.Errorf("cache.Size() = %v, expected 3 with only young entries left", sz)
+	}
+}
+
+func TestTwoQueueKeyUint64Restore(t *testing.T) {
+	cache := NewTwoQueueCacheKeyUint64(3)
+	cache.Set(1, &CacheValue{1})
+	cache.Get(1)
+	cache.Set(2, &CacheValue{1})
+	snapshot := cache.Snapshot()
+
+	restored := NewTwoQueueCacheKeyUint64(2)
+	restored.Set(9, &CacheValue{1})
+	restored.Restore(append(snapshot, KeyUint64Item{Key: 3, Value: &CacheValue{5}}))
+	if keys := restored.Keys(); len(keys) != 2 || keys[0] != 1 || keys[1] != 2 {
+		t.Errorf("restored.Keys() = %v, expected [1 2]", keys)
+	}
+	if sz := restored.Size(); sz != 2 {
+		t.Errorf("restored.Size() = %v, expected 2 without the oversize item", sz)
+	}
+}
+
+func TestTwoQueueKeyUint64UpdateAll(t *testing.T) {
+	cache := NewTwoQueueCacheKeyUint64(10)
+	cache.Set(1, &CacheValue{1})
+	cache.Get(1)
+	cache.Set(2, &CacheValue{1})
+	cache.Set(3, &CacheValue{1})
+	cache.UpdateAll(func(k key.KeyUint64, v Cacheable) (Cacheable, bool) {
+		return &CacheValue{4}, k != 2
+	})
+
+	if items := cache.ItemsWithSize(); len(items) != 2 || items[0].Key != 1 || items[0].Size != 4 || items[1].Key != 3 {
+		t.Errorf("cache.ItemsWithSize() = %v, expected keys 1 and 3 of size 4", items)
+	}
+	if sz := cache.Size(); sz != 8 {
+		t.Errorf("cache.Size() = %v, expected 8", sz)
+	}
+}
+
+func TestTwoQueueKeyUint64GetMultiCtx(t *testing.T) {
+	cache := NewTwoQueueCacheKeyUint64(10)
+	cache.Set(1, &CacheValue{1})
+	cache.OnMiss(func(k key.KeyUint64) (Cacheable, bool) {
+		return &CacheValue{1}, k != 3
+	})
+
+	results := cache.GetMultiCtx(context.Background(), []key.KeyUint64{1, 2, 3})
+	if len(results) != 2 || results[1] == nil || results[2] == nil {
+		t.Errorf("GetMultiCtx() = %v, expected keys 1 and 2", results)
+	}
+	if !cache.Contains(2) || cache.Contains(3) {
+		t.Error("GetMultiCtx() should store the loaded value only")
+	}
+	if stats := cache.StatsStruct(); stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("cache.StatsStruct() = %+v, expected 1 hit and 2 misses", stats)
+	}
+}
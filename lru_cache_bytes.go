@@ -0,0 +1,277 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lru
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// BytesItem is what is stored in the cache
+type BytesItem struct {
+	Key   []byte
+	Value Cacheable
+}
+
+type OnMissHandlerBytes func(k []byte) (Cacheable, bool)
+
+// LRUCacheBytes is a typical LRU cache implementation keyed by []byte, for
+// binary identifiers, without allocating a string on every lookup. If the
+// cache reaches the capacity, the least recently used item is deleted from
+// the cache. Note the capacity is not the number of items, but the total sum
+// of the Size() of each item.
+//
+// Keys are copied when stored, so the caller may reuse a key once the call
+// storing it returns.
+type LRUCacheBytes struct {
+	mu sync.Mutex
+
+	// list & table of *bytesEntry objects
+	list  *list.List
+	table map[string]*list.Element
+
+	// Our current size. Obviously a gross simplification and
+	// low-grade approximation.
+	size int64
+
+	// How much we are limiting the cache to.
+	capacity int64
+	onMiss   OnMissHandlerBytes
+}
+type bytesEntry struct {
+	key   string // a copy of the []byte key
+	value Cacheable
+	size  int64
+}
+
+// NewLRUCacheBytes creates a new empty cache with the given capacity.
+func NewLRUCacheBytes(capacity int64) *LRUCacheBytes {
+	return &LRUCacheBytes{
+		list:     list.New(),
+		table:    make(map[string]*list.Element),
+		capacity: capacity,
+	}
+}
+
+// Get returns a value from the cache, and marks the bytesEntry as most
+// recently used. It does not allocate on a hit: the compiler looks
+// lru.table[string(k)] up without copying k.
+func (lru *LRUCacheBytes) Get(k []byte) (v Cacheable, ok bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element := lru.table[string(k)]
+	if element == nil {
+		if lru.onMiss == nil {
+			return nil, false
+		}
+		v, ok = lru.onMiss(k)
+		if v == nil {
+			// a nil value is reported as a miss rather than cached
+			ok = false
+		}
+		if ok {
+			lru.set(k, v)
+		}
+		return
+	}
+	lru.moveToFront(element)
+	return element.Value.(*bytesEntry).value, true
+}
+
+// Set sets a value in the cache. k is copied if it was not cached yet.
+func (lru *LRUCacheBytes) Set(k []byte, value Cacheable) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.set(k, value)
+}
+func (lru *LRUCacheBytes) set(k []byte, value Cacheable) {
+	if element := lru.table[string(k)]; element != nil {
+		lru.updateInplace(element, value)
+	} else {
+		lru.addNew(k, value)
+	}
+}
+
+// SetIfAbsent will set the value in the cache if not present. If the
+// value exists in the cache, we don't set it.
+func (lru *LRUCacheBytes) SetIfAbsent(k []byte, value Cacheable) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	if element := lru.table[string(k)]; element != nil {
+		lru.moveToFront(element)
+	} else {
+		lru.addNew(k, value)
+	}
+}
+
+// Delete removes an bytesEntry from the cache, and returns if the bytesEntry existed.
+func (lru *LRUCacheBytes) Delete(k []byte) bool {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element := lru.table[string(k)]
+	if element == nil {
+		return false
+	}
+
+	lru.list.Remove(element)
+	delete(lru.table, element.Value.(*bytesEntry).key)
+	lru.size -= element.Value.(*bytesEntry).size
+	safeOnPurge(element.Value.(*bytesEntry).value, PURGE_REASON_DELETE)
+	return true
+}
+
+// Clear will clear the entire cache.
+func (lru *LRUCacheBytes) Clear() {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	for e := lru.list.Front(); e != nil; e = e.Next() {
+		safeOnPurge(e.Value.(*bytesEntry).value, PURGE_REASON_CLEAR_ALL)
+	}
+
+	lru.list.Init()
+	lru.table = make(map[string]*list.Element)
+	lru.size = 0
+}
+
+// SetCapacity will set the capacity of the cache. If the capacity is
+// smaller, and the current cache size exceed that capacity, the cache
+// will be shrank, purging the evicted elements with
+// PURGE_REASON_CAPACITY_SHRINK.
+func (lru *LRUCacheBytes) SetCapacity(capacity int64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.capacity = capacity
+	lru.checkCapacity(PURGE_REASON_CAPACITY_SHRINK)
+}
+func (lru *LRUCacheBytes) OnMiss(onMiss OnMissHandlerBytes) {
+	lru.onMiss = onMiss
+}
+
+// Stats
+func (lru *LRUCacheBytes) Stats() (length, size, capacity int64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return int64(lru.list.Len()), lru.size, lru.capacity
+}
+
+// StatsJSON returns stats as a JSON object in a string.
+func (lru *LRUCacheBytes) StatsJSON() string {
+	if lru == nil {
+		return "{}"
+	}
+	l, s, c := lru.Stats()
+	return fmt.Sprintf("{\"Length\": %v, \"Size\": %v, \"Capacity\": %v }", l, s, c)
+}
+
+// Length returns how many elements are in the cache
+func (lru *LRUCacheBytes) Length() int64 {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return int64(lru.list.Len())
+}
+
+// Size returns the sum of the objects' Size() method.
+func (lru *LRUCacheBytes) Size() int64 {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return lru.size
+}
+
+// Capacity returns the cache maximum capacity.
+func (lru *LRUCacheBytes) Capacity() int64 {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return lru.capacity
+}
+
+// Keys returns copies of all the ks for the cache, ordered from most
+// recently used to last recently used.
+func (lru *LRUCacheBytes) Keys() [][]byte {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	ks := make([][]byte, 0, lru.list.Len())
+	for e := lru.list.Front(); e != nil; e = e.Next() {
+		ks = append(ks, []byte(e.Value.(*bytesEntry).key))
+	}
+	return ks
+}
+
+// Items returns all the values for the cache, ordered from most recently
+// used to last recently used. The keys are copies.
+func (lru *LRUCacheBytes) Items() []BytesItem {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	items := make([]BytesItem, 0, lru.list.Len())
+	for e := lru.list.Front(); e != nil; e = e.Next() {
+		v := e.Value.(*bytesEntry)
+		items = append(items, BytesItem{Key: []byte(v.key), Value: v.value})
+	}
+	return items
+}
+
+func (lru *LRUCacheBytes) Values() []Cacheable {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	values := make([]Cacheable, 0, lru.list.Len())
+	for e := lru.list.Front(); e != nil; e = e.Next() {
+		v := e.Value.(*bytesEntry)
+		values = append(values, v.value)
+	}
+	return values
+}
+func (lru *LRUCacheBytes) updateInplace(element *list.Element, value Cacheable) {
+	valueSize := getSize(value)
+	sizeDiff := valueSize - element.Value.(*bytesEntry).size
+	safeOnPurge(element.Value.(*bytesEntry).value, PURGE_REASON_UPDATE)
+	element.Value.(*bytesEntry).value = value
+	element.Value.(*bytesEntry).size = valueSize
+	lru.size += sizeDiff
+	lru.moveToFront(element)
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+func (lru *LRUCacheBytes) moveToFront(element *list.Element) {
+	lru.list.MoveToFront(element)
+}
+
+func (lru *LRUCacheBytes) addNew(k []byte, value Cacheable) {
+	size := getSize(value)
+	if lru.capacity <= 0 || size > lru.capacity {
+		// it would only be evicted right away, along with everything else
+		safeOnPurge(value, PURGE_REASON_CACHEFULL)
+		return
+	}
+	// the only place the key is kept: copy it away from the caller
+	newEntry := &bytesEntry{string(k), value, size}
+	element := lru.list.PushFront(newEntry)
+	lru.table[newEntry.key] = element
+	lru.size += newEntry.size
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+func (lru *LRUCacheBytes) checkCapacity(why PurgeReason) {
+	// Partially duplicated from Delete
+	for lru.size > lru.capacity {
+		delElem := lru.list.Back()
+		if delElem == nil {
+			// empty, yet over a negative capacity
+			break
+		}
+		delValue := delElem.Value.(*bytesEntry)
+		lru.list.Remove(delElem)
+		delete(lru.table, delValue.key)
+		lru.size -= delValue.size
+		safeOnPurge(delValue.value, why)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lru
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBytesSetCopiesKey(t *testing.T) {
+	cache := NewLRUCacheBytes(100)
+	data := &CacheValue{1}
+	k := []byte("key1")
+	cache.Set(k, data)
+	k[3] = '2' // the caller reuses its buffer
+
+	if v, ok := cache.Get([]byte("key1")); !ok || v.(*CacheValue) != data {
+		t.Errorf("Cache has incorrect value: %v != %v", data, v)
+	}
+	if v, ok := cache.Get(k); ok {
+		t.Errorf("Get(%s) = %v, want miss", k, v)
+	}
+	if keys := cache.Keys(); len(keys) != 1 || !bytes.Equal(keys[0], []byte("key1")) {
+		t.Errorf("cache.Keys() = %q, want [key1]", keys)
+	}
+	if items := cache.Items(); len(items) != 1 || !bytes.Equal(items[0].Key, []byte("key1")) {
+		t.Errorf("cache.Items() = %v, want key1", items)
+	}
+}
+
+func TestBytesDelete(t *testing.T) {
+	cache := NewLRUCacheBytes(100)
+	value := &CacheValue{1}
+	k := []byte("key")
+	if cache.Delete(k) {
+		t.Error("Item unexpectedly already in cache.")
+	}
+	cache.Set(k, value)
+	if !cache.Delete(k) {
+		t.Error("Expected item to be in cache.")
+	}
+	if l, sz, _ := cache.Stats(); l != 0 || sz != 0 {
+		t.Errorf("cache.Stats() = %v, %v, want 0, 0", l, sz)
+	}
+	if _, ok := cache.Get(k); ok {
+		t.Error("Cache returned a value after deletion.")
+	}
+}
+
+func TestBytesLRUIsEvicted(t *testing.T) {
+	cache := NewLRUCacheBytes(3)
+	for _, k := range []string{"k1", "k2", "k3"} {
+		cache.Set([]byte(k), &CacheValue{1})
+	}
+	cache.Get([]byte("k1"))
+	cache.Set([]byte("k4"), &CacheValue{1})
+	// lru: [k4, k1, k3]
+
+	if _, ok := cache.Get([]byte("k2")); ok {
+		t.Error("Least recently used element was not evicted.")
+	}
+	if keys := cache.Keys(); len(keys) != 3 || string(keys[0]) != "k4" || string(keys[1]) != "k1" || string(keys[2]) != "k3" {
+		t.Errorf("cache.Keys() = %q, want [k4 k1 k3]", keys)
+	}
+}
+
+func TestBytesOnMiss(t *testing.T) {
+	cache := NewLRUCacheBytes(100)
+	cache.OnMiss(func(k []byte) (Cacheable, bool) {
+		return &CacheValue{len(k)}, true
+	})
+	k := []byte("abc")
+	if v, ok := cache.Get(k); !ok || v.(*CacheValue).size != 3 {
+		t.Errorf("Get(abc) = %v, %v, want a value of size 3", v, ok)
+	}
+	k[0] = 'x'
+	if keys := cache.Keys(); len(keys) != 1 || string(keys[0]) != "abc" {
+		t.Errorf("cache.Keys() = %q, want [abc]", keys)
+	}
+}
+
+func TestBytesGetDoesNotAllocate(t *testing.T) {
+	cache := NewLRUCacheBytes(100)
+	k := []byte("0123456789abcdef")
+	cache.Set(k, &CacheValue{1})
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, ok := cache.Get(k); !ok {
+			t.Fatal("Get missed")
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Get allocated %v times, want 0", allocs)
+	}
+}
+
+func BenchmarkBytesGet(b *testing.B) {
+	cache := NewLRUCacheBytes(64 * 1024 * 1024)
+	k := []byte("0123456789abcdef0123456789abcdef")
+	cache.Set(k, make(MyValue, 1000))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := cache.Get(k); !ok {
+			panic("error")
+		}
+	}
+}
+
+// BenchmarkBytesGetViaString is the conversion LRUCacheBytes avoids.
+func BenchmarkBytesGetViaString(b *testing.B) {
+	cache := NewLRUCacheString(64 * 1024 * 1024)
+	k := []byte("0123456789abcdef0123456789abcdef")
+	cache.Set(string(k), make(MyValue, 1000))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := cache.Get(string(k)); !ok {
+			panic("error")
+		}
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cache implements a LRU cache.
+//
+// The implementation borrows heavily from SmallLRUCacheInt
+// (originally by Nathan Schrenk). The object maintains a doubly-linked list of
+// elements. When an element is accessed, it is promoted to the head of the
+// list. When space is needed, the element at the tail of the list
+// (the least recently used element) is evicted.
+//
+// DenseLRUCacheInt indexes its elements with a slice rather than a map, for
+// small and dense key spaces.
+package lru
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// DenseLRUCacheInt is a LRUCacheInt for keys in the range [0, maxKey]. Keys
+// outside that range are never cached: Get misses without calling onMiss,
+// Set and SetIfAbsent ignore them, and Delete returns false. Note the
+// capacity is not the number of items, but the total sum of the Size() of
+// each item.
+type DenseLRUCacheInt struct {
+	mu sync.Mutex
+
+	// list & table of *denseIntEntry objects
+	list  *list.List
+	table []*list.Element
+
+	// Our current size. Obviously a gross simplification and
+	// low-grade approximation.
+	size int64
+
+	// How much we are limiting the cache to.
+	capacity int64
+	onMiss   OnMissHandlerInt
+}
+type denseIntEntry struct {
+	key   int
+	value Cacheable
+	size  int64
+}
+
+// NewDenseLRUCacheInt creates a new empty cache for keys in [0, maxKey]
+// with the given capacity. A negative maxKey leaves no key in range, so the
+// cache stays empty.
+func NewDenseLRUCacheInt(maxKey int, capacity int64) *DenseLRUCacheInt {
+	if maxKey < 0 {
+		maxKey = -1
+	}
+	return &DenseLRUCacheInt{
+		list:     list.New(),
+		table:    make([]*list.Element, maxKey+1),
+		capacity: capacity,
+	}
+}
+
+// Get returns a value from the cache, and marks the denseIntEntry as most
+// recently used.
+func (lru *DenseLRUCacheInt) Get(k int) (v Cacheable, ok bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	if !lru.inRange(k) {
+		return nil, false
+	}
+	element := lru.table[k]
+	if element == nil {
+		if lru.onMiss == nil {
+			return nil, false
+		}
+		v, ok = lru.onMiss(k)
+		if v == nil {
+			// a nil value is reported as a miss rather than cached
+			ok = false
+		}
+		if ok {
+			lru.set(k, v)
+		}
+		return
+	}
+	lru.moveToFront(element)
+	return element.Value.(*denseIntEntry).value, true
+}
+
+// Set sets a value in the cache.
+func (lru *DenseLRUCacheInt) Set(k int, value Cacheable) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.set(k, value)
+}
+func (lru *DenseLRUCacheInt) set(k int, value Cacheable) {
+	if !lru.inRange(k) {
+		return
+	}
+	if element := lru.table[k]; element != nil {
+		lru.updateInplace(element, value)
+	} else {
+		lru.addNew(k, value)
+	}
+}
+
+// SetIfAbsent will set the value in the cache if not present. If the
+// value exists in the cache, we don't set it.
+func (lru *DenseLRUCacheInt) SetIfAbsent(k int, value Cacheable) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	if !lru.inRange(k) {
+		return
+	}
+	if element := lru.table[k]; element != nil {
+		lru.moveToFront(element)
+	} else {
+		lru.addNew(k, value)
+	}
+}
+
+// Delete removes an denseIntEntry from the cache, and returns if the denseIntEntry existed.
+func (lru *DenseLRUCacheInt) Delete(k int) bool {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	if !lru.inRange(k) {
+		return false
+	}
+	element := lru.table[k]
+	if element == nil {
+		return false
+	}
+
+	lru.list.Remove(element)
+	lru.table[k] = nil
+	lru.size -= element.Value.(*denseIntEntry).size
+	safeOnPurge(element.Value.(*denseIntEntry).value, PURGE_REASON_DELETE)
+	return true
+}
+
+// Clear will clear the entire cache.
+func (lru *DenseLRUCacheInt) Clear() {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	for e := lru.list.Front(); e != nil; e = e.Next() {
+		safeOnPurge(e.Value.(*denseIntEntry).value, PURGE_REASON_CLEAR_ALL)
+	}
+
+	lru.list.Init()
+	lru.table = make([]*list.Element, len(lru.table))
+	lru.size = 0
+}
+
+// SetCapacity will set the capacity of the cache. If the capacity is
+// smaller, and the current cache size exceed that capacity, the cache
+// will be shrank, purging the evicted elements with
+// PURGE_REASON_CAPACITY_SHRINK.
+func (lru *DenseLRUCacheInt) SetCapacity(capacity int64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.capacity = capacity
+	lru.checkCapacity(PURGE_REASON_CAPACITY_SHRINK)
+}
+func (lru *DenseLRUCacheInt) OnMiss(onMiss OnMissHandlerInt) {
+	lru.onMiss = onMiss
+}
+
+// Stats
+func (lru *DenseLRUCacheInt) Stats() (length, size, capacity int64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	// if lastElem := lru.list.Back(); lastElem != nil {
+	// 	oldest = lastElem.Value.(*denseIntEntry).time_accessed
+	// }
+	return int64(lru.list.Len()), lru.size, lru.capacity
+}
+
+// StatsJSON returns stats as a JSON object in a int.
+func (lru *DenseLRUCacheInt) StatsJSON() string {
+	if lru == nil {
+		return "{}"
+	}
+	l, s, c := lru.Stats()
+	return fmt.Sprintf("{\"Length\": %v, \"Size\": %v, \"Capacity\": %v }", l, s, c)
+}
+
+// Length returns how many elements are in the cache
+func (lru *DenseLRUCacheInt) Length() int64 {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return int64(lru.list.Len())
+}
+
+// Size returns the sum of the objects' Size() method.
+func (lru *DenseLRUCacheInt) Size() int64 {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return lru.size
+}
+
+// Capacity returns the cache maximum capacity.
+func (lru *DenseLRUCacheInt) Capacity() int64 {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return lru.capacity
+}
+
+// Keys returns all the ks for the cache, ordered from most recently
+// used to last recently used.
+func (lru *DenseLRUCacheInt) Keys() []int {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	ks := make([]int, 0, lru.list.Len())
+	for e := lru.list.Front(); e != nil; e = e.Next() {
+		ks = append(ks, e.Value.(*denseIntEntry).key)
+	}
+	return ks
+}
+
+// Items returns all the values for the cache, ordered from most recently
+// used to last recently used.
+func (lru *DenseLRUCacheInt) Items() []IntItem {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	items := make([]IntItem, 0, lru.list.Len())
+	for e := lru.list.Front(); e != nil; e = e.Next() {
+		v := e.Value.(*denseIntEntry)
+		items = append(items, IntItem{Key: v.key, Value: v.value})
+	}
+	return items
+}
+
+func (lru *DenseLRUCacheInt) Values() []Cacheable {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	values := make([]Cacheable, 0, lru.list.Len())
+	for e := lru.list.Front(); e != nil; e = e.Next() {
+		v := e.Value.(*denseIntEntry)
+		values = append(values, v.value)
+	}
+	return values
+}
+func (lru *DenseLRUCacheInt) updateInplace(element *list.Element, value Cacheable) {
+	valueSize := getSize(value)
+	sizeDiff := valueSize - element.Value.(*denseIntEntry).size
+	safeOnPurge(element.Value.(*denseIntEntry).value, PURGE_REASON_UPDATE)
+	element.Value.(*denseIntEntry).value = value
+	element.Value.(*denseIntEntry).size = valueSize
+	lru.size += sizeDiff
+	lru.moveToFront(element)
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+func (lru *DenseLRUCacheInt) inRange(k int) bool {
+	return k >= 0 && k < len(lru.table)
+}
+
+func (lru *DenseLRUCacheInt) moveToFront(element *list.Element) {
+	lru.list.MoveToFront(element)
+}
+
+func (lru *DenseLRUCacheInt) addNew(k int, value Cacheable) {
+	newEntry := &denseIntEntry{k, value, getSize(value)}
+	if lru.capacity <= 0 || newEntry.size > lru.capacity {
+		// it would only be evicted right away, along with everything else
+		safeOnPurge(value, PURGE_REASON_CACHEFULL)
+		return
+	}
+	element := lru.list.PushFront(newEntry)
+	lru.table[k] = element
+	lru.size += newEntry.size
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+func (lru *DenseLRUCacheInt) checkCapacity(why PurgeReason) {
+	// Partially duplicated from Delete
+	for lru.size > lru.capacity {
+		delElem := lru.list.Back()
+		if delElem == nil {
+			// empty, yet over a negative capacity
+			break
+		}
+		delValue := delElem.Value.(*denseIntEntry)
+		lru.list.Remove(delElem)
+		lru.table[delValue.key] = nil
+		lru.size -= delValue.size
+		safeOnPurge(delValue.value, why)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lru
+
+import (
+	"testing"
+)
+
+func TestDenseIntKeyRange(t *testing.T) {
+	maxKey := 63
+	cache := NewDenseLRUCacheInt(maxKey, 100)
+	values := make([]*CacheValue, maxKey+1)
+	for k := 0; k <= maxKey; k++ {
+		values[k] = &CacheValue{1}
+		cache.Set(k, values[k])
+	}
+	if l := cache.Length(); l != int64(maxKey+1) {
+		t.Errorf("cache.Length() = %v, want %v", l, maxKey+1)
+	}
+	for k := 0; k <= maxKey; k++ {
+		v, ok := cache.Get(k)
+		if !ok || v.(*CacheValue) != values[k] {
+			t.Errorf("Get(%v) = %v, %v, want %v", k, v, ok, values[k])
+		}
+	}
+	for k := 0; k <= maxKey; k += 2 {
+		if !cache.Delete(k) {
+			t.Errorf("Delete(%v) = false, want true", k)
+		}
+	}
+	for k := 0; k <= maxKey; k++ {
+		_, ok := cache.Get(k)
+		if want := k%2 == 1; ok != want {
+			t.Errorf("Get(%v) ok = %v, want %v", k, ok, want)
+		}
+	}
+	if sz := cache.Size(); sz != int64(maxKey+1)/2 {
+		t.Errorf("cache.Size() = %v, want %v", sz, (maxKey+1)/2)
+	}
+
+	cache.Clear()
+	if l := cache.Length(); l != 0 {
+		t.Errorf("cache.Length() after Clear = %v, want 0", l)
+	}
+	cache.Set(maxKey, &CacheValue{1})
+	if _, ok := cache.Get(maxKey); !ok {
+		t.Errorf("Get(%v) after Clear missed", maxKey)
+	}
+}
+
+func TestDenseIntOutOfRange(t *testing.T) {
+	cache := NewDenseLRUCacheInt(9, 100)
+	missed := 0
+	cache.OnMiss(func(k int) (Cacheable, bool) {
+		missed++
+		return &CacheValue{1}, true
+	})
+	for _, k := range []int{-1, 10, 1 << 20} {
+		cache.Set(k, &CacheValue{1})
+		cache.SetIfAbsent(k, &CacheValue{1})
+		if v, ok := cache.Get(k); ok {
+			t.Errorf("Get(%v) = %v, want miss", k, v)
+		}
+		if cache.Delete(k) {
+			t.Errorf("Delete(%v) = true, want false", k)
+		}
+	}
+	if missed != 0 {
+		t.Errorf("onMiss called %v times for out of range keys, want 0", missed)
+	}
+	if l, sz, _ := cache.Stats(); l != 0 || sz != 0 {
+		t.Errorf("cache.Stats() = %v, %v, want 0, 0", l, sz)
+	}
+}
+
+func TestDenseIntNegativeMaxKey(t *testing.T) {
+	for _, maxKey := range []int{-1, -2, -1 << 20} {
+		cache := NewDenseLRUCacheInt(maxKey, 100)
+		cache.Set(0, &CacheValue{1})
+		if v, ok := cache.Get(0); ok {
+			t.Errorf("maxKey %v: Get(0) = %v, want miss", maxKey, v)
+		}
+		if l := cache.Length(); l != 0 {
+			t.Errorf("maxKey %v: cache.Length() = %v, want 0", maxKey, l)
+		}
+	}
+}
+
+func TestDenseIntLRUIsEvicted(t *testing.T) {
+	cache := NewDenseLRUCacheInt(9, 3)
+
+	cache.Set(1, &CacheValue{1})
+	cache.Set(2, &CacheValue{1})
+	cache.Set(3, &CacheValue{1})
+	// lru: [k3, k2, k1]
+
+	cache.Get(3)
+	cache.Get(2)
+	cache.Get(1)
+	// lru: [k1, k2, k3]
+
+	cache.Set(0, &CacheValue{1})
+	// lru: [k0, k1, k2]
+
+	if _, ok := cache.Get(3); ok {
+		t.Error("Least recently used element was not evicted.")
+	}
+	if keys := cache.Keys(); len(keys) != 3 || keys[0] != 0 || keys[1] != 1 || keys[2] != 2 {
+		t.Errorf("cache.Keys() = %v, want [0 1 2]", keys)
+	}
+}
+
+func BenchmarkDenseIntGet(b *testing.B) {
+	cache := NewDenseLRUCacheInt(1023, 64*1024*1024)
+	value := make(MyValue, 1000)
+	for k := 0; k < 1024; k++ {
+		cache.Set(k, value)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		val, ok := cache.Get(i & 1023)
+		if !ok {
+			panic("error")
+		}
+		_ = val
+	}
+}
+
+func BenchmarkIntGet(b *testing.B) {
+	cache := NewLRUCacheInt(64 * 1024 * 1024)
+	value := make(MyValue, 1000)
+	for k := 0; k < 1024; k++ {
+		cache.Set(k, value)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		val, ok := cache.Get(i & 1023)
+		if !ok {
+			panic("error")
+		}
+		_ = val
+	}
+}
@@ -71,7 +71,11 @@ func (lru *LRUCacheInt32) Get(k int32) (v Cacheable, ok bool) {
 			return nil, false
 		}
 		v, ok = lru.onMiss(k)
-		if ok { // should check v==nil ???
+		if v == nil {
+			// a nil value is reported as a miss rather than cached
+			ok = false
+		}
+		if ok {
 			lru.set(k, v)
 		}
 		return
@@ -140,13 +144,14 @@ func (lru *LRUCacheInt32) Clear() {
 
 // SetCapacity will set the capacity of the cache. If the capacity is
 // smaller, and the current cache size exceed that capacity, the cache
-// will be shrank.
+// will be shrank, purging the evicted elements with
+// PURGE_REASON_CAPACITY_SHRINK.
 func (lru *LRUCacheInt32) SetCapacity(capacity int64) {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
 	lru.capacity = capacity
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CAPACITY_SHRINK)
 }
 func (lru *LRUCacheInt32) OnMiss(onMiss OnMissHandlerInt32) {
 	lru.onMiss = onMiss
@@ -238,7 +243,7 @@ func (lru *LRUCacheInt32) updateInplace(element *list.Element, value Cacheable)
 	element.Value.(*int32Entry).size = valueSize
 	lru.size += sizeDiff
 	lru.moveToFront(element)
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
 }
 
 func (lru *LRUCacheInt32) moveToFront(element *list.Element) {
@@ -247,20 +252,29 @@ func (lru *LRUCacheInt32) moveToFront(element *list.Element) {
 
 func (lru *LRUCacheInt32) addNew(k int32, value Cacheable) {
 	newEntry := &int32Entry{k, value, getSize(value)}
+	if lru.capacity <= 0 || newEntry.size > lru.capacity {
+		// it would only be evicted right away, along with everything else
+		safeOnPurge(value, PURGE_REASON_CACHEFULL)
+		return
+	}
 	element := lru.list.PushFront(newEntry)
 	lru.table[k] = element
 	lru.size += newEntry.size
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
 }
 
-func (lru *LRUCacheInt32) checkCapacity() {
+func (lru *LRUCacheInt32) checkCapacity(why PurgeReason) {
 	// Partially duplicated from Delete
 	for lru.size > lru.capacity {
 		delElem := lru.list.Back()
+		if delElem == nil {
+			// empty, yet over a negative capacity
+			break
+		}
 		delValue := delElem.Value.(*int32Entry)
 		lru.list.Remove(delElem)
 		delete(lru.table, delValue.key)
 		lru.size -= delValue.size
-		safeOnPurge(delValue.value, PURGE_REASON_CACHEFULL)
+		safeOnPurge(delValue.value, why)
 	}
 }
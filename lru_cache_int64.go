@@ -43,6 +43,12 @@ type LRUCacheInt64 struct {
 	// How much we are limiting the cache to.
 	capacity int64
 	onMiss   OnMissHandlerInt64
+
+	// When set, capacity evictions are appended to it, see SetAndReport.
+	evictedSink *[]Int64Item
+
+	// While set, nothing is evicted, see PauseEviction.
+	evictionPaused bool
 }
 type int64Entry struct {
 	key   int64
@@ -71,7 +77,11 @@ func (lru *LRUCacheInt64) Get(k int64) (v Cacheable, ok bool) {
 			return nil, false
 		}
 		v, ok = lru.onMiss(k)
-		if ok { // should check v==nil ???
+		if v == nil {
+			// a nil value is reported as a miss rather than cached
+			ok = false
+		}
+		if ok {
 			lru.set(k, v)
 		}
 		return
@@ -94,6 +104,56 @@ func (lru *LRUCacheInt64) set(k int64, value Cacheable) {
 	}
 }
 
+// SetAndReport is like Set, but returns the entries evicted to make room for
+// value, in eviction order (least recently used first). When value is
+// rejected instead, for being larger than the capacity or because the
+// capacity is <= 0, it is the one returned. The slice is empty if nothing
+// was evicted.
+func (lru *LRUCacheInt64) SetAndReport(k int64, value Cacheable) []Int64Item {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	evicted := []Int64Item{}
+	lru.evictedSink = &evicted
+	lru.set(k, value)
+	lru.evictedSink = nil
+	return evicted
+}
+
+// Replace updates the value cached under k and returns the previous one,
+// which has already been purged with PURGE_REASON_UPDATE. If k is not
+// cached, nothing is stored and Replace returns nil, false; see Swap to
+// insert it instead.
+func (lru *LRUCacheInt64) Replace(k int64, value Cacheable) (old Cacheable, existed bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element := lru.table[k]
+	if element == nil {
+		return nil, false
+	}
+	old = element.Value.(*int64Entry).value
+	lru.updateInplace(element, value)
+	return old, true
+}
+
+// Swap stores value under k as the most recently used entry and returns the
+// value it replaced, in one locked operation. The previous value has already
+// been purged with PURGE_REASON_UPDATE when it is returned. Unlike Replace,
+// if k was not cached, value is inserted and Swap returns nil, false.
+func (lru *LRUCacheInt64) Swap(k int64, value Cacheable) (old Cacheable, existed bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	if element := lru.table[k]; element != nil {
+		old = element.Value.(*int64Entry).value
+		lru.updateInplace(element, value)
+		return old, true
+	}
+	lru.addNew(k, value)
+	return nil, false
+}
+
 // SetIfAbsent will set the value in the cache if not present. If the
 // value exists in the cache, we don't set it.
 func (lru *LRUCacheInt64) SetIfAbsent(k int64, value Cacheable) {
@@ -124,6 +184,24 @@ func (lru *LRUCacheInt64) Delete(k int64) bool {
 	return true
 }
 
+// GetAndDelete removes an int64Entry from the cache and returns its value,
+// in one locked operation. onMiss is not consulted.
+func (lru *LRUCacheInt64) GetAndDelete(k int64) (Cacheable, bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element := lru.table[k]
+	if element == nil {
+		return nil, false
+	}
+
+	lru.list.Remove(element)
+	delete(lru.table, k)
+	lru.size -= element.Value.(*int64Entry).size
+	safeOnPurge(element.Value.(*int64Entry).value, PURGE_REASON_DELETE)
+	return element.Value.(*int64Entry).value, true
+}
+
 // Clear will clear the entire cache.
 func (lru *LRUCacheInt64) Clear() {
 	lru.mu.Lock()
@@ -140,13 +218,43 @@ func (lru *LRUCacheInt64) Clear() {
 
 // SetCapacity will set the capacity of the cache. If the capacity is
 // smaller, and the current cache size exceed that capacity, the cache
-// will be shrank.
+// will be shrank, purging the evicted elements with
+// PURGE_REASON_CAPACITY_SHRINK.
 func (lru *LRUCacheInt64) SetCapacity(capacity int64) {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
 	lru.capacity = capacity
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CAPACITY_SHRINK)
+}
+
+// Resize is like SetCapacity, but returns how many entries were evicted to
+// fit the new capacity.
+func (lru *LRUCacheInt64) Resize(capacity int64) (evicted int64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.capacity = capacity
+	return lru.checkCapacity(PURGE_REASON_CAPACITY_SHRINK)
+}
+
+// PauseEviction stops evicting entries to make room, for example during a
+// bulk load: until ResumeEviction, the size may exceed the capacity.
+func (lru *LRUCacheInt64) PauseEviction() {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.evictionPaused = true
+}
+
+// ResumeEviction undoes PauseEviction, and shrinks the cache down to its
+// capacity in a single pass.
+func (lru *LRUCacheInt64) ResumeEviction() {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.evictionPaused = false
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
 }
 func (lru *LRUCacheInt64) OnMiss(onMiss OnMissHandlerInt64) {
 	lru.onMiss = onMiss
@@ -171,14 +279,24 @@ func (lru *LRUCacheInt64) StatsJSON() string {
 	return fmt.Sprintf("{\"Length\": %v, \"Size\": %v, \"Capacity\": %v }", l, s, c)
 }
 
-// Length returns how many elements are in the cache
+// Length returns how many elements are in the cache. This is not what the
+// capacity limits: see Size.
 func (lru *LRUCacheInt64) Length() int64 {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 	return int64(lru.list.Len())
 }
 
-// Size returns the sum of the objects' Size() method.
+// Empty reports whether the cache holds no element.
+func (lru *LRUCacheInt64) Empty() bool {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return lru.list.Len() == 0
+}
+
+// Size returns the sum of the objects' Size() method, which is what the
+// capacity is compared against. It differs from Length as soon as an element
+// does not weigh 1.
 func (lru *LRUCacheInt64) Size() int64 {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
@@ -238,7 +356,7 @@ func (lru *LRUCacheInt64) updateInplace(element *list.Element, value Cacheable)
 	element.Value.(*int64Entry).size = valueSize
 	lru.size += sizeDiff
 	lru.moveToFront(element)
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
 }
 
 func (lru *LRUCacheInt64) moveToFront(element *list.Element) {
@@ -247,20 +365,44 @@ func (lru *LRUCacheInt64) moveToFront(element *list.Element) {
 
 func (lru *LRUCacheInt64) addNew(k int64, value Cacheable) {
 	newEntry := &int64Entry{k, value, getSize(value)}
+	if lru.capacity <= 0 || newEntry.size > lru.capacity {
+		// it would only be evicted right away, along with everything else
+		lru.evict(newEntry, PURGE_REASON_CACHEFULL)
+		return
+	}
 	element := lru.list.PushFront(newEntry)
 	lru.table[k] = element
 	lru.size += newEntry.size
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
 }
 
-func (lru *LRUCacheInt64) checkCapacity() {
+// checkCapacity evicts entries until the cache fits its capacity, and
+// returns how many were evicted.
+func (lru *LRUCacheInt64) checkCapacity(why PurgeReason) (evicted int64) {
+	if lru.evictionPaused {
+		return 0
+	}
 	// Partially duplicated from Delete
 	for lru.size > lru.capacity {
 		delElem := lru.list.Back()
+		if delElem == nil {
+			// empty, yet over a negative capacity
+			break
+		}
 		delValue := delElem.Value.(*int64Entry)
 		lru.list.Remove(delElem)
 		delete(lru.table, delValue.key)
 		lru.size -= delValue.size
-		safeOnPurge(delValue.value, PURGE_REASON_CACHEFULL)
+		lru.evict(delValue, why)
+		evicted++
+	}
+	return evicted
+}
+
+// evict reports entry to SetAndReport, and purges it.
+func (lru *LRUCacheInt64) evict(entry *int64Entry, why PurgeReason) {
+	if lru.evictedSink != nil {
+		*lru.evictedSink = append(*lru.evictedSink, Int64Item{Key: entry.key, Value: entry.value})
 	}
+	safeOnPurge(entry.value, why)
 }
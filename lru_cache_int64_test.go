@@ -334,3 +334,190 @@ func TestInt64OnMiss(t *testing.T) {
 	}
 
 }
+
+func TestInt64Resize(t *testing.T) {
+	cache := NewLRUCacheInt64(10)
+	for i := int64(0); i < 10; i++ {
+		cache.Set(i, &CacheValue{1})
+	}
+
+	if evicted := cache.Resize(20); evicted != 0 {
+		t.Errorf("cache.Resize(20) evicted %v, expected 0", evicted)
+	}
+	if evicted := cache.Resize(6); evicted != 4 {
+		t.Errorf("cache.Resize(6) evicted %v, expected 4", evicted)
+	}
+	if l, sz, c := cache.Stats(); l != 6 || sz != 6 || c != 6 {
+		t.Errorf("cache stats = %v, %v, %v, expected 6, 6, 6", l, sz, c)
+	}
+}
+
+func TestInt64GetAndDelete(t *testing.T) {
+	cache := NewLRUCacheInt64(100)
+	value := &PurgeCacheValueInt64{}
+	purgeReasonFlag4TestInt64 = PURGE_REASON_CACHEFULL // init
+	cache.Set(1, value)
+	cache.Set(2, &CacheValue{1})
+
+	v, ok := cache.GetAndDelete(1)
+	if !ok || v.(*PurgeCacheValueInt64) != value {
+		t.Errorf("cache.GetAndDelete(1) = %v, %v, expected %v", v, ok, value)
+	}
+	if purgeReasonFlag4TestInt64 != PURGE_REASON_DELETE {
+		t.Errorf("after cache.GetAndDelete ,purgeReason should be %d ,but get %d", PURGE_REASON_DELETE, purgeReasonFlag4TestInt64)
+	}
+	if _, ok := cache.Get(1); ok {
+		t.Error("Cache returned a value after GetAndDelete.")
+	}
+	if v, ok := cache.GetAndDelete(1); ok || v != nil {
+		t.Errorf("second cache.GetAndDelete(1) = %v, %v, expected nil, false", v, ok)
+	}
+	if l, sz, _ := cache.Stats(); l != 1 || sz != 1 {
+		t.Errorf("cache.Stats() = %v, %v, expected 1, 1", l, sz)
+	}
+}
+
+func TestInt64Replace(t *testing.T) {
+	cache := NewLRUCacheInt64(100)
+	if old, existed := cache.Replace(1, &CacheValue{1}); existed || old != nil {
+		t.Errorf("cache.Replace(1) = %v, %v on an empty cache, expected nil, false", old, existed)
+	}
+	if _, ok := cache.Get(1); ok {
+		t.Error("cache.Replace(1) inserted a missing key")
+	}
+
+	value := &PurgeCacheValueInt64{}
+	cache.Set(2, value)
+	purgeReasonFlag4TestInt64 = PURGE_REASON_CACHEFULL // init
+	data := &CacheValue{3}
+	old, existed := cache.Replace(2, data)
+	if !existed || old.(*PurgeCacheValueInt64) != value {
+		t.Errorf("cache.Replace(2) = %v, %v, expected %v, true", old, existed, value)
+	}
+	if purgeReasonFlag4TestInt64 != PURGE_REASON_UPDATE {
+		t.Errorf("after cache.Replace ,purgeReason should be %d ,but get %d", PURGE_REASON_UPDATE, purgeReasonFlag4TestInt64)
+	}
+	if v, ok := cache.Get(2); !ok || v.(*CacheValue) != data {
+		t.Errorf("Cache has incorrect value: %v != %v", data, v)
+	}
+	if l, sz, _ := cache.Stats(); l != 1 || sz != 3 {
+		t.Errorf("cache.Stats() = %v, %v, expected 1, 3", l, sz)
+	}
+}
+
+func TestInt64Swap(t *testing.T) {
+	cache := NewLRUCacheInt64(100)
+	if old, existed := cache.Swap(1, &CacheValue{1}); existed || old != nil {
+		t.Errorf("cache.Swap(1) = %v, %v on an empty cache, expected nil, false", old, existed)
+	}
+	value := &PurgeCacheValueInt64{}
+	cache.Set(2, value)
+	cache.Set(3, &CacheValue{1})
+
+	purgeReasonFlag4TestInt64 = PURGE_REASON_CACHEFULL // init
+	data := &CacheValue{5}
+	old, existed := cache.Swap(2, data)
+	if !existed || old.(*PurgeCacheValueInt64) != value {
+		t.Errorf("cache.Swap(2) = %v, %v, expected %v, true", old, existed, value)
+	}
+	if purgeReasonFlag4TestInt64 != PURGE_REASON_UPDATE {
+		t.Errorf("after cache.Swap ,purgeReason should be %d ,but get %d", PURGE_REASON_UPDATE, purgeReasonFlag4TestInt64)
+	}
+	if keys := cache.Keys(); len(keys) != 3 || keys[0] != 2 {
+		t.Errorf("cache.Keys() = %v, expected 2 to be the most recently used", keys)
+	}
+	if l, sz, _ := cache.Stats(); l != 3 || sz != 7 {
+		t.Errorf("cache.Stats() = %v, %v, expected 3, 7", l, sz)
+	}
+}
+
+func TestInt64Empty(t *testing.T) {
+	cache := NewLRUCacheInt64(100)
+	if !cache.Empty() {
+		t.Error("new cache is not empty")
+	}
+	cache.Set(1, &CacheValue{5})
+	if cache.Empty() {
+		t.Error("cache is empty after Set")
+	}
+	if l, sz := cache.Length(), cache.Size(); l != 1 || sz != 5 {
+		t.Errorf("cache.Length(), cache.Size() = %v, %v, expected 1, 5", l, sz)
+	}
+	cache.Delete(1)
+	if !cache.Empty() {
+		t.Error("cache is not empty after Delete")
+	}
+}
+
+func TestInt64SetAndReport(t *testing.T) {
+	cache := NewLRUCacheInt64(3)
+	v1, v2 := &CacheValue{1}, &CacheValue{1}
+	cache.Set(1, v1)
+	cache.Set(2, v2)
+	if evicted := cache.SetAndReport(3, &CacheValue{1}); evicted == nil || len(evicted) != 0 {
+		t.Errorf("SetAndReport() = %#v, expected an empty slice", evicted)
+	}
+	evicted := cache.SetAndReport(4, &CacheValue{2})
+	if len(evicted) != 2 || evicted[0].Key != 1 || evicted[0].Value != v1 || evicted[1].Key != 2 || evicted[1].Value != v2 {
+		t.Errorf("SetAndReport() = %v, expected k1 then k2", evicted)
+	}
+	// evictions outside SetAndReport are not collected
+	cache.Set(5, &CacheValue{3})
+	if l := cache.Length(); l != 1 {
+		t.Errorf("cache.Length() = %v, expected 1", l)
+	}
+}
+
+func TestInt64SetAndReportRejected(t *testing.T) {
+	cache := NewLRUCacheInt64(3)
+	cache.Set(1, &CacheValue{1})
+	big := &CacheValue{4}
+	if evicted := cache.SetAndReport(2, big); len(evicted) != 1 || evicted[0].Key != 2 || evicted[0].Value != big {
+		t.Errorf("SetAndReport(2) = %v, expected the oversize value", evicted)
+	}
+	if keys := cache.Keys(); len(keys) != 1 || keys[0] != 1 {
+		t.Errorf("cache.Keys() = %v, expected [1]", keys)
+	}
+
+	cache = NewLRUCacheInt64(0)
+	value := &CacheValue{1}
+	if evicted := cache.SetAndReport(3, value); len(evicted) != 1 || evicted[0].Key != 3 || evicted[0].Value != value {
+		t.Errorf("SetAndReport(3) = %v on a disabled cache, expected the value", evicted)
+	}
+}
+
+func TestInt64NegativeCapacity(t *testing.T) {
+	cache := NewLRUCacheInt64(100)
+	cache.SetCapacity(-1) // used to panic on the empty list
+
+	cache.SetCapacity(100)
+	cache.Set(1, &CacheValue{1})
+	cache.Set(2, &CacheValue{1})
+	cache.SetCapacity(-1)
+	if l, sz, c := cache.Stats(); l != 0 || sz != 0 || c != -1 {
+		t.Errorf("cache.Stats() = %v, %v, %v, expected 0, 0, -1", l, sz, c)
+	}
+}
+
+func TestInt64PauseEviction(t *testing.T) {
+	cache := NewLRUCacheInt64(3)
+	cache.PauseEviction()
+	for i := int64(0); i < 10; i++ {
+		cache.Set(i, &CacheValue{1})
+	}
+	if l := cache.Length(); l != 10 {
+		t.Errorf("cache.Length() = %v while paused, expected 10", l)
+	}
+
+	cache.ResumeEviction()
+	if l := cache.Length(); l != 3 {
+		t.Errorf("cache.Length() = %v after ResumeEviction, expected 3", l)
+	}
+	if keys := cache.Keys(); keys[0] != 9 || keys[1] != 8 || keys[2] != 7 {
+		t.Errorf("cache.Keys() = %v, expected [9 8 7]", keys)
+	}
+	cache.Set(10, &CacheValue{1})
+	if l := cache.Length(); l != 3 {
+		t.Errorf("cache.Length() = %v, expected eviction to be back", l)
+	}
+}
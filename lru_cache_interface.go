@@ -1,5 +1,10 @@
 package lru
 
+import (
+	key "github.com/0studio/storage_key"
+	"reflect"
+)
+
 // Reasons for a cached element to be deleted from the cache
 type PurgeReason int
 
@@ -12,6 +17,21 @@ const (
 	PURGE_REASON_UPDATE
 	// when Cache.Clear() is called
 	PURGE_REASON_CLEAR_ALL
+	// The element outlived its time to live. No cache expires elements yet;
+	// the reason is reserved so that OnPurge switches can handle it already.
+	PURGE_REASON_EXPIRED
+	// SetCapacity shrank the cache below its current size
+	PURGE_REASON_CAPACITY_SHRINK
+)
+
+// What the capacity of a cache bounds
+type CapacityMode int
+
+const (
+	// The capacity is the total sum of the Size() of each item
+	CapacityBySize CapacityMode = iota
+	// The capacity is the number of items: every item weighs 1
+	CapacityByCount
 )
 
 // Optional interface for cached objects
@@ -60,6 +80,66 @@ type OnPurger interface {
 	//
 }
 
+// Cache is the method set shared by every cache keyed by K, for code
+// written once for all of them, such as metrics wrappers or debug dumps.
+type Cache[K any] interface {
+	Get(k K) (v Cacheable, ok bool)
+	Set(k K, value Cacheable)
+	SetIfAbsent(k K, value Cacheable)
+	Delete(k K) bool
+	Clear()
+	SetCapacity(capacity int64)
+	Stats() (length, size, capacity int64)
+	StatsJSON() string
+	Length() int64
+	Size() int64
+	Capacity() int64
+	Keys() []K
+}
+
+// StringCache is the method set shared by the caches keyed by string, so
+// that callers can switch implementations, say to NoopStringCache to disable
+// caching.
+type StringCache interface {
+	Cache[string]
+	OnMiss(onMiss OnMissHandlerString)
+	Items() []StringItem
+	Values() []Cacheable
+}
+
+var (
+	_ Cache[string]              = (*LFUCacheString)(nil)
+	_ Cache[int]                 = (*DenseLRUCacheInt)(nil)
+	_ Cache[int]                 = (*LRUCacheInt)(nil)
+	_ Cache[int32]               = (*LRUCacheInt32)(nil)
+	_ Cache[int64]               = (*LRUCacheInt64)(nil)
+	_ Cache[uint32]              = (*LRUCacheUint32)(nil)
+	_ Cache[uint64]              = (*LRUCacheUint64)(nil)
+	_ Cache[[]byte]              = (*LRUCacheBytes)(nil)
+	_ Cache[key.String]          = (*LRUCacheKeyString)(nil)
+	_ Cache[key.KeyInt32]        = (*LRUCacheKeyInt32)(nil)
+	_ Cache[key.KeyUint64]       = (*LRUCacheKeyUint64)(nil)
+	_ Cache[key.KeyUint64]       = (*TwoQueueCacheKeyUint64)(nil)
+	_ Cache[key.KeyDoubleUint64] = (*LRUCacheKeyDoubleUint64)(nil)
+	_ Cache[key.KeyUint64Int32]  = (*LRUCacheKeyUint64Int32)(nil)
+	_ StringCache                = (*LRUCacheString)(nil)
+	_ StringCache                = (*ShardLRUCacheString)(nil)
+	_ StringCache                = (*NoopStringCache)(nil)
+)
+
+// CacheStats is a snapshot of a cache's gauges and monotonic counters.
+type CacheStats struct {
+	// Gauges
+	Length   int64
+	Size     int64
+	Capacity int64
+
+	// Monotonic counters
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
 // Anything can be cached!
 type Cacheable interface{}
 
@@ -79,6 +159,16 @@ func getSize(x Cacheable) int64 {
 	return 1
 }
 
+// sameValue reports whether a and b are the same value. Values of a type
+// that cannot be compared, say a slice, are never the same.
+func sameValue(a, b Cacheable) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
+
 // Only call c.OnPurge() if c implements OnPurger.
 func safeOnPurge(c Cacheable, why PurgeReason) {
 	if t, ok := c.(OnPurger); ok {
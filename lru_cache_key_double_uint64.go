@@ -72,7 +72,11 @@ func (lru *LRUCacheKeyDoubleUint64) Get(k key.KeyDoubleUint64) (v Cacheable, ok
 			return nil, false
 		}
 		v, ok = lru.onMiss(k)
-		if ok { // should check v==nil ???
+		if v == nil {
+			// a nil value is reported as a miss rather than cached
+			ok = false
+		}
+		if ok {
 			lru.set(k, v)
 		}
 		return
@@ -141,13 +145,14 @@ func (lru *LRUCacheKeyDoubleUint64) Clear() {
 
 // SetCapacity will set the capacity of the cache. If the capacity is
 // smaller, and the current cache size exceed that capacity, the cache
-// will be shrank.
+// will be shrank, purging the evicted elements with
+// PURGE_REASON_CAPACITY_SHRINK.
 func (lru *LRUCacheKeyDoubleUint64) SetCapacity(capacity int64) {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
 	lru.capacity = capacity
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CAPACITY_SHRINK)
 }
 func (lru *LRUCacheKeyDoubleUint64) OnMiss(onMiss OnMissHandlerKeyDoubleUint64) {
 	lru.onMiss = onMiss
@@ -239,7 +244,7 @@ func (lru *LRUCacheKeyDoubleUint64) updateInplace(element *list.Element, value C
 	element.Value.(*keyDoubleUint64Entry).size = valueSize
 	lru.size += sizeDiff
 	lru.moveToFront(element)
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
 }
 
 func (lru *LRUCacheKeyDoubleUint64) moveToFront(element *list.Element) {
@@ -248,20 +253,29 @@ func (lru *LRUCacheKeyDoubleUint64) moveToFront(element *list.Element) {
 
 func (lru *LRUCacheKeyDoubleUint64) addNew(k key.KeyDoubleUint64, value Cacheable) {
 	newEntry := &keyDoubleUint64Entry{k, value, getSize(value)}
+	if lru.capacity <= 0 || newEntry.size > lru.capacity {
+		// it would only be evicted right away, along with everything else
+		safeOnPurge(value, PURGE_REASON_CACHEFULL)
+		return
+	}
 	element := lru.list.PushFront(newEntry)
 	lru.table[k] = element
 	lru.size += newEntry.size
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
 }
 
-func (lru *LRUCacheKeyDoubleUint64) checkCapacity() {
+func (lru *LRUCacheKeyDoubleUint64) checkCapacity(why PurgeReason) {
 	// Partially duplicated from Delete
 	for lru.size > lru.capacity {
 		delElem := lru.list.Back()
+		if delElem == nil {
+			// empty, yet over a negative capacity
+			break
+		}
 		delValue := delElem.Value.(*keyDoubleUint64Entry)
 		lru.list.Remove(delElem)
 		delete(lru.table, delValue.key)
 		lru.size -= delValue.size
-		safeOnPurge(delValue.value, PURGE_REASON_CACHEFULL)
+		safeOnPurge(delValue.value, why)
 	}
 }
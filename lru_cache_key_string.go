@@ -26,6 +26,10 @@ type KeyStringItem struct {
 
 type OnMissHandlerKeyString func(k key.String) (Cacheable, bool)
 
+// computeLockStripes is the number of mutexes GetOrComputeLocked spreads the
+// keys over.
+const computeLockStripes = 64
+
 // LRUCacheKeyString is a typical LRU cache implementation.  If the cache
 // reaches the capacity, the least recently used item is deleted from
 // the cache. Note the capacity is not the number of items, but the
@@ -44,6 +48,12 @@ type LRUCacheKeyString struct {
 	// How much we are limiting the cache to.
 	capacity int64
 	onMiss   OnMissHandlerKeyString
+
+	// Striped per-key locks, see GetOrComputeLocked.
+	computeLocks [computeLockStripes]sync.Mutex
+
+	// see KeyStringOptions
+	countKeySize bool
 }
 type keyStringEntry struct {
 	key   key.String
@@ -51,12 +61,29 @@ type keyStringEntry struct {
 	size  int64
 }
 
+// KeyStringOptions configures a cache created with
+// NewLRUCacheKeyStringWithOptions.
+type KeyStringOptions struct {
+	Capacity int64
+
+	// CountKeySize adds the length of each key to the size accounted for
+	// its entry, for a truer memory bound with long keys such as URLs.
+	CountKeySize bool
+}
+
 // NewLRUCacheKeyString creates a new empty cache with the given capacity.
 func NewLRUCacheKeyString(capacity int64) *LRUCacheKeyString {
+	return NewLRUCacheKeyStringWithOptions(KeyStringOptions{Capacity: capacity})
+}
+
+// NewLRUCacheKeyStringWithOptions creates a new empty cache configured by
+// opts.
+func NewLRUCacheKeyStringWithOptions(opts KeyStringOptions) *LRUCacheKeyString {
 	return &LRUCacheKeyString{
-		list:     list.New(),
-		table:    make(map[key.String]*list.Element),
-		capacity: capacity,
+		list:         list.New(),
+		table:        make(map[key.String]*list.Element),
+		capacity:     opts.Capacity,
+		countKeySize: opts.CountKeySize,
 	}
 }
 
@@ -72,7 +99,11 @@ func (lru *LRUCacheKeyString) Get(k key.String) (v Cacheable, ok bool) {
 			return nil, false
 		}
 		v, ok = lru.onMiss(k)
-		if ok { // should check v==nil ???
+		if v == nil {
+			// a nil value is reported as a miss rather than cached
+			ok = false
+		}
+		if ok {
 			lru.set(k, v)
 		}
 		return
@@ -81,6 +112,45 @@ func (lru *LRUCacheKeyString) Get(k key.String) (v Cacheable, ok bool) {
 	return element.Value.(*keyStringEntry).value, true
 }
 
+// GetOrComputeLocked returns the value of k, marking it as most recently
+// used. On a miss it calls compute, without holding the cache lock, and
+// stores a successful result; onMiss is not consulted. Concurrent calls for
+// the same k are serialized so that only the first one computes, the others
+// then finding its result in the cache, while calls for other keys proceed
+// concurrently, except for the rare keys sharing a lock stripe.
+func (lru *LRUCacheKeyString) GetOrComputeLocked(k key.String, compute func() (Cacheable, bool)) (Cacheable, bool) {
+	if v, ok := lru.lookup(k); ok {
+		return v, true
+	}
+
+	stripe := &lru.computeLocks[uint(k.ToSum())%computeLockStripes]
+	stripe.Lock()
+	defer stripe.Unlock()
+
+	// computed by the previous holder of the stripe
+	if v, ok := lru.lookup(k); ok {
+		return v, true
+	}
+	v, ok := compute()
+	if ok {
+		lru.Set(k, v)
+	}
+	return v, ok
+}
+
+// lookup is like Get but never consults onMiss.
+func (lru *LRUCacheKeyString) lookup(k key.String) (Cacheable, bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element := lru.table[k]
+	if element == nil {
+		return nil, false
+	}
+	lru.moveToFront(element)
+	return element.Value.(*keyStringEntry).value, true
+}
+
 // Set sets a value in the cache.
 func (lru *LRUCacheKeyString) Set(k key.String, value Cacheable) {
 	lru.mu.Lock()
@@ -141,13 +211,14 @@ func (lru *LRUCacheKeyString) Clear() {
 
 // SetCapacity will set the capacity of the cache. If the capacity is
 // smaller, and the current cache size exceed that capacity, the cache
-// will be shrank.
+// will be shrank, purging the evicted elements with
+// PURGE_REASON_CAPACITY_SHRINK.
 func (lru *LRUCacheKeyString) SetCapacity(capacity int64) {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
 	lru.capacity = capacity
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CAPACITY_SHRINK)
 }
 func (lru *LRUCacheKeyString) OnMiss(onMiss OnMissHandlerKeyString) {
 	lru.onMiss = onMiss
@@ -232,14 +303,14 @@ func (lru *LRUCacheKeyString) Values() []Cacheable {
 	return values
 }
 func (lru *LRUCacheKeyString) updateInplace(element *list.Element, value Cacheable) {
-	valueSize := getSize(value)
+	valueSize := lru.entrySize(element.Value.(*keyStringEntry).key, value)
 	sizeDiff := valueSize - element.Value.(*keyStringEntry).size
 	safeOnPurge(element.Value.(*keyStringEntry).value, PURGE_REASON_UPDATE)
 	element.Value.(*keyStringEntry).value = value
 	element.Value.(*keyStringEntry).size = valueSize
 	lru.size += sizeDiff
 	lru.moveToFront(element)
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
 }
 
 func (lru *LRUCacheKeyString) moveToFront(element *list.Element) {
@@ -247,21 +318,38 @@ func (lru *LRUCacheKeyString) moveToFront(element *list.Element) {
 }
 
 func (lru *LRUCacheKeyString) addNew(k key.String, value Cacheable) {
-	newEntry := &keyStringEntry{k, value, getSize(value)}
+	newEntry := &keyStringEntry{k, value, lru.entrySize(k, value)}
+	if lru.capacity <= 0 || newEntry.size > lru.capacity {
+		// it would only be evicted right away, along with everything else
+		safeOnPurge(value, PURGE_REASON_CACHEFULL)
+		return
+	}
 	element := lru.list.PushFront(newEntry)
 	lru.table[k] = element
 	lru.size += newEntry.size
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
 }
 
-func (lru *LRUCacheKeyString) checkCapacity() {
+// entrySize is the weight of k and value toward the capacity.
+func (lru *LRUCacheKeyString) entrySize(k key.String, value Cacheable) int64 {
+	if lru.countKeySize {
+		return getSize(value) + int64(len(k))
+	}
+	return getSize(value)
+}
+
+func (lru *LRUCacheKeyString) checkCapacity(why PurgeReason) {
 	// Partially duplicated from Delete
 	for lru.size > lru.capacity {
 		delElem := lru.list.Back()
+		if delElem == nil {
+			// empty, yet over a negative capacity
+			break
+		}
 		delValue := delElem.Value.(*keyStringEntry)
 		lru.list.Remove(delElem)
 		delete(lru.table, delValue.key)
 		lru.size -= delValue.size
-		safeOnPurge(delValue.value, PURGE_REASON_CACHEFULL)
+		safeOnPurge(delValue.value, why)
 	}
 }
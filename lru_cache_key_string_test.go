@@ -6,8 +6,11 @@ package lru
 
 import (
 	"encoding/json"
+	"fmt"
 	key "github.com/0studio/storage_key"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestKeyStringInitialState(t *testing.T) {
@@ -335,3 +338,95 @@ func TestKeyStringOnMiss(t *testing.T) {
 	}
 
 }
+
+func TestKeyStringGetOrComputeLockedSameKey(t *testing.T) {
+	cache := NewLRUCacheKeyString(100)
+	value := &CacheValue{1}
+	var mu sync.Mutex
+	computes, inflight := 0, 0
+	compute := func() (Cacheable, bool) {
+		mu.Lock()
+		computes++
+		inflight++
+		if inflight > 1 {
+			t.Error("computes for the same key ran concurrently")
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+		return value, true
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, ok := cache.GetOrComputeLocked("k", compute); !ok || v != value {
+				t.Errorf("GetOrComputeLocked() = %v, %v, expected %v", v, ok, value)
+			}
+		}()
+	}
+	wg.Wait()
+	if computes != 1 {
+		t.Errorf("compute called %v times, expected 1", computes)
+	}
+}
+
+func TestKeyStringGetOrComputeLockedOtherKeys(t *testing.T) {
+	cache := NewLRUCacheKeyString(100)
+	// two keys on different lock stripes
+	k1 := key.String("k")
+	k2 := k1
+	for i := 0; uint(k2.ToSum())%computeLockStripes == uint(k1.ToSum())%computeLockStripes; i++ {
+		k2 = key.String(fmt.Sprintf("k%d", i))
+	}
+
+	// the compute of k1 only returns once the compute of k2 has run
+	k2Computed := make(chan struct{})
+	k1Started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.GetOrComputeLocked(k1, func() (Cacheable, bool) {
+			close(k1Started)
+			<-k2Computed
+			return &CacheValue{1}, true
+		})
+	}()
+	<-k1Started
+
+	go cache.GetOrComputeLocked(k2, func() (Cacheable, bool) {
+		close(k2Computed)
+		return &CacheValue{1}, true
+	})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("compute of another key blocked by a running compute")
+	}
+}
+
+func TestKeyStringCountKeySize(t *testing.T) {
+	cache := NewLRUCacheKeyStringWithOptions(KeyStringOptions{Capacity: 20, CountKeySize: true})
+	cache.Set("http://a", &CacheValue{1}) // 8 + 1
+	if sz := cache.Size(); sz != 9 {
+		t.Errorf("cache.Size() = %v, expected 9", sz)
+	}
+	cache.Set("http://a", &CacheValue{2})
+	if sz := cache.Size(); sz != 10 {
+		t.Errorf("cache.Size() after update = %v, expected 10", sz)
+	}
+	cache.Set("http://bb", &CacheValue{2}) // 9 + 2: evicts http://a
+	if l, sz := cache.Length(), cache.Size(); l != 1 || sz != 11 {
+		t.Errorf("cache.Length(), cache.Size() = %v, %v, expected 1, 11", l, sz)
+	}
+
+	cache = NewLRUCacheKeyString(20)
+	cache.Set("http://a", &CacheValue{1})
+	if sz := cache.Size(); sz != 1 {
+		t.Errorf("cache.Size() = %v without CountKeySize, expected 1", sz)
+	}
+}
@@ -13,98 +13,590 @@ package lru
 
 import (
 	"container/list"
+	"context"
+	"errors"
 	"fmt"
 	key "github.com/0studio/storage_key"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// itemsCtxChunkSize is how many entries ItemsCtx copies per lock acquisition.
+const itemsCtxChunkSize = 1024
+
+// defaultMaxConcurrentLoads bounds how many onMiss calls GetMultiCtx and
+// Preload run at once, see SetMaxConcurrentLoads.
+const defaultMaxConcurrentLoads = 16
+
+// defaultMinEntrySize is what a value weighs at least toward the capacity
+// unless changed, see SetMinEntrySize.
+const defaultMinEntrySize = 1
+
+// negativeTombstoneSize is what a remembered miss weighs toward the capacity,
+// see EnableNegativeCache.
+const negativeTombstoneSize = 1
+
+// keyuint64EntryPool recycles the entries removed from any
+// LRUCacheKeyUint64, sparing the garbage collector in caches with a high
+// churn.
+var keyuint64EntryPool = sync.Pool{New: func() interface{} { return new(keyuint64Entry) }}
+
+// ErrSnapshotInterrupted is returned by ItemsCtx when the entry it paused on
+// between two chunks was removed or promoted meanwhile. Retrying is safe.
+var ErrSnapshotInterrupted = errors.New("lru: snapshot interrupted by a concurrent removal or promotion")
+
 // KeyUint64Item is what is stored in the cache
 type KeyUint64Item struct {
 	Key   key.KeyUint64
 	Value Cacheable
 }
 
+// KeyUint64SizedItem is a KeyUint64Item with the size the cache accounted
+// for it.
+type KeyUint64SizedItem struct {
+	Key   key.KeyUint64
+	Value Cacheable
+	Size  int64
+}
+
+// CacheConfig is the effective configuration of a cache, as returned by
+// Config. Changing it has no effect on the cache.
+type CacheConfig struct {
+	Capacity   int64
+	ShardCount int // 1 unless sharded
+
+	// CapacityMode is CapacityByCount for caches bounded by a number of
+	// items, see NewLRUCacheKeyUint64MaxItems.
+	CapacityMode CapacityMode
+
+	MinEntrySize         int64
+	MinResidency         time.Duration
+	PromoteAfterAccesses int
+	NegativeTTL          time.Duration // 0 when the negative cache is disabled
+	DetachedClear        bool
+	CheckSizes           bool
+	RecordWriters        bool
+	EvictionPaused       bool
+}
+
 type OnMissHandlerKeyUint64 func(k key.KeyUint64) (Cacheable, bool)
 
+type OnEvictHandlerKeyUint64 func(k key.KeyUint64, v Cacheable, why PurgeReason)
+
 // LRUCacheKeyUint64 is a typical LRU cache implementation.  If the cache
 // reaches the capacity, the least recently used item is deleted from
 // the cache. Note the capacity is not the number of items, but the
 // total sum of the Size() of each item.
 type LRUCacheKeyUint64 struct {
-	mu sync.Mutex
+	mu sync.RWMutex
 
 	// list & table of *keyuint64Entry objects
 	list  *list.List
 	table map[key.KeyUint64]*list.Element
 
 	// Our current size. Obviously a gross simplification and
-	// low-grade approximation.
-	size int64
+	// low-grade approximation. Only changed with mu held, but atomic so
+	// that SizeApprox can read it without.
+	size atomic.Int64
 
 	// How much we are limiting the cache to.
 	capacity int64
 	onMiss   OnMissHandlerKeyUint64
+	onEvict  OnEvictHandlerKeyUint64
+
+	// Called when the capacity changes, see OnCapacityChange.
+	onCapacityChange func(old, new int64)
+
+	// At most this many onMiss calls in flight, see SetMaxConcurrentLoads.
+	maxConcurrentLoads int
+
+	// Initial size of the table, see NewLRUCacheKeyUint64WithHint.
+	sizeHint int
+
+	// With CapacityByCount every entry weighs 1 regardless of its Size(),
+	// so the capacity is a number of items.
+	capacityMode CapacityMode
+
+	// Every entry weighs at least this much, see SetMinEntrySize.
+	minEntrySize int64
+
+	// Entries younger than this are not evicted, see SetMinResidency.
+	minResidency time.Duration
+
+	// Get only promotes entries hit at least this many times, see
+	// SetPromoteAfterAccesses.
+	promoteAfterAccesses int64
+
+	// When set, capacity evictions are appended to it, see
+	// SetReturningEvicted.
+	evictedSink *[]KeyUint64Item
+
+	// Capacity evictions are sent to it when there is room, see
+	// EvictionChannel.
+	evictionCh           chan KeyUint64Item
+	droppedNotifications int64
+
+	// Clear fires the purge callbacks after releasing the lock, see
+	// SetDetachedClear.
+	detachedClear bool
+
+	// While set, nothing is evicted, see PauseEviction.
+	evictionPaused bool
+
+	// While above the capacity, evict at most this many entries per
+	// operation, see SetCapacityGradual.
+	shrinkPerOp int
+
+	// Re-check the Size() of values as they leave the cache, see
+	// SetCheckSizes.
+	checkSizes     bool
+	sizeMismatches int64
+
+	// Record who stores each entry, see SetRecordWriters.
+	recordWriters bool
+
+	// Misses are remembered this long, see EnableNegativeCache.
+	negativeTTL time.Duration
+
+	// Bumped whenever an entry is moved to the front, see ItemsCtx.
+	promotions uint64
+
+	// Optional structured logger, see SetLogger, and whether it is told
+	// about misses, see SetLogMisses.
+	logger    func(event string, fields map[string]interface{})
+	logMisses bool
+
+	// The clock behind minResidency and negativeTTL, time.Now unless a test
+	// replaces it.
+	now func() time.Time
+
+	// Monotonic counters, see StatsStruct.
+	hits      int64
+	misses    int64
+	evictions int64
 }
 type keyuint64Entry struct {
-	key   key.KeyUint64
-	value Cacheable
-	size  int64
+	key      key.KeyUint64
+	value    Cacheable
+	size     int64
+	inserted time.Time // only recorded when minResidency is set
+	hits     int64     // successful Gets since insertion
+
+	// A tombstone remembers a miss until expires, see EnableNegativeCache.
+	// Its value is nil.
+	tombstone bool
+	expires   time.Time
+
+	// Size() of value when stored, only recorded when checkSizes is set.
+	reportedSize int64
+	sizeRecorded bool
+
+	// pc of the last caller of Set, only recorded when recordWriters is set.
+	writer uintptr
+
+	// lru.promotions when last moved to the front, see ItemsCtx.
+	promoted uint64
 }
 
 // NewLRUCacheKeyUint64 creates a new empty cache with the given capacity.
+// A value larger than the capacity is purged with PURGE_REASON_CACHEFULL
+// instead of being stored, rather than evicting every other entry to no
+// avail, and a capacity <= 0 disables the cache.
 func NewLRUCacheKeyUint64(capacity int64) *LRUCacheKeyUint64 {
+	return NewLRUCacheKeyUint64WithHint(capacity, 0)
+}
+
+// NewLRUCacheKeyUint64WithHint is like NewLRUCacheKeyUint64, but sizes the
+// table for expectedItems entries up front, and again after Clear, so that
+// filling the cache does not repeatedly grow it.
+func NewLRUCacheKeyUint64WithHint(capacity int64, expectedItems int) *LRUCacheKeyUint64 {
 	return &LRUCacheKeyUint64{
-		list:     list.New(),
-		table:    make(map[key.KeyUint64]*list.Element),
-		capacity: capacity,
+		list:         list.New(),
+		table:        make(map[key.KeyUint64]*list.Element, expectedItems),
+		capacity:     capacity,
+		sizeHint:     expectedItems,
+		minEntrySize: defaultMinEntrySize,
+		now:          time.Now,
 	}
 }
 
+// NewLRUCacheKeyUint64MaxItems creates a new empty cache holding at most
+// maxItems items: every entry weighs 1 regardless of its Size().
+func NewLRUCacheKeyUint64MaxItems(maxItems int64) *LRUCacheKeyUint64 {
+	lru := NewLRUCacheKeyUint64(maxItems)
+	lru.capacityMode = CapacityByCount
+	return lru
+}
+
 // Get returns a value from the cache, and marks the keyuint64Entry as most
 // recently used.
 func (lru *LRUCacheKeyUint64) Get(k key.KeyUint64) (v Cacheable, ok bool) {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
+	v, _, ok = lru.get(k)
+	return
+}
 
+// GetWithMeta is like Get, but also returns how many times the entry has been
+// hit since it was stored, including this call. A value loaded through onMiss
+// has not been hit yet.
+func (lru *LRUCacheKeyUint64) GetWithMeta(k key.KeyUint64) (v Cacheable, hits int64, ok bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return lru.get(k)
+}
+func (lru *LRUCacheKeyUint64) get(k key.KeyUint64) (v Cacheable, hits int64, ok bool) {
+	if lru.shrinkPerOp > 0 {
+		lru.checkCapacity(PURGE_REASON_CAPACITY_SHRINK)
+	}
 	element := lru.table[k]
+	if element != nil && element.Value.(*keyuint64Entry).tombstone {
+		if lru.isNegative(element, lru.now()) {
+			lru.misses++
+			lru.logMiss(k)
+			return nil, 0, false
+		}
+		lru.dropTombstone(element)
+		element = nil
+	}
 	if element == nil {
+		lru.misses++
+		lru.logMiss(k)
 		if lru.onMiss == nil {
-			return nil, false
+			return nil, 0, false
 		}
 		v, ok = lru.onMiss(k)
-		if ok { // should check v==nil ???
+		if v == nil {
+			// a nil value is reported as a miss rather than cached
+			ok = false
+		}
+		if ok {
 			lru.set(k, v)
+		} else {
+			lru.remember(k)
 		}
 		return
 	}
-	lru.moveToFront(element)
+	lru.hits++
+	entry := element.Value.(*keyuint64Entry)
+	entry.hits++
+	if entry.hits >= lru.promoteAfterAccesses {
+		lru.moveToFront(element)
+	}
+	return entry.value, entry.hits, true
+}
+
+// GetTypedOr is like c.Get, but returns the value as a T. It returns def on
+// a miss, or when the cached value is not a T.
+func GetTypedOr[T any](c *LRUCacheKeyUint64, k key.KeyUint64, def T) T {
+	v, ok := c.Get(k)
+	if !ok {
+		return def
+	}
+	if t, ok := v.(T); ok {
+		return t
+	}
+	return def
+}
+
+// GetTyped is like c.Get, but returns the value as a T, sparing the caller
+// the type assertion. ok is false on a miss, or when the cached value is not
+// a T.
+func GetTyped[T any](c *LRUCacheKeyUint64, k key.KeyUint64) (value T, ok bool) {
+	v, ok := c.Get(k)
+	if !ok {
+		return value, false
+	}
+	value, ok = v.(T)
+	return value, ok
+}
+
+// MustGetTyped is like GetTyped, but panics when the cached value is not a T,
+// since that means the cache is shared by code disagreeing on what it holds.
+// ok is false on a miss.
+func MustGetTyped[T any](c *LRUCacheKeyUint64, k key.KeyUint64) (value T, ok bool) {
+	v, ok := c.Get(k)
+	if !ok {
+		return value, false
+	}
+	value, ok = v.(T)
+	if !ok {
+		panic(fmt.Sprintf("lru: value of key %v is a %T, not a %T", k, v, value))
+	}
+	return value, true
+}
+
+// GetMultiStats returns the values of keys found in the cache, marking them
+// as most recently used, along with how many of keys hit and missed. onMiss
+// is not consulted. A key listed more than once is looked up and counted
+// only once, so hits is the length of results.
+func (lru *LRUCacheKeyUint64) GetMultiStats(keys []key.KeyUint64) (results map[key.KeyUint64]Cacheable, hits, misses int) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	results = make(map[key.KeyUint64]Cacheable, len(keys))
+	seen := make(map[key.KeyUint64]bool, len(keys))
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if element := lru.table[k]; element != nil && !element.Value.(*keyuint64Entry).tombstone {
+			hits++
+			lru.moveToFront(element)
+			results[k] = element.Value.(*keyuint64Entry).value
+		} else {
+			misses++
+			lru.logMiss(k)
+		}
+	}
+	lru.hits += int64(hits)
+	lru.misses += int64(misses)
+	return results, hits, misses
+}
+
+// GetMultiCtx returns the values of keys found in the cache. Missing keys are
+// loaded concurrently through onMiss, at most SetMaxConcurrentLoads at a
+// time, outside the lock, and stored. Keys whose load has not completed when
+// ctx is done are omitted from the result: the loads in flight are left to
+// finish in the background and their results discarded, the others are not
+// started. A key listed more than once is looked up, counted and loaded only
+// once.
+func (lru *LRUCacheKeyUint64) GetMultiCtx(ctx context.Context, keys []key.KeyUint64) map[key.KeyUint64]Cacheable {
+	results := make(map[key.KeyUint64]Cacheable, len(keys))
+	var missing []key.KeyUint64
+
+	lru.mu.Lock()
+	now := lru.now()
+	seen := make(map[key.KeyUint64]bool, len(keys))
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		element := lru.table[k]
+		if element != nil && !element.Value.(*keyuint64Entry).tombstone {
+			lru.hits++
+			lru.moveToFront(element)
+			results[k] = element.Value.(*keyuint64Entry).value
+		} else {
+			lru.misses++
+			lru.logMiss(k)
+			if element == nil || !lru.isNegative(element, now) {
+				missing = append(missing, k)
+			}
+		}
+	}
+	onMiss, workers := lru.onMiss, lru.maxConcurrentLoads
+	lru.mu.Unlock()
+
+	if onMiss == nil || len(missing) == 0 {
+		return results
+	}
+	loaded := loadKeyUint64s(ctx, onMiss, missing, workers)
+	for i := 0; i < len(missing); i++ {
+		select {
+		case <-ctx.Done():
+			return results
+		case l := <-loaded:
+			if l.Value != nil {
+				lru.Set(l.Key, l.Value)
+				results[l.Key] = l.Value
+			} else {
+				lru.mu.Lock()
+				lru.remember(l.Key)
+				lru.mu.Unlock()
+			}
+		}
+	}
+	return results
+}
+
+// GetMultiOrLoad returns the values of keys, loading all the missing ones
+// with a single call to loader, outside the lock, instead of one onMiss call
+// per key. The values returned by loader are stored; missing keys it leaves
+// out, or returns a nil value for, are not found, and are remembered by the
+// negative cache if enabled. Keys loader returns that were not asked for are
+// ignored. loader is not
+// called when every key hits.
+func (lru *LRUCacheKeyUint64) GetMultiOrLoad(keys []key.KeyUint64, loader func(missing []key.KeyUint64) map[key.KeyUint64]Cacheable) map[key.KeyUint64]Cacheable {
+	results := make(map[key.KeyUint64]Cacheable, len(keys))
+	var missing []key.KeyUint64
+
+	lru.mu.Lock()
+	now := lru.now()
+	seen := make(map[key.KeyUint64]bool, len(keys))
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		element := lru.table[k]
+		if element != nil && !element.Value.(*keyuint64Entry).tombstone {
+			lru.hits++
+			lru.moveToFront(element)
+			results[k] = element.Value.(*keyuint64Entry).value
+		} else {
+			lru.misses++
+			lru.logMiss(k)
+			if element == nil || !lru.isNegative(element, now) {
+				missing = append(missing, k)
+			}
+		}
+	}
+	lru.mu.Unlock()
+
+	if len(missing) == 0 {
+		return results
+	}
+	loaded := loader(missing)
+
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	for _, k := range missing {
+		if v := loaded[k]; v != nil {
+			lru.set(k, v)
+			results[k] = v
+		} else {
+			lru.remember(k)
+		}
+	}
+	return results
+}
+
+// Preload warms the cache: every key of keys not already cached is loaded
+// through onMiss, concurrently, at most SetMaxConcurrentLoads at a time, and
+// outside the lock, and stored if found. Each key is loaded at most once,
+// values stored meanwhile by Set are kept, and the hit and miss counters are
+// left alone. It returns once every load has completed.
+func (lru *LRUCacheKeyUint64) Preload(keys []key.KeyUint64) {
+	lru.mu.RLock()
+	onMiss, workers := lru.onMiss, lru.maxConcurrentLoads
+	var missing []key.KeyUint64
+	seen := make(map[key.KeyUint64]bool, len(keys))
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if element := lru.table[k]; element == nil || element.Value.(*keyuint64Entry).tombstone {
+			missing = append(missing, k)
+		}
+	}
+	lru.mu.RUnlock()
+
+	if onMiss == nil {
+		return
+	}
+	loaded := loadKeyUint64s(context.Background(), onMiss, missing, workers)
+	for range missing {
+		if l := <-loaded; l.Value != nil {
+			lru.SetIfAbsent(l.Key, l.Value)
+		}
+	}
+}
+
+// loadKeyUint64s calls onMiss for every key of keys, from at most workers
+// goroutines (defaultMaxConcurrentLoads if workers <= 0), and sends each
+// result to the returned channel, with a nil Value when the key was not
+// found. The channel is buffered for all of keys, so that the workers never
+// block on it. Once ctx is done, the keys not picked up yet are skipped and
+// get no result.
+func loadKeyUint64s(ctx context.Context, onMiss OnMissHandlerKeyUint64, keys []key.KeyUint64, workers int) <-chan KeyUint64Item {
+	if workers <= 0 {
+		workers = defaultMaxConcurrentLoads
+	}
+	if workers > len(keys) {
+		workers = len(keys)
+	}
+	results := make(chan KeyUint64Item, len(keys))
+	var next atomic.Int64
+	for w := 0; w < workers; w++ {
+		go func() {
+			for {
+				i := next.Add(1) - 1
+				if i >= int64(len(keys)) || ctx.Err() != nil {
+					return
+				}
+				v, ok := onMiss(keys[i])
+				if !ok {
+					v = nil
+				}
+				results <- KeyUint64Item{Key: keys[i], Value: v}
+			}
+		}()
+	}
+	return results
+}
+
+// Peek returns a value from the cache without marking it as most recently
+// used and without consulting onMiss. It only takes the read lock, so
+// concurrent Peeks do not block each other.
+func (lru *LRUCacheKeyUint64) Peek(k key.KeyUint64) (v Cacheable, ok bool) {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	element := lru.table[k]
+	if element == nil || element.Value.(*keyuint64Entry).tombstone {
+		return nil, false
+	}
 	return element.Value.(*keyuint64Entry).value, true
 }
 
+// Contains reports whether k is in the cache, without marking it as most
+// recently used and without consulting onMiss.
+func (lru *LRUCacheKeyUint64) Contains(k key.KeyUint64) bool {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	element := lru.table[k]
+	return element != nil && !element.Value.(*keyuint64Entry).tombstone
+}
+
 // Set sets a value in the cache.
 func (lru *LRUCacheKeyUint64) Set(k key.KeyUint64, value Cacheable) {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 	lru.set(k, value)
+	lru.recordWriter(k)
 }
 func (lru *LRUCacheKeyUint64) set(k key.KeyUint64, value Cacheable) {
-	if element := lru.table[k]; element != nil {
+	if element := lru.table[k]; element != nil && !lru.dropTombstone(element) {
 		lru.updateInplace(element, value)
 	} else {
 		lru.addNew(k, value)
 	}
 }
 
+// SetReturningEvicted is like Set, but returns the entries evicted to make
+// room for value, in eviction order (least recently used first). When value
+// is rejected instead, for being larger than the capacity or because the
+// capacity is <= 0, it is the one returned.
+func (lru *LRUCacheKeyUint64) SetReturningEvicted(k key.KeyUint64, value Cacheable) []KeyUint64Item {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	var evicted []KeyUint64Item
+	lru.evictedSink = &evicted
+	lru.set(k, value)
+	lru.evictedSink = nil
+	lru.recordWriter(k)
+	return evicted
+}
+
 // SetIfAbsent will set the value in the cache if not present. If the
 // value exists in the cache, we don't set it.
 func (lru *LRUCacheKeyUint64) SetIfAbsent(k key.KeyUint64, value Cacheable) {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
-	if element := lru.table[k]; element != nil {
+	if element := lru.table[k]; element != nil && !lru.dropTombstone(element) {
 		lru.moveToFront(element)
 	} else {
 		lru.addNew(k, value)
+		lru.recordWriter(k)
 	}
 }
 
@@ -114,53 +606,526 @@ func (lru *LRUCacheKeyUint64) Delete(k key.KeyUint64) bool {
 	defer lru.mu.Unlock()
 
 	element := lru.table[k]
-	if element == nil {
+	if element == nil || lru.dropTombstone(element) {
 		return false
 	}
 
 	lru.list.Remove(element)
 	delete(lru.table, k)
-	lru.size -= element.Value.(*keyuint64Entry).size
-	safeOnPurge(element.Value.(*keyuint64Entry).value, PURGE_REASON_DELETE)
+	lru.size.Add(-element.Value.(*keyuint64Entry).size)
+	lru.purge(element.Value.(*keyuint64Entry), PURGE_REASON_DELETE)
+	releaseKeyUint64Entry(element.Value.(*keyuint64Entry))
 	return true
 }
 
-// Clear will clear the entire cache.
+// Remove is like Delete, but also returns the value removed. It has been
+// purged with PURGE_REASON_DELETE when it is returned.
+func (lru *LRUCacheKeyUint64) Remove(k key.KeyUint64) (Cacheable, bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element := lru.table[k]
+	if element == nil || lru.dropTombstone(element) {
+		return nil, false
+	}
+
+	entry := element.Value.(*keyuint64Entry)
+	v := entry.value
+	lru.list.Remove(element)
+	delete(lru.table, k)
+	lru.size.Add(-entry.size)
+	lru.purge(entry, PURGE_REASON_DELETE)
+	releaseKeyUint64Entry(entry)
+	return v, true
+}
+
+// DeleteMulti removes all of keys present in the cache under a single lock
+// acquisition, and returns how many entries were removed.
+func (lru *LRUCacheKeyUint64) DeleteMulti(keys []key.KeyUint64) int {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	removed := 0
+	for _, k := range keys {
+		element := lru.table[k]
+		if element == nil || lru.dropTombstone(element) {
+			continue
+		}
+		lru.list.Remove(element)
+		delete(lru.table, k)
+		lru.size.Add(-element.Value.(*keyuint64Entry).size)
+		lru.purge(element.Value.(*keyuint64Entry), PURGE_REASON_DELETE)
+		releaseKeyUint64Entry(element.Value.(*keyuint64Entry))
+		removed++
+	}
+	return removed
+}
+
+// DeleteFunc removes every entry for which pred returns true, and returns
+// how many entries were removed.
+//
+// pred is called with lru.mu held: it must not call back into the cache,
+// otherwise it will deadlock.
+func (lru *LRUCacheKeyUint64) DeleteFunc(pred func(k key.KeyUint64, v Cacheable) bool) int {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	removed := 0
+	for e := lru.list.Front(); e != nil; {
+		next := e.Next()
+		entry := e.Value.(*keyuint64Entry)
+		if !entry.tombstone && pred(entry.key, entry.value) {
+			lru.list.Remove(e)
+			delete(lru.table, entry.key)
+			lru.size.Add(-entry.size)
+			lru.purge(entry, PURGE_REASON_DELETE)
+			releaseKeyUint64Entry(entry)
+			removed++
+		}
+		e = next
+	}
+	return removed
+}
+
+// Clear will clear the entire cache. See SetDetachedClear for when the
+// purge callbacks run.
 func (lru *LRUCacheKeyUint64) Clear() {
+	lru.mu.Lock()
+	if !lru.detachedClear {
+		defer lru.mu.Unlock()
+		lru.clear()
+		return
+	}
+
+	old, logger, onEvict := lru.list, lru.logger, lru.onEvict
+	lru.list = list.New()
+	lru.table = make(map[key.KeyUint64]*list.Element, lru.sizeHint)
+	lru.size.Store(0)
+	lru.mu.Unlock()
+
+	for e := old.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*keyuint64Entry)
+		if entry.tombstone {
+			continue
+		}
+		if logger != nil {
+			logger("evict", map[string]interface{}{"key": entry.key, "size": entry.size, "reason": PURGE_REASON_CLEAR_ALL})
+		}
+		safeOnPurge(entry.value, PURGE_REASON_CLEAR_ALL)
+		if onEvict != nil {
+			onEvict(entry.key, entry.value, PURGE_REASON_CLEAR_ALL)
+		}
+	}
+	for e := old.Front(); e != nil; e = e.Next() {
+		releaseKeyUint64Entry(e.Value.(*keyuint64Entry))
+	}
+}
+
+// Drain empties the cache like Clear, but removes the entries one at a time
+// from the least recently used to the most recently used, so that write-back
+// done in OnPurge or OnEvict processes the coldest entries first.
+func (lru *LRUCacheKeyUint64) Drain() {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	for delElem := lru.list.Back(); delElem != nil; delElem = lru.list.Back() {
+		delValue := delElem.Value.(*keyuint64Entry)
+		lru.list.Remove(delElem)
+		delete(lru.table, delValue.key)
+		lru.size.Add(-delValue.size)
+		lru.purge(delValue, PURGE_REASON_CLEAR_ALL)
+		releaseKeyUint64Entry(delValue)
+	}
+}
+
+// ResetCount clears the cache and switches it to CapacityByCount with a
+// budget of maxItems items, in one locked operation. See NewLRUCacheKeyUint64MaxItems.
+func (lru *LRUCacheKeyUint64) ResetCount(maxItems int64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.clear()
+	lru.capacityMode = CapacityByCount
+	lru.setCapacity(maxItems)
+}
+
+// ResetPerKeyHits zeroes the hit count of every entry, keeping the entries
+// and their positions. With SetPromoteAfterAccesses, entries then have to be
+// hit that many times again before Get promotes them.
+func (lru *LRUCacheKeyUint64) ResetPerKeyHits() {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
 	for e := lru.list.Front(); e != nil; e = e.Next() {
-		safeOnPurge(e.Value.(*keyuint64Entry).value, PURGE_REASON_CLEAR_ALL)
+		e.Value.(*keyuint64Entry).hits = 0
+	}
+}
+
+// Clone returns an independent copy of the cache with the same entries in
+// the same order, and the same configuration: capacity and capacity mode,
+// size hint, SetMinEntrySize, SetMinResidency, SetPromoteAfterAccesses,
+// SetMaxConcurrentLoads, EnableNegativeCache, SetDetachedClear,
+// PauseEviction, a gradual shrink in progress, SetCheckSizes,
+// SetRecordWriters and SetLogMisses. Values are shared, not copied. Hooks
+// (OnMiss, OnEvict, OnCapacityChange, SetLogger, EvictionChannel) are not
+// carried over, and counters start from zero.
+func (lru *LRUCacheKeyUint64) Clone() *LRUCacheKeyUint64 {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	clone := NewLRUCacheKeyUint64WithHint(lru.capacity, lru.sizeHint)
+	clone.capacityMode = lru.capacityMode
+	clone.minEntrySize = lru.minEntrySize
+	clone.minResidency = lru.minResidency
+	clone.promoteAfterAccesses = lru.promoteAfterAccesses
+	clone.maxConcurrentLoads = lru.maxConcurrentLoads
+	clone.negativeTTL = lru.negativeTTL
+	clone.detachedClear = lru.detachedClear
+	clone.evictionPaused = lru.evictionPaused
+	clone.shrinkPerOp = lru.shrinkPerOp
+	clone.checkSizes = lru.checkSizes
+	clone.recordWriters = lru.recordWriters
+	clone.now = lru.now
+	clone.logMisses = lru.logMisses
+	for e := lru.list.Front(); e != nil; e = e.Next() {
+		entry := *e.Value.(*keyuint64Entry)
+		entry.promoted = 0 // stamped by this cache's counter
+		clone.table[entry.key] = clone.list.PushBack(&entry)
+	}
+	clone.size.Store(lru.size.Load())
+	return clone
+}
+
+// Snapshot returns a copy of all the entries, ordered from most recently used
+// to least recently used, suitable for Restore. It is the same as Items.
+func (lru *LRUCacheKeyUint64) Snapshot() []KeyUint64Item {
+	return lru.Items()
+}
+
+// Restore clears the cache then loads items, preserving their order as the
+// LRU order: the first item is the most recently used. If a key appears more
+// than once only its first occurrence is kept. Items are admitted as by Set:
+// a value larger than the capacity, or any value when the capacity is <= 0,
+// is evicted with PURGE_REASON_CACHEFULL instead. Items that do not fit in
+// the capacity are evicted from the end of the list.
+func (lru *LRUCacheKeyUint64) Restore(items []KeyUint64Item) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.clear()
+	for _, item := range items {
+		if _, ok := lru.table[item.Key]; ok {
+			continue
+		}
+		size := lru.entrySize(item.Value)
+		if !lru.admit(item.Key, item.Value, size) {
+			continue
+		}
+		newEntry := newKeyUint64Entry(item.Key, item.Value, size)
+		lru.recordSize(newEntry)
+		if lru.minResidency > 0 {
+			newEntry.inserted = lru.now()
+		}
+		lru.table[item.Key] = lru.list.PushBack(newEntry)
+		lru.size.Add(newEntry.size)
 	}
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
 
-	lru.list.Init()
-	lru.table = make(map[key.KeyUint64]*list.Element)
-	lru.size = 0
+// clear empties the cache before firing the purge callbacks of the removed
+// entries, so that the cache is consistent even if one of them panics.
+func (lru *LRUCacheKeyUint64) clear() {
+	old := lru.list
+	lru.list = list.New()
+	lru.table = make(map[key.KeyUint64]*list.Element, lru.sizeHint)
+	lru.size.Store(0)
+
+	for e := old.Front(); e != nil; e = e.Next() {
+		lru.purge(e.Value.(*keyuint64Entry), PURGE_REASON_CLEAR_ALL)
+		releaseKeyUint64Entry(e.Value.(*keyuint64Entry))
+	}
 }
 
 // SetCapacity will set the capacity of the cache. If the capacity is
 // smaller, and the current cache size exceed that capacity, the cache
-// will be shrank.
+// will be shrank, purging the evicted elements with
+// PURGE_REASON_CAPACITY_SHRINK.
 func (lru *LRUCacheKeyUint64) SetCapacity(capacity int64) {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
+	lru.setCapacity(capacity)
+	lru.shrinkPerOp = 0
+	lru.checkCapacity(PURGE_REASON_CAPACITY_SHRINK)
+}
+
+// SetCapacityGradual is like SetCapacity, but bounds the time spent shrinking
+// a large cache with the lock held: the capacity is lowered right away, but
+// every call, including the subsequent Get and Set, evicts at most maxPerOp
+// entries until the size is back within the capacity. All the entries
+// evicted meanwhile are purged with PURGE_REASON_CAPACITY_SHRINK, including
+// the ones evicted to make room for a Set. A maxPerOp <= 0 shrinks in one
+// pass, as SetCapacity does.
+func (lru *LRUCacheKeyUint64) SetCapacityGradual(capacity int64, maxPerOp int) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.setCapacity(capacity)
+	lru.shrinkPerOp = maxPerOp
+	lru.checkCapacity(PURGE_REASON_CAPACITY_SHRINK)
+}
+
+func (lru *LRUCacheKeyUint64) setCapacity(capacity int64) {
+	old := lru.capacity
 	lru.capacity = capacity
-	lru.checkCapacity()
+	if lru.onCapacityChange != nil && old != capacity {
+		lru.onCapacityChange(old, capacity)
+	}
+}
+
+// SetMinEntrySize makes every entry count at least n toward the capacity,
+// so that values reporting a Size() of 0 cannot accumulate without bound.
+// It only applies to entries stored afterwards. The default is
+// defaultMinEntrySize, and n <= 0 counts values exactly as reported. It has
+// no effect with CapacityByCount.
+func (lru *LRUCacheKeyUint64) SetMinEntrySize(n int64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.minEntrySize = n
+}
+
+// SetMinResidency protects entries inserted less than d ago from capacity
+// eviction: the least recently used entry old enough is evicted instead. If
+// every entry is too young the cache is allowed to exceed its capacity until
+// they age. A zero d disables the protection.
+func (lru *LRUCacheKeyUint64) SetMinResidency(d time.Duration) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.minResidency = d
+}
+
+// SetPromoteAfterAccesses makes Get promote an entry to most recently used
+// only once it has been hit n times, so that keys touched once by a scan stay
+// near the tail and are evicted first. n <= 1 promotes on every hit, which
+// is the default.
+func (lru *LRUCacheKeyUint64) SetPromoteAfterAccesses(n int) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.promoteAfterAccesses = int64(n)
+}
+
+// SetMaxConcurrentLoads bounds how many onMiss calls GetMultiCtx and Preload
+// run at once, so that a large batch of misses does not start a goroutine,
+// and a backend request, per key. n <= 0 restores the default,
+// defaultMaxConcurrentLoads.
+func (lru *LRUCacheKeyUint64) SetMaxConcurrentLoads(n int) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.maxConcurrentLoads = n
 }
+
+// PauseEviction stops evicting entries to make room: until ResumeEviction,
+// the size may exceed the capacity.
+func (lru *LRUCacheKeyUint64) PauseEviction() {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.evictionPaused = true
+}
+
+// ResumeEviction undoes PauseEviction, and shrinks the cache down to its
+// capacity.
+func (lru *LRUCacheKeyUint64) ResumeEviction() {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.evictionPaused = false
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+// SetRecordWriters enables a debug mode recording, for every entry stored
+// afterwards by Set, SetReturningEvicted or SetIfAbsent, the function that
+// called it, as reported by LastWriter. It costs a runtime.Caller per store.
+func (lru *LRUCacheKeyUint64) SetRecordWriters(enabled bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.recordWriters = enabled
+}
+
+// LastWriter returns the name of the function that last stored k, if it was
+// recorded, see SetRecordWriters.
+func (lru *LRUCacheKeyUint64) LastWriter(k key.KeyUint64) (funcName string, ok bool) {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	element := lru.table[k]
+	if element == nil || element.Value.(*keyuint64Entry).writer == 0 {
+		return "", false
+	}
+	fn := runtime.FuncForPC(element.Value.(*keyuint64Entry).writer)
+	if fn == nil {
+		return "", false
+	}
+	return fn.Name(), true
+}
+
+// SetCheckSizes enables a debug mode enforcing the SizeAware contract: the
+// Size() of every value stored afterwards is recorded, and checked again when
+// the value is evicted, deleted, cleared or replaced. Every value reporting a
+// different size by then is counted by SizeMismatches, and logged as a
+// "size_mismatch" event (fields "key", "recorded", "reported") if a logger
+// is set.
+func (lru *LRUCacheKeyUint64) SetCheckSizes(enabled bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.checkSizes = enabled
+}
+
+// SizeMismatches returns how many values were caught changing size while
+// cached, see SetCheckSizes.
+func (lru *LRUCacheKeyUint64) SizeMismatches() int64 {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+	return lru.sizeMismatches
+}
+
+// EnableNegativeCache remembers misses for ttl: when onMiss reports a key as
+// not found, a tombstone is stored in its place, and Gets of that key miss
+// without calling onMiss again until the tombstone expires. Set and
+// SetIfAbsent replace tombstones as if the key were absent.
+//
+// Tombstones weigh negativeTombstoneSize toward the capacity, are evicted
+// like any other entry, and are counted by Length and Stats, but they are
+// never returned by Peek, Keys, Items, Values or ForEach, nor passed to
+// OnPurge, OnEvict or the logger. Expired tombstones are dropped by the next
+// Get of their key or by eviction. A ttl of 0 stops recording new ones.
+func (lru *LRUCacheKeyUint64) EnableNegativeCache(ttl time.Duration) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.negativeTTL = ttl
+}
+
+// SetDetachedClear makes Clear empty the cache under a brief lock and fire
+// the OnPurge, OnEvict and logger callbacks for the removed entries only
+// after releasing it, so that slow callbacks don't block concurrent readers
+// and writers. The callbacks may then run concurrently with other cache
+// operations, and may call back into the cache. It is off by default.
+func (lru *LRUCacheKeyUint64) SetDetachedClear(enabled bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.detachedClear = enabled
+}
+
+// SetLogger installs a structured logger. It is called with the event
+// "evict" (fields "key", "size", "reason") whenever an entry is deleted,
+// evicted or cleared, and, if enabled with SetLogMisses, with the event
+// "miss" (field "key") on every cache miss. Pass nil to disable logging.
+//
+// Like OnPurge, logger is called with the cache locked and must not call back
+// into the cache.
+func (lru *LRUCacheKeyUint64) SetLogger(logger func(event string, fields map[string]interface{})) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.logger = logger
+}
+
+// SetLogMisses enables the "miss" events of the logger, see SetLogger. They
+// are off by default, since a busy cache may miss far more often than it
+// evicts.
+func (lru *LRUCacheKeyUint64) SetLogMisses(enabled bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.logMisses = enabled
+}
+
+// OnEvict installs a handler called, right after the value's own OnPurge,
+// every time a value leaves the cache or is replaced, with the same reasons.
+// Unlike OnPurger it does not require the value to implement anything.
+//
+// The same contract as OnPurger applies: the entire cache is blocked until
+// onEvict returns, and it must not call back into the cache.
+func (lru *LRUCacheKeyUint64) OnEvict(onEvict OnEvictHandlerKeyUint64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.onEvict = onEvict
+}
+
+// EvictionChannel returns a channel receiving every item evicted to make
+// room, and every new value rejected for being larger than the capacity, or
+// because the capacity is <= 0. It is an alternative to OnEvict for handlers
+// too slow to run with the cache locked. The send never blocks: when the
+// buffer is full, the notification is dropped and counted, see
+// DroppedNotifications. A new call replaces the channel, closing the
+// previous one.
+func (lru *LRUCacheKeyUint64) EvictionChannel(buffer int) <-chan KeyUint64Item {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	if lru.evictionCh != nil {
+		close(lru.evictionCh)
+	}
+	lru.evictionCh = make(chan KeyUint64Item, buffer)
+	return lru.evictionCh
+}
+
+// DroppedNotifications returns the number of evictions not sent to the
+// EvictionChannel because its buffer was full.
+func (lru *LRUCacheKeyUint64) DroppedNotifications() int64 {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+	return lru.droppedNotifications
+}
+
+// OnCapacityChange installs a handler called with the old and new capacity
+// whenever SetCapacity, SetCapacityGradual or ResetCount changes it, before
+// the cache is shrunk to fit. Like OnEvict, it is called with the cache
+// locked and must not call back into the cache.
+func (lru *LRUCacheKeyUint64) OnCapacityChange(onCapacityChange func(old, new int64)) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.onCapacityChange = onCapacityChange
+}
+
+// OnMiss sets the handler loading the values missing from the cache. The
+// values it finds are stored, except nil ones, which are reported as misses.
 func (lru *LRUCacheKeyUint64) OnMiss(onMiss OnMissHandlerKeyUint64) {
 	lru.onMiss = onMiss
 }
 
-// Stats
+// Stats returns the gauges of StatsStruct.
 func (lru *LRUCacheKeyUint64) Stats() (length, size, capacity int64) {
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	stats := lru.StatsStruct()
+	return stats.Length, stats.Size, stats.Capacity
+}
+
+// StatsStruct returns the gauges (length, size, capacity) together with the
+// hit, miss and eviction counters.
+func (lru *LRUCacheKeyUint64) StatsStruct() CacheStats {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
 	// if lastElem := lru.list.Back(); lastElem != nil {
 	// 	oldest = lastElem.Value.(*keyuint64Entry).time_accessed
 	// }
-	return int64(lru.list.Len()), lru.size, lru.capacity
+	return CacheStats{
+		Length:    int64(lru.list.Len()),
+		Size:      lru.size.Load(),
+		Capacity:  lru.capacity,
+		Hits:      lru.hits,
+		Misses:    lru.misses,
+		Evictions: lru.evictions,
+	}
 }
 
 // StatsJSON returns stats as a JSON object in a key.KeyUint64.
@@ -172,36 +1137,126 @@ func (lru *LRUCacheKeyUint64) StatsJSON() string {
 	return fmt.Sprintf("{\"Length\": %v, \"Size\": %v, \"Capacity\": %v }", l, s, c)
 }
 
+// StatsSince returns the current stats with the counters (hits, misses,
+// evictions) expressed as the delta since prev, a snapshot previously taken
+// with StatsStruct. Gauges (length, size, capacity) are returned as-is.
+func (lru *LRUCacheKeyUint64) StatsSince(prev CacheStats) CacheStats {
+	cur := lru.StatsStruct()
+	cur.Hits -= prev.Hits
+	cur.Misses -= prev.Misses
+	cur.Evictions -= prev.Evictions
+	return cur
+}
+
 // Length returns how many elements are in the cache
 func (lru *LRUCacheKeyUint64) Length() int64 {
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
 	return int64(lru.list.Len())
 }
 
+// Len is like Length but returns an int.
+func (lru *LRUCacheKeyUint64) Len() int {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+	return lru.list.Len()
+}
+
 // Size returns the sum of the objects' Size() method.
 func (lru *LRUCacheKeyUint64) Size() int64 {
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
-	return lru.size
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+	return lru.size.Load()
+}
+
+// SizeApprox is like Size, but reads the size without locking, so that
+// polling it, say from a metrics goroutine, doesn't contend with the cache.
+// It may lag a concurrent Set or Delete.
+func (lru *LRUCacheKeyUint64) SizeApprox() int64 {
+	return lru.size.Load()
 }
 
 // Capacity returns the cache maximum capacity.
 func (lru *LRUCacheKeyUint64) Capacity() int64 {
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
 	return lru.capacity
 }
 
+// ColdKeys is the converse of RecentKeys: it returns up to the n least
+// recently used keys, least recently used first, that is the next ones to be
+// evicted.
+func (lru *LRUCacheKeyUint64) ColdKeys(n int) []key.KeyUint64 {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	if l := lru.list.Len(); n > l {
+		n = l
+	}
+	if n <= 0 {
+		return []key.KeyUint64{}
+	}
+	ks := make([]key.KeyUint64, 0, n)
+	for e := lru.list.Back(); e != nil && len(ks) < n; e = e.Prev() {
+		if v := e.Value.(*keyuint64Entry); !v.tombstone {
+			ks = append(ks, v.key)
+		}
+	}
+	return ks
+}
+
+// Config returns the current configuration of the cache, for logging or
+// validating it.
+func (lru *LRUCacheKeyUint64) Config() CacheConfig {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+	return CacheConfig{
+		Capacity:             lru.capacity,
+		ShardCount:           1,
+		CapacityMode:         lru.capacityMode,
+		MinEntrySize:         lru.minEntrySize,
+		MinResidency:         lru.minResidency,
+		PromoteAfterAccesses: int(lru.promoteAfterAccesses),
+		NegativeTTL:          lru.negativeTTL,
+		DetachedClear:        lru.detachedClear,
+		CheckSizes:           lru.checkSizes,
+		RecordWriters:        lru.recordWriters,
+		EvictionPaused:       lru.evictionPaused,
+	}
+}
+
 // Keys returns all the ks for the cache, ordered from most recently
 // used to last recently used.
 func (lru *LRUCacheKeyUint64) Keys() []key.KeyUint64 {
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
 
 	ks := make([]key.KeyUint64, 0, lru.list.Len())
 	for e := lru.list.Front(); e != nil; e = e.Next() {
-		ks = append(ks, e.Value.(*keyuint64Entry).key)
+		if v := e.Value.(*keyuint64Entry); !v.tombstone {
+			ks = append(ks, v.key)
+		}
+	}
+	return ks
+}
+
+// RecentKeys is like Keys, but returns only up to the n most recently used
+// keys, without walking or copying the rest of the cache.
+func (lru *LRUCacheKeyUint64) RecentKeys(n int) []key.KeyUint64 {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	if l := lru.list.Len(); n > l {
+		n = l
+	}
+	if n <= 0 {
+		return []key.KeyUint64{}
+	}
+	ks := make([]key.KeyUint64, 0, n)
+	for e := lru.list.Front(); e != nil && len(ks) < n; e = e.Next() {
+		if v := e.Value.(*keyuint64Entry); !v.tombstone {
+			ks = append(ks, v.key)
+		}
 	}
 	return ks
 }
@@ -209,59 +1264,432 @@ func (lru *LRUCacheKeyUint64) Keys() []key.KeyUint64 {
 // Items returns all the values for the cache, ordered from most recently
 // used to last recently used.
 func (lru *LRUCacheKeyUint64) Items() []KeyUint64Item {
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
 
 	items := make([]KeyUint64Item, 0, lru.list.Len())
 	for e := lru.list.Front(); e != nil; e = e.Next() {
-		v := e.Value.(*keyuint64Entry)
-		items = append(items, KeyUint64Item{Key: v.key, Value: v.value})
+		if v := e.Value.(*keyuint64Entry); !v.tombstone {
+			items = append(items, KeyUint64Item{Key: v.key, Value: v.value})
+		}
+	}
+	return items
+}
+
+// ItemsOldestFirst is like Items, but ordered from least recently used to
+// most recently used, the order in which entries would be evicted.
+func (lru *LRUCacheKeyUint64) ItemsOldestFirst() []KeyUint64Item {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	items := make([]KeyUint64Item, 0, lru.list.Len())
+	for e := lru.list.Back(); e != nil; e = e.Prev() {
+		if v := e.Value.(*keyuint64Entry); !v.tombstone {
+			items = append(items, KeyUint64Item{Key: v.key, Value: v.value})
+		}
+	}
+	return items
+}
+
+// ItemsCtx is like Items, but copies the entries itemsCtxChunkSize at a time,
+// releasing the lock and checking ctx between chunks. It returns ctx.Err() as
+// soon as ctx is done.
+//
+// Unlike Items the result is not a point-in-time snapshot. While the lock is
+// released, entries not listed yet may be removed, or added or promoted
+// ahead of the ones left, and are then missed; values updated in place are
+// listed as found. No entry is listed twice: when the entry to resume from
+// was removed or promoted meanwhile, ItemsCtx returns ErrSnapshotInterrupted.
+func (lru *LRUCacheKeyUint64) ItemsCtx(ctx context.Context) ([]KeyUint64Item, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	lru.mu.RLock()
+	items := make([]KeyUint64Item, 0, lru.list.Len())
+	e := lru.list.Front()
+	for {
+		for n := 0; e != nil && n < itemsCtxChunkSize; n++ {
+			if v := e.Value.(*keyuint64Entry); !v.tombstone {
+				items = append(items, KeyUint64Item{Key: v.key, Value: v.value})
+			}
+			e = e.Next()
+		}
+		if e == nil {
+			lru.mu.RUnlock()
+			return items, nil
+		}
+
+		cursor, cursorKey, mark := e, e.Value.(*keyuint64Entry).key, lru.promotions
+		lru.mu.RUnlock()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		lru.mu.RLock()
+		if lru.table[cursorKey] != cursor || cursor.Value.(*keyuint64Entry).promoted > mark {
+			lru.mu.RUnlock()
+			return nil, ErrSnapshotInterrupted
+		}
+	}
+}
+
+// ItemsWithSize is like Items but also reports the size stored for each
+// entry at insertion or update time, which may differ from its current
+// Size() if the value is mutable.
+func (lru *LRUCacheKeyUint64) ItemsWithSize() []KeyUint64SizedItem {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	items := make([]KeyUint64SizedItem, 0, lru.list.Len())
+	for e := lru.list.Front(); e != nil; e = e.Next() {
+		if v := e.Value.(*keyuint64Entry); !v.tombstone {
+			items = append(items, KeyUint64SizedItem{Key: v.key, Value: v.value, Size: v.size})
+		}
 	}
 	return items
 }
 
 func (lru *LRUCacheKeyUint64) Values() []Cacheable {
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
 
 	values := make([]Cacheable, 0, lru.list.Len())
 	for e := lru.list.Front(); e != nil; e = e.Next() {
-		v := e.Value.(*keyuint64Entry)
-		values = append(values, v.value)
+		if v := e.Value.(*keyuint64Entry); !v.tombstone {
+			values = append(values, v.value)
+		}
 	}
 	return values
 }
+
+// ForEach calls fn for every entry, ordered from most recently used to
+// least recently used, and stops as soon as fn returns false. Unlike Items it
+// does not copy the cache.
+//
+// fn is called with lru.mu read-locked: it must not call back into the
+// cache, otherwise it may deadlock.
+func (lru *LRUCacheKeyUint64) ForEach(fn func(k key.KeyUint64, v Cacheable) bool) {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	for e := lru.list.Front(); e != nil; e = e.Next() {
+		v := e.Value.(*keyuint64Entry)
+		if !v.tombstone && !fn(v.key, v.value) {
+			return
+		}
+	}
+}
+
+// RangeSnapshot calls fn for every entry, ordered from most recently used to
+// least recently used, like ForEach, but on a copy of the entries taken with
+// the lock held only for the copy: the cache is not blocked while fn runs,
+// and fn may call back into it. The entries fn sees may have been updated or
+// removed from the cache meanwhile.
+func (lru *LRUCacheKeyUint64) RangeSnapshot(fn func(k key.KeyUint64, v Cacheable)) {
+	for _, item := range lru.Items() {
+		fn(item.Key, item.Value)
+	}
+}
+
+// UpdateAll calls fn for every entry, from most recently used to least
+// recently used, without affecting their positions. When fn returns keep and
+// a non-nil newV, the value is replaced with newV and its size recomputed;
+// the old value is only purged with PURGE_REASON_UPDATE if newV is a
+// different value, so fn may return v, say after updating it in place.
+// Otherwise, including when newV is nil, the entry is deleted. The cache is
+// shrunk once the walk is over if the new sizes exceed the capacity.
+//
+// fn is called with lru.mu held: it must not call back into the cache,
+// otherwise it will deadlock.
+func (lru *LRUCacheKeyUint64) UpdateAll(fn func(k key.KeyUint64, v Cacheable) (newV Cacheable, keep bool)) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	for e := lru.list.Front(); e != nil; {
+		next := e.Next()
+		entry := e.Value.(*keyuint64Entry)
+		if entry.tombstone {
+			e = next
+			continue
+		}
+		newV, keep := fn(entry.key, entry.value)
+		if !keep || newV == nil {
+			lru.list.Remove(e)
+			delete(lru.table, entry.key)
+			lru.size.Add(-entry.size)
+			lru.purge(entry, PURGE_REASON_DELETE)
+			releaseKeyUint64Entry(entry)
+		} else {
+			valueSize := lru.entrySize(newV)
+			if !sameValue(newV, entry.value) {
+				lru.purge(entry, PURGE_REASON_UPDATE)
+			}
+			lru.size.Add(valueSize - entry.size)
+			entry.value = newV
+			lru.recordSize(entry)
+			entry.size = valueSize
+		}
+		e = next
+	}
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
 func (lru *LRUCacheKeyUint64) updateInplace(element *list.Element, value Cacheable) {
-	valueSize := getSize(value)
+	valueSize := lru.entrySize(value)
 	sizeDiff := valueSize - element.Value.(*keyuint64Entry).size
-	safeOnPurge(element.Value.(*keyuint64Entry).value, PURGE_REASON_UPDATE)
+	lru.purge(element.Value.(*keyuint64Entry), PURGE_REASON_UPDATE)
 	element.Value.(*keyuint64Entry).value = value
+	lru.recordSize(element.Value.(*keyuint64Entry))
 	element.Value.(*keyuint64Entry).size = valueSize
-	lru.size += sizeDiff
+	lru.size.Add(sizeDiff)
 	lru.moveToFront(element)
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
 }
 
 func (lru *LRUCacheKeyUint64) moveToFront(element *list.Element) {
+	if lru.list.Front() == element {
+		return
+	}
+	lru.promotions++
+	element.Value.(*keyuint64Entry).promoted = lru.promotions
 	lru.list.MoveToFront(element)
 }
 
 func (lru *LRUCacheKeyUint64) addNew(k key.KeyUint64, value Cacheable) {
-	newEntry := &keyuint64Entry{k, value, getSize(value)}
+	size := lru.entrySize(value)
+	if !lru.admit(k, value, size) {
+		return
+	}
+	newEntry := newKeyUint64Entry(k, value, size)
+	lru.recordSize(newEntry)
+	if lru.minResidency > 0 {
+		newEntry.inserted = lru.now()
+	}
 	element := lru.list.PushFront(newEntry)
 	lru.table[k] = element
-	lru.size += newEntry.size
-	lru.checkCapacity()
+	lru.size.Add(newEntry.size)
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+// admit reports whether a new value weighing size may be stored. Otherwise
+// it would only be evicted right away, along with everything else, so it is
+// evicted on its own instead.
+func (lru *LRUCacheKeyUint64) admit(k key.KeyUint64, value Cacheable, size int64) bool {
+	if lru.capacity <= 0 || size > lru.capacity {
+		lru.evict(&keyuint64Entry{key: k, value: value}, PURGE_REASON_CACHEFULL)
+		return false
+	}
+	return true
+}
+
+// entrySize is the weight of value toward the capacity.
+func (lru *LRUCacheKeyUint64) entrySize(value Cacheable) int64 {
+	if lru.capacityMode == CapacityByCount {
+		return 1
+	}
+	if size := getSize(value); size > lru.minEntrySize {
+		return size
+	}
+	return lru.minEntrySize
 }
 
-func (lru *LRUCacheKeyUint64) checkCapacity() {
+func (lru *LRUCacheKeyUint64) checkCapacity(why PurgeReason) {
+	if lru.evictionPaused {
+		return
+	}
+	if lru.shrinkPerOp > 0 {
+		// SetCapacityGradual is still catching up, whichever operation
+		// gives it the opportunity
+		why = PURGE_REASON_CAPACITY_SHRINK
+	}
+	var now time.Time
+	if lru.minResidency > 0 {
+		now = lru.now()
+	}
+	evicted := 0
 	// Partially duplicated from Delete
-	for lru.size > lru.capacity {
+	for lru.size.Load() > lru.capacity {
+		if lru.shrinkPerOp > 0 && evicted >= lru.shrinkPerOp {
+			// SetCapacityGradual: the next operation goes on
+			return
+		}
 		delElem := lru.list.Back()
+		if lru.minResidency > 0 {
+			delElem = lru.oldestEvictable(now)
+		}
+		if delElem == nil {
+			// everything left is protected by minResidency
+			return
+		}
 		delValue := delElem.Value.(*keyuint64Entry)
 		lru.list.Remove(delElem)
 		delete(lru.table, delValue.key)
-		lru.size -= delValue.size
-		safeOnPurge(delValue.value, PURGE_REASON_CACHEFULL)
+		lru.size.Add(-delValue.size)
+		evicted++
+		if !delValue.tombstone {
+			lru.evict(delValue, why)
+		}
+		releaseKeyUint64Entry(delValue)
+	}
+	lru.shrinkPerOp = 0
+}
+
+// evict counts entry as an eviction, reports it to SetReturningEvicted and
+// EvictionChannel, and purges it.
+func (lru *LRUCacheKeyUint64) evict(entry *keyuint64Entry, why PurgeReason) {
+	lru.evictions++
+	if lru.evictedSink != nil {
+		*lru.evictedSink = append(*lru.evictedSink, KeyUint64Item{Key: entry.key, Value: entry.value})
+	}
+	if lru.evictionCh != nil {
+		lru.notifyEviction(entry)
+	}
+	lru.purge(entry, why)
+}
+
+func (lru *LRUCacheKeyUint64) notifyEviction(entry *keyuint64Entry) {
+	select {
+	case lru.evictionCh <- KeyUint64Item{Key: entry.key, Value: entry.value}:
+	default:
+		lru.droppedNotifications++
+	}
+}
+
+// purge notifies the value, the OnEvict handler and the logger that entry
+// is leaving the cache, or that its value is being replaced.
+func (lru *LRUCacheKeyUint64) purge(entry *keyuint64Entry, why PurgeReason) {
+	if entry.tombstone {
+		return
+	}
+	lru.checkSize(entry)
+	if why != PURGE_REASON_UPDATE {
+		lru.logEvict(entry, why)
+	}
+	safeOnPurge(entry.value, why)
+	if lru.onEvict != nil {
+		lru.onEvict(entry.key, entry.value, why)
+	}
+}
+
+func (lru *LRUCacheKeyUint64) logEvict(entry *keyuint64Entry, why PurgeReason) {
+	if lru.logger == nil {
+		return
+	}
+	lru.logger("evict", map[string]interface{}{"key": entry.key, "size": entry.size, "reason": why})
+}
+
+func (lru *LRUCacheKeyUint64) logMiss(k key.KeyUint64) {
+	if lru.logger == nil || !lru.logMisses {
+		return
+	}
+	lru.logger("miss", map[string]interface{}{"key": k})
+}
+
+// recordSize remembers the Size() reported by the value of entry when
+// checkSizes is set, see SetCheckSizes.
+func (lru *LRUCacheKeyUint64) recordSize(entry *keyuint64Entry) {
+	entry.sizeRecorded = lru.checkSizes
+	if lru.checkSizes {
+		entry.reportedSize = getSize(entry.value)
+	}
+}
+
+// checkSize counts, and logs, a value whose Size() changed since recordSize.
+func (lru *LRUCacheKeyUint64) checkSize(entry *keyuint64Entry) {
+	if !entry.sizeRecorded {
+		return
+	}
+	reported := getSize(entry.value)
+	if reported == entry.reportedSize {
+		return
+	}
+	lru.sizeMismatches++
+	if lru.logger != nil {
+		lru.logger("size_mismatch", map[string]interface{}{"key": entry.key, "recorded": entry.reportedSize, "reported": reported})
+	}
+}
+
+// recordWriter remembers the caller of the exported method storing k, when
+// recordWriters is set. It must be called directly from that method.
+func (lru *LRUCacheKeyUint64) recordWriter(k key.KeyUint64) {
+	if !lru.recordWriters {
+		return
+	}
+	element := lru.table[k]
+	if element == nil {
+		// already evicted
+		return
+	}
+	if pc, _, _, ok := runtime.Caller(2); ok {
+		element.Value.(*keyuint64Entry).writer = pc
+	}
+}
+
+// isNegative reports whether element is a tombstone that has not expired.
+func (lru *LRUCacheKeyUint64) isNegative(element *list.Element, now time.Time) bool {
+	entry := element.Value.(*keyuint64Entry)
+	return entry.tombstone && now.Before(entry.expires)
+}
+
+// remember stores a tombstone for k, or refreshes its existing one, when
+// negative caching is enabled. A cached value for k is left alone.
+func (lru *LRUCacheKeyUint64) remember(k key.KeyUint64) {
+	if lru.negativeTTL <= 0 {
+		return
+	}
+	expires := lru.now().Add(lru.negativeTTL)
+	if element := lru.table[k]; element != nil {
+		if entry := element.Value.(*keyuint64Entry); entry.tombstone {
+			entry.expires = expires
+			lru.moveToFront(element)
+		}
+		return
+	}
+	newEntry := newKeyUint64Entry(k, nil, negativeTombstoneSize)
+	newEntry.tombstone = true
+	newEntry.expires = expires
+	lru.table[k] = lru.list.PushFront(newEntry)
+	lru.size.Add(newEntry.size)
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+// dropTombstone removes element if it is a tombstone, whether expired or
+// not, and reports whether it did. Tombstones hold no value, so nothing is
+// notified.
+func (lru *LRUCacheKeyUint64) dropTombstone(element *list.Element) bool {
+	entry := element.Value.(*keyuint64Entry)
+	if !entry.tombstone {
+		return false
+	}
+	lru.list.Remove(element)
+	delete(lru.table, entry.key)
+	lru.size.Add(-entry.size)
+	releaseKeyUint64Entry(entry)
+	return true
+}
+
+// newKeyUint64Entry returns an entry from keyuint64EntryPool.
+func newKeyUint64Entry(k key.KeyUint64, value Cacheable, size int64) *keyuint64Entry {
+	entry := keyuint64EntryPool.Get().(*keyuint64Entry)
+	entry.key, entry.value, entry.size = k, value, size
+	return entry
+}
+
+// releaseKeyUint64Entry returns to keyuint64EntryPool an entry removed from
+// the cache and purged, after clearing it so that the pool does not keep its
+// value alive. It must not be used afterwards.
+func releaseKeyUint64Entry(entry *keyuint64Entry) {
+	*entry = keyuint64Entry{}
+	keyuint64EntryPool.Put(entry)
+}
+
+// oldestEvictable returns the least recently used element that has been
+// resident for at least minResidency, or nil if there is none.
+func (lru *LRUCacheKeyUint64) oldestEvictable(now time.Time) *list.Element {
+	for e := lru.list.Back(); e != nil; e = e.Prev() {
+		if now.Sub(e.Value.(*keyuint64Entry).inserted) >= lru.minResidency {
+			return e
+		}
 	}
+	return nil
 }
@@ -0,0 +1,70 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lru
+
+import (
+	"encoding/json"
+	"fmt"
+	key "github.com/0studio/storage_key"
+	"net/http"
+)
+
+// debugHandlerMaxKeys caps the number of keys listed by DebugHandler.
+const debugHandlerMaxKeys = 100
+
+// DebugHandler returns an http.Handler serving the cache stats, as returned
+// by StatsJSON, and up to debugHandlerMaxKeys of the most recently used keys:
+//
+//	{"Stats": {"Length": 2, "Size": 2, "Capacity": 100 }, "Keys": [2, 1]}
+func (lru *LRUCacheKeyUint64) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := make([]key.KeyUint64, 0, debugHandlerMaxKeys)
+		lru.ForEach(func(k key.KeyUint64, v Cacheable) bool {
+			keys = append(keys, k)
+			return len(keys) < debugHandlerMaxKeys
+		})
+		data, err := json.Marshal(struct {
+			Stats json.RawMessage
+			Keys  []key.KeyUint64
+		}{json.RawMessage(lru.StatsJSON()), keys})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
+
+// Verify checks the internal consistency of the cache: the table and the
+// list hold the same entries, each under its own key, and their sizes add up
+// to the accounted size. It returns an error describing the first mismatch
+// found. It walks the whole cache with the lock held, so it is meant for
+// tests and debugging.
+func (lru *LRUCacheKeyUint64) Verify() error {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	if len(lru.table) != lru.list.Len() {
+		return fmt.Errorf("lru: table has %d entries, list has %d", len(lru.table), lru.list.Len())
+	}
+	var size int64
+	for e := lru.list.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*keyuint64Entry)
+		if element := lru.table[entry.key]; element != e {
+			return fmt.Errorf("lru: list entry %v is not the one in the table", entry.key)
+		}
+		size += entry.size
+	}
+	for k, element := range lru.table {
+		if entry := element.Value.(*keyuint64Entry); entry.key != k {
+			return fmt.Errorf("lru: table key %v points to the entry of %v", k, entry.key)
+		}
+	}
+	if size != lru.size.Load() {
+		return fmt.Errorf("lru: entry sizes add up to %d, size is %d", size, lru.size.Load())
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lru
+
+import (
+	"encoding/json"
+	key "github.com/0studio/storage_key"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestKeyUint64DebugHandler(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(1000)
+	for i := 0; i < debugHandlerMaxKeys+10; i++ {
+		cache.Set(key.KeyUint64(i), &CacheValue{1})
+	}
+
+	w := httptest.NewRecorder()
+	cache.DebugHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/cache", nil))
+
+	var resp struct {
+		Stats struct{ Length, Size, Capacity int64 }
+		Keys  []key.KeyUint64
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("DebugHandler returned bad json data: %v %v", w.Body.String(), err)
+	}
+	if resp.Stats.Length != debugHandlerMaxKeys+10 || resp.Stats.Size != debugHandlerMaxKeys+10 || resp.Stats.Capacity != 1000 {
+		t.Errorf("DebugHandler returned bad stats: %+v", resp.Stats)
+	}
+	if len(resp.Keys) != debugHandlerMaxKeys || resp.Keys[0] != debugHandlerMaxKeys+9 {
+		t.Errorf("DebugHandler returned bad keys: %v", resp.Keys)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("DebugHandler Content-Type = %q", ct)
+	}
+}
+
+func TestKeyUint64Verify(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(10)
+	cache.EnableNegativeCache(time.Minute)
+	for i := 0; i < 20; i++ {
+		cache.Set(key.KeyUint64(i), &CacheValue{1})
+	}
+	cache.Delete(15)
+	cache.Get(100) // tombstone
+	cache.Set(16, &CacheValue{2})
+	if err := cache.Verify(); err != nil {
+		t.Fatalf("cache.Verify() = %v on a healthy cache", err)
+	}
+
+	cache.size.Add(1)
+	if err := cache.Verify(); err == nil {
+		t.Error("cache.Verify() = nil with a wrong size")
+	}
+	cache.size.Add(-1)
+
+	cache.table[17], cache.table[18] = cache.table[18], cache.table[17]
+	if err := cache.Verify(); err == nil {
+		t.Error("cache.Verify() = nil with swapped table entries")
+	}
+	cache.table[17], cache.table[18] = cache.table[18], cache.table[17]
+
+	delete(cache.table, 19)
+	if err := cache.Verify(); err == nil {
+		t.Error("cache.Verify() = nil with an entry missing from the table")
+	}
+}
@@ -72,7 +72,11 @@ func (lru *LRUCacheKeyUint64Int32) Get(k key.KeyUint64Int32) (v Cacheable, ok bo
 			return nil, false
 		}
 		v, ok = lru.onMiss(k)
-		if ok { // should check v==nil ???
+		if v == nil {
+			// a nil value is reported as a miss rather than cached
+			ok = false
+		}
+		if ok {
 			lru.set(k, v)
 		}
 		return
@@ -141,13 +145,14 @@ func (lru *LRUCacheKeyUint64Int32) Clear() {
 
 // SetCapacity will set the capacity of the cache. If the capacity is
 // smaller, and the current cache size exceed that capacity, the cache
-// will be shrank.
+// will be shrank, purging the evicted elements with
+// PURGE_REASON_CAPACITY_SHRINK.
 func (lru *LRUCacheKeyUint64Int32) SetCapacity(capacity int64) {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
 	lru.capacity = capacity
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CAPACITY_SHRINK)
 }
 func (lru *LRUCacheKeyUint64Int32) OnMiss(onMiss OnMissHandlerKeyUint64Int32) {
 	lru.onMiss = onMiss
@@ -239,7 +244,7 @@ func (lru *LRUCacheKeyUint64Int32) updateInplace(element *list.Element, value Ca
 	element.Value.(*keyUint64Int32Entry).size = valueSize
 	lru.size += sizeDiff
 	lru.moveToFront(element)
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
 }
 
 func (lru *LRUCacheKeyUint64Int32) moveToFront(element *list.Element) {
@@ -248,20 +253,29 @@ func (lru *LRUCacheKeyUint64Int32) moveToFront(element *list.Element) {
 
 func (lru *LRUCacheKeyUint64Int32) addNew(k key.KeyUint64Int32, value Cacheable) {
 	newEntry := &keyUint64Int32Entry{k, value, getSize(value)}
+	if lru.capacity <= 0 || newEntry.size > lru.capacity {
+		// it would only be evicted right away, along with everything else
+		safeOnPurge(value, PURGE_REASON_CACHEFULL)
+		return
+	}
 	element := lru.list.PushFront(newEntry)
 	lru.table[k] = element
 	lru.size += newEntry.size
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
 }
 
-func (lru *LRUCacheKeyUint64Int32) checkCapacity() {
+func (lru *LRUCacheKeyUint64Int32) checkCapacity(why PurgeReason) {
 	// Partially duplicated from Delete
 	for lru.size > lru.capacity {
 		delElem := lru.list.Back()
+		if delElem == nil {
+			// empty, yet over a negative capacity
+			break
+		}
 		delValue := delElem.Value.(*keyUint64Int32Entry)
 		lru.list.Remove(delElem)
 		delete(lru.table, delValue.key)
 		lru.size -= delValue.size
-		safeOnPurge(delValue.value, PURGE_REASON_CACHEFULL)
+		safeOnPurge(delValue.value, why)
 	}
 }
@@ -0,0 +1,121 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lru
+
+import (
+	key "github.com/0studio/storage_key"
+	"testing"
+)
+
+func newKeyUint64BenchCache() *LRUCacheKeyUint64 {
+	cache := NewLRUCacheKeyUint64(64 * 1024 * 1024)
+	for i := 0; i < 1024; i++ {
+		cache.Set(key.KeyUint64(i), make(MyValue, 1000))
+	}
+	return cache
+}
+
+func BenchmarkKeyUint64GetParallel(b *testing.B) {
+	cache := newKeyUint64BenchCache()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i key.KeyUint64
+		for pb.Next() {
+			if _, ok := cache.Get(i % 1024); !ok {
+				panic("error")
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkKeyUint64PeekParallel(b *testing.B) {
+	cache := newKeyUint64BenchCache()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i key.KeyUint64
+		for pb.Next() {
+			if _, ok := cache.Peek(i % 1024); !ok {
+				panic("error")
+			}
+			i++
+		}
+	})
+}
+
+func newShardKeyUint64BenchCache() *ShardLRUCacheKeyUint64 {
+	cache := NewShardLRUCacheKeyUint64(16, 64*1024*1024)
+	for i := 0; i < 1024; i++ {
+		cache.Set(key.KeyUint64(i), make(MyValue, 1000))
+	}
+	return cache
+}
+
+func BenchmarkShardKeyUint64GetParallel(b *testing.B) {
+	cache := newShardKeyUint64BenchCache()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i key.KeyUint64
+		for pb.Next() {
+			if _, ok := cache.Get(i % 1024); !ok {
+				panic("error")
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkShardKeyUint64PeekParallel(b *testing.B) {
+	cache := newShardKeyUint64BenchCache()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i key.KeyUint64
+		for pb.Next() {
+			if _, ok := cache.Peek(i % 1024); !ok {
+				panic("error")
+			}
+			i++
+		}
+	})
+}
+
+// BenchmarkKeyUint64SetChurn inserts a new key on every iteration into a full
+// cache, each insert evicting the least recently used entry.
+func BenchmarkKeyUint64SetChurn(b *testing.B) {
+	cache := NewLRUCacheKeyUint64MaxItems(1024)
+	value := &CacheValue{1}
+	for i := 0; i < 1024; i++ {
+		cache.Set(key.KeyUint64(i), value)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Set(key.KeyUint64(i+1024), value)
+	}
+}
+
+func benchmarkKeyUint64Fill(b *testing.B, newCache func() *LRUCacheKeyUint64) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		cache := newCache()
+		for k := 0; k < 4096; k++ {
+			cache.Set(key.KeyUint64(k), &CacheValue{1})
+		}
+	}
+}
+
+func BenchmarkKeyUint64Fill(b *testing.B) {
+	benchmarkKeyUint64Fill(b, func() *LRUCacheKeyUint64 {
+		return NewLRUCacheKeyUint64MaxItems(4096)
+	})
+}
+
+func BenchmarkKeyUint64FillWithHint(b *testing.B) {
+	benchmarkKeyUint64Fill(b, func() *LRUCacheKeyUint64 {
+		cache := NewLRUCacheKeyUint64WithHint(4096, 4096)
+		cache.capacityMode = CapacityByCount
+		return cache
+	})
+}
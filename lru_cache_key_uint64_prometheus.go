@@ -0,0 +1,63 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build prometheus
+
+package lru
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// keyUint64Collector exports the StatsStruct of a LRUCacheKeyUint64.
+type keyUint64Collector struct {
+	lru *LRUCacheKeyUint64
+
+	length    *prometheus.Desc
+	size      *prometheus.Desc
+	capacity  *prometheus.Desc
+	hits      *prometheus.Desc
+	misses    *prometheus.Desc
+	evictions *prometheus.Desc
+}
+
+// Collector returns a prometheus.Collector exporting the cache gauges
+// (length, size, capacity) and counters (hits, misses, evictions) as
+// <namespace>_lru_<name>. The stats are read on every Collect.
+//
+// It is only built with the prometheus build tag, so that the package does
+// not depend on the Prometheus client otherwise.
+func (lru *LRUCacheKeyUint64) Collector(namespace string) prometheus.Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "lru", name), help, nil, nil)
+	}
+	return &keyUint64Collector{
+		lru:       lru,
+		length:    desc("length", "Number of elements in the cache."),
+		size:      desc("size", "Sum of the Size() of the elements in the cache."),
+		capacity:  desc("capacity", "Maximum size of the cache."),
+		hits:      desc("hits_total", "Number of Gets that found their key."),
+		misses:    desc("misses_total", "Number of Gets that did not find their key."),
+		evictions: desc("evictions_total", "Number of elements evicted to make room."),
+	}
+}
+
+func (c *keyUint64Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.length
+	ch <- c.size
+	ch <- c.capacity
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.evictions
+}
+
+func (c *keyUint64Collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.lru.StatsStruct()
+	ch <- prometheus.MustNewConstMetric(c.length, prometheus.GaugeValue, float64(s.Length))
+	ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(s.Size))
+	ch <- prometheus.MustNewConstMetric(c.capacity, prometheus.GaugeValue, float64(s.Capacity))
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(s.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(s.Misses))
+	ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(s.Evictions))
+}
@@ -0,0 +1,39 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build prometheus
+
+package lru
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"testing"
+)
+
+func TestKeyUint64Collector(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	cache.Set(1, &CacheValue{1})
+	cache.Get(1)
+	cache.Get(2)
+
+	collector := cache.Collector("test")
+	descs := make(chan *prometheus.Desc, 10)
+	collector.Describe(descs)
+	close(descs)
+	if len(descs) != 6 {
+		t.Errorf("Describe sent %v descriptions, expected 6", len(descs))
+	}
+
+	metrics := make(chan prometheus.Metric, 10)
+	collector.Collect(metrics)
+	close(metrics)
+	if len(metrics) != 6 {
+		t.Errorf("Collect sent %v metrics, expected 6", len(metrics))
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Errorf("registry.Register() returned %v", err)
+	}
+}
@@ -14,8 +14,13 @@ package lru
 import (
 	"fmt"
 	key "github.com/0studio/storage_key"
+	"sync/atomic"
 )
 
+// imbalanceCheckInterval is how many Sets happen between two automatic
+// CheckImbalance calls once an alert is configured.
+const imbalanceCheckInterval = 1024
+
 // ShardLRUCacheKeyUint64 is a typical LRU cache implementation.  If the cache
 // reaches the capacity, the least recently used item is deleted from
 // the cache. Note the capacity is not the number of items, but the
@@ -23,6 +28,25 @@ import (
 type ShardLRUCacheKeyUint64 struct {
 	shardCount int
 	cachelist  []*LRUCacheKeyUint64
+
+	// see SetShardHasher
+	hasher func(key.KeyUint64) int
+
+	// Relative shard capacities, nil for an even split, see
+	// NewShardLRUCacheKeyUint64Weighted.
+	weights []int64
+
+	// see SetImbalanceAlert
+	imbalanceThreshold float64
+	onImbalance        func(shardIdx int, load float64)
+	sets               atomic.Uint64
+}
+
+// ShardStat holds the stats of a single shard.
+type ShardStat struct {
+	Length   int64
+	Size     int64
+	Capacity int64
 }
 
 // NewLRUCacheKeyUint64 creates a new empty cache with the given capacity.
@@ -30,36 +54,128 @@ func NewShardLRUCacheKeyUint64(shardCount int, capacity int64) *ShardLRUCacheKey
 	if shardCount < 1 {
 		shardCount = 1
 	}
-	var shardCap int64 = capacity / int64(shardCount)
-	var leftCap int64 = capacity - shardCap*int64(shardCount)
-
 	c := &ShardLRUCacheKeyUint64{shardCount: shardCount, cachelist: make([]*LRUCacheKeyUint64, shardCount)}
-	for i := 0; i < shardCount; i++ {
-		if i == shardCount-1 {
-			c.cachelist[i] = NewLRUCacheKeyUint64(shardCap + leftCap)
-		} else {
-			c.cachelist[i] = NewLRUCacheKeyUint64(shardCap)
+	for i, shardCap := range shardCapacities(capacity, shardCount, nil) {
+		c.cachelist[i] = NewLRUCacheKeyUint64(shardCap)
+	}
+
+	return c
+}
+
+// NewShardLRUCacheKeyUint64Weighted creates a new empty cache with a shard
+// per weight, each with the weight as its capacity, for uneven shards.
+// SetCapacity keeps the shard capacities proportional to the weights. It
+// panics if weights is empty or one of them is not positive.
+func NewShardLRUCacheKeyUint64Weighted(weights []int64) *ShardLRUCacheKeyUint64 {
+	if len(weights) == 0 {
+		panic("lru: NewShardLRUCacheKeyUint64Weighted: no weights")
+	}
+	for i, w := range weights {
+		if w <= 0 {
+			panic(fmt.Sprintf("lru: NewShardLRUCacheKeyUint64Weighted: weight %d of shard %d is not positive", w, i))
 		}
+	}
+	c := &ShardLRUCacheKeyUint64{
+		shardCount: len(weights),
+		cachelist:  make([]*LRUCacheKeyUint64, len(weights)),
+		weights:    append([]int64(nil), weights...),
+	}
+	for i, w := range weights {
+		c.cachelist[i] = NewLRUCacheKeyUint64(w)
+	}
+	return c
+}
 
+// shardCapacities splits capacity among shardCount shards, evenly or, if
+// weights is not nil, according to the weights, the last shard getting the
+// remainder.
+func shardCapacities(capacity int64, shardCount int, weights []int64) []int64 {
+	caps := make([]int64, shardCount)
+	var total, assigned int64
+	for _, w := range weights {
+		total += w
+	}
+	for i := 0; i < shardCount-1; i++ {
+		if weights != nil {
+			caps[i] = int64(float64(capacity) * float64(weights[i]) / float64(total))
+		} else {
+			caps[i] = capacity / int64(shardCount)
+		}
+		assigned += caps[i]
 	}
+	caps[shardCount-1] = capacity - assigned
+	return caps
+}
 
+// NewShardLRUCacheKeyUint64MaxItems creates a new empty cache bounded to
+// maxItems items: every shard uses CapacityByCount (see
+// NewLRUCacheKeyUint64MaxItems) with its part of maxItems. The limit is per
+// shard, so the total never exceeds maxItems, but with an uneven spread of
+// the keys a shard may start evicting before the whole cache holds maxItems
+// items.
+func NewShardLRUCacheKeyUint64MaxItems(shardCount int, maxItems int64) *ShardLRUCacheKeyUint64 {
+	c := NewShardLRUCacheKeyUint64(shardCount, maxItems)
+	for _, cache := range c.cachelist {
+		cache.capacityMode = CapacityByCount
+	}
 	return c
 }
 
+// GetShard returns the shard k belongs to, chosen by k.ToSum(), or the hash
+// set with SetShardHasher, modulo the number of shards. The hash is taken as
+// unsigned, as the sum overflows int for the largest keys.
 func (lru *ShardLRUCacheKeyUint64) GetShard(k key.KeyUint64) *LRUCacheKeyUint64 {
-	idx := k.ToSum() % lru.shardCount
+	var h int
+	if lru.hasher != nil {
+		h = lru.hasher(k)
+	} else {
+		h = k.ToSum()
+	}
+	idx := uint(h) % uint(lru.shardCount)
 	return lru.cachelist[idx]
 }
 
+// SetShardHasher replaces k.ToSum() as the hash GetShard spreads the keys
+// with, for keys whose sums share their low bits. A nil hasher restores the
+// default. Keys already cached are not moved, so that they may become
+// unreachable: it must be set before the cache is used.
+func (lru *ShardLRUCacheKeyUint64) SetShardHasher(hasher func(key.KeyUint64) int) {
+	lru.hasher = hasher
+}
+
+// GetShardByIndex returns the i-th shard, or nil if i is out of range.
+func (lru *ShardLRUCacheKeyUint64) GetShardByIndex(i int) *LRUCacheKeyUint64 {
+	if i < 0 || i >= lru.shardCount {
+		return nil
+	}
+	return lru.cachelist[i]
+}
+
 // Get returns a value from the cache, and marks the keyuint64Entry as most
 // recently used.
 func (lru *ShardLRUCacheKeyUint64) Get(k key.KeyUint64) (v Cacheable, ok bool) {
 	return lru.GetShard(k).Get(k)
 }
 
+// Peek returns a value from the cache without marking it as most recently
+// used and without consulting onMiss. It only takes a read lock on the
+// shard, so concurrent Peeks never block each other.
+func (lru *ShardLRUCacheKeyUint64) Peek(k key.KeyUint64) (v Cacheable, ok bool) {
+	return lru.GetShard(k).Peek(k)
+}
+
+// Contains reports whether k is in the cache, without affecting its position
+// and without consulting onMiss. Like Peek, it only takes a read lock.
+func (lru *ShardLRUCacheKeyUint64) Contains(k key.KeyUint64) bool {
+	return lru.GetShard(k).Contains(k)
+}
+
 // Set sets a value in the cache.
 func (lru *ShardLRUCacheKeyUint64) Set(k key.KeyUint64, value Cacheable) {
 	lru.GetShard(k).Set(k, value)
+	if lru.onImbalance != nil && lru.sets.Add(1)%imbalanceCheckInterval == 0 {
+		lru.CheckImbalance()
+	}
 }
 
 // SetIfAbsent will set the value in the cache if not present. If the
@@ -84,18 +200,9 @@ func (lru *ShardLRUCacheKeyUint64) Clear() {
 // smaller, and the current cache size exceed that capacity, the cache
 // will be shrank.
 func (lru *ShardLRUCacheKeyUint64) SetCapacity(capacity int64) {
-	var shardCap int64 = capacity / int64(lru.shardCount)
-	var leftCap int64 = capacity - shardCap*int64(lru.shardCount)
-
-	for i := 0; i < lru.shardCount; i++ {
-		if i == lru.shardCount-1 {
-			lru.cachelist[i].SetCapacity(shardCap + leftCap)
-		} else {
-			lru.cachelist[i].SetCapacity(shardCap)
-		}
-
+	for i, shardCap := range shardCapacities(capacity, lru.shardCount, lru.weights) {
+		lru.cachelist[i].SetCapacity(shardCap)
 	}
-
 }
 func (lru *ShardLRUCacheKeyUint64) OnMiss(onMiss OnMissHandlerKeyUint64) {
 	for idx, _ := range lru.cachelist {
@@ -103,6 +210,40 @@ func (lru *ShardLRUCacheKeyUint64) OnMiss(onMiss OnMissHandlerKeyUint64) {
 	}
 }
 
+// SetImbalanceAlert makes the cache call cb for every shard whose size
+// exceeds threshold times the mean shard size, which usually means keys are
+// poorly distributed. load is the shard size divided by the mean. Shards are
+// checked every imbalanceCheckInterval Sets, or on demand with
+// CheckImbalance. A nil cb disables the alert.
+//
+// Like OnMiss, it must be called before the cache is used concurrently.
+func (lru *ShardLRUCacheKeyUint64) SetImbalanceAlert(threshold float64, cb func(shardIdx int, load float64)) {
+	lru.imbalanceThreshold = threshold
+	lru.onImbalance = cb
+}
+
+// CheckImbalance runs the check configured by SetImbalanceAlert.
+func (lru *ShardLRUCacheKeyUint64) CheckImbalance() {
+	if lru.onImbalance == nil {
+		return
+	}
+	sizes := make([]int64, lru.shardCount)
+	var total int64
+	for idx, _ := range lru.cachelist {
+		sizes[idx] = lru.cachelist[idx].Size()
+		total += sizes[idx]
+	}
+	if total <= 0 {
+		return
+	}
+	mean := float64(total) / float64(lru.shardCount)
+	for idx, size := range sizes {
+		if load := float64(size) / mean; load > lru.imbalanceThreshold {
+			lru.onImbalance(idx, load)
+		}
+	}
+}
+
 // Stats
 func (lru *ShardLRUCacheKeyUint64) Stats() (length, size, capacity int64) {
 	for idx, _ := range lru.cachelist {
@@ -114,6 +255,15 @@ func (lru *ShardLRUCacheKeyUint64) Stats() (length, size, capacity int64) {
 	return
 }
 
+// ShardStats returns the stats of each shard, indexed like GetShardByIndex.
+func (lru *ShardLRUCacheKeyUint64) ShardStats() []ShardStat {
+	stats := make([]ShardStat, lru.shardCount)
+	for idx, _ := range lru.cachelist {
+		stats[idx].Length, stats[idx].Size, stats[idx].Capacity = lru.cachelist[idx].Stats()
+	}
+	return stats
+}
+
 // StatsJSON returns stats as a JSON object in a key.KeyUint64.
 func (lru *ShardLRUCacheKeyUint64) StatsJSON() string {
 	if lru == nil {
@@ -123,6 +273,16 @@ func (lru *ShardLRUCacheKeyUint64) StatsJSON() string {
 	return fmt.Sprintf("{\"Length\": %v, \"Size\": %v, \"Capacity\": %v }", l, s, c)
 }
 
+// Config returns the configuration of the first shard, with the total
+// Capacity and the ShardCount. Shards configured individually through
+// GetShardByIndex may differ.
+func (lru *ShardLRUCacheKeyUint64) Config() CacheConfig {
+	config := lru.cachelist[0].Config()
+	config.Capacity = lru.Capacity()
+	config.ShardCount = lru.shardCount
+	return config
+}
+
 // Length returns how many elements are in the cache
 func (lru *ShardLRUCacheKeyUint64) Length() (length int64) {
 	for idx, _ := range lru.cachelist {
@@ -144,7 +304,7 @@ func (lru *ShardLRUCacheKeyUint64) Size() (size int64) {
 // Capacity returns the cache maximum capacity.
 func (lru *ShardLRUCacheKeyUint64) Capacity() (capacity int64) {
 	for idx, _ := range lru.cachelist {
-		c := lru.cachelist[idx].Size()
+		c := lru.cachelist[idx].Capacity()
 		capacity += c
 	}
 	return
@@ -183,3 +343,24 @@ func (lru *ShardLRUCacheKeyUint64) Values() []Cacheable {
 	}
 	return values
 }
+
+// ValuesFunc calls fn for every value, shard by shard, and stops as soon as
+// fn returns false. Unlike Values it does not build the aggregate slice.
+//
+// Only the shard being visited is locked, so this is not a snapshot of the
+// whole cache: other shards may change between visits. fn is called with that
+// shard read-locked and must not call back into the cache.
+func (lru *ShardLRUCacheKeyUint64) ValuesFunc(fn func(Cacheable) bool) {
+	for _, cache := range lru.cachelist {
+		stopped := false
+		cache.ForEach(func(k key.KeyUint64, v Cacheable) bool {
+			if !fn(v) {
+				stopped = true
+			}
+			return !stopped
+		})
+		if stopped {
+			return
+		}
+	}
+}
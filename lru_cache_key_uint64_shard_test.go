@@ -91,14 +91,15 @@ func TestShardKeyUint64SetUpdatesSize(t *testing.T) {
 	emptyValue := &CacheValue{0}
 	k := key.KeyUint64(1)
 	cache.Set(k, emptyValue)
-	if _, sz, _ := cache.Stats(); sz != 0 {
-		t.Errorf("cache.Size() = %v, expected 0", sz)
+	// counted as defaultMinEntrySize
+	if _, sz, _ := cache.Stats(); sz != 1 {
+		t.Errorf("cache.Size() = %v, expected 1", sz)
 	}
 	someValue := &CacheValue{20}
 	k = key.KeyUint64(2)
 	cache.Set(k, someValue)
-	if _, sz, _ := cache.Stats(); sz != 20 {
-		t.Errorf("cache.Size() = %v, expected 20", sz)
+	if _, sz, _ := cache.Stats(); sz != 21 {
+		t.Errorf("cache.Size() = %v, expected 21", sz)
 	}
 }
 
@@ -122,8 +123,8 @@ func TestShardKeyUint64SetWithOldKeyUpdatesSize(t *testing.T) {
 	k := key.KeyUint64(1)
 	cache.Set(k, emptyValue)
 
-	if _, sz, _ := cache.Stats(); sz != 0 {
-		t.Errorf("cache.Size() = %v, expected %v", sz, 0)
+	if _, sz, _ := cache.Stats(); sz != 1 {
+		t.Errorf("cache.Size() = %v, expected %v", sz, 1)
 	}
 
 	someValue := &CacheValue{20}
@@ -335,3 +336,242 @@ func TestShardKeyUint64OnMiss(t *testing.T) {
 	}
 
 }
+
+func TestShardKeyUint64CapacityWithData(t *testing.T) {
+	cache := NewShardLRUCacheKeyUint64(4, 100)
+	for i := 0; i < 10; i++ {
+		cache.Set(key.KeyUint64(i), &CacheValue{1})
+	}
+	if c := cache.Capacity(); c != 100 {
+		t.Errorf("cache.Capacity() = %v, expected 100", c)
+	}
+	if s := cache.Size(); s != 10 {
+		t.Errorf("cache.Size() = %v, expected 10", s)
+	}
+}
+
+func TestShardKeyUint64ShardStats(t *testing.T) {
+	cache := NewShardLRUCacheKeyUint64(2, 100)
+	for i := 0; i < 10; i++ {
+		cache.Set(key.KeyUint64(i), &CacheValue{i})
+	}
+
+	stats := cache.ShardStats()
+	if len(stats) != 2 {
+		t.Fatalf("len(ShardStats()) = %v, expected 2", len(stats))
+	}
+	var total ShardStat
+	for idx, stat := range stats {
+		l, s, c := cache.GetShardByIndex(idx).Stats()
+		if stat != (ShardStat{Length: l, Size: s, Capacity: c}) {
+			t.Errorf("ShardStats()[%d] = %+v, expected %v %v %v", idx, stat, l, s, c)
+		}
+		total.Length += stat.Length
+		total.Size += stat.Size
+		total.Capacity += stat.Capacity
+	}
+	if l, s, c := cache.Stats(); total != (ShardStat{Length: l, Size: s, Capacity: c}) {
+		t.Errorf("sum of ShardStats() = %+v, expected %v %v %v", total, l, s, c)
+	}
+
+	if cache.GetShardByIndex(2) != nil || cache.GetShardByIndex(-1) != nil {
+		t.Error("GetShardByIndex() out of range should return nil")
+	}
+}
+
+func TestShardKeyUint64ImbalanceAlert(t *testing.T) {
+	cache := NewShardLRUCacheKeyUint64(4, 10000)
+	hot := make(map[int]float64)
+	cache.SetImbalanceAlert(2, func(shardIdx int, load float64) {
+		hot[shardIdx] = load
+	})
+
+	// only store keys landing in the same shard
+	hotShard := cache.GetShard(0)
+	var hotIdx int
+	for idx := 0; idx < 4; idx++ {
+		if cache.GetShardByIndex(idx) == hotShard {
+			hotIdx = idx
+		}
+	}
+	for k := key.KeyUint64(0); hotShard.Length() < imbalanceCheckInterval; k++ {
+		if cache.GetShard(k) == hotShard {
+			cache.Set(k, &CacheValue{1})
+		}
+	}
+
+	if len(hot) != 1 || hot[hotIdx] != 4 {
+		t.Errorf("imbalance alert fired for %v, expected shard %d with load 4", hot, hotIdx)
+	}
+}
+
+func TestShardKeyUint64Peek(t *testing.T) {
+	cache := NewShardLRUCacheKeyUint64(1, 2)
+	value := &CacheValue{1}
+	cache.Set(1, value)
+	cache.Set(2, &CacheValue{1})
+
+	if v, ok := cache.Peek(1); !ok || v.(*CacheValue) != value {
+		t.Errorf("cache.Peek(1) = %v, %v, expected %v", v, ok, value)
+	}
+	if !cache.Contains(1) || cache.Contains(3) {
+		t.Error("cache.Contains() returned incorrect results")
+	}
+	// Peek and Contains don't promote: k1 is still the least recently used
+	cache.Set(3, &CacheValue{1})
+	if cache.Contains(1) {
+		t.Error("Peek promoted k1")
+	}
+}
+
+func TestShardKeyUint64ValuesFunc(t *testing.T) {
+	cache := NewShardLRUCacheKeyUint64(4, 100)
+	// one value in every shard
+	expected := map[*CacheValue]bool{}
+	for i := 0; i < 4; i++ {
+		for k := key.KeyUint64(0); ; k++ {
+			if cache.GetShard(k) == cache.GetShardByIndex(i) {
+				v := &CacheValue{1}
+				cache.Set(k, v)
+				expected[v] = true
+				break
+			}
+		}
+	}
+
+	visited := map[*CacheValue]bool{}
+	cache.ValuesFunc(func(v Cacheable) bool {
+		visited[v.(*CacheValue)] = true
+		return true
+	})
+	if len(visited) != 4 {
+		t.Errorf("ValuesFunc visited %v values, expected 4", len(visited))
+	}
+	for v := range expected {
+		if !visited[v] {
+			t.Errorf("ValuesFunc did not visit %v", v)
+		}
+	}
+
+	n := 0
+	cache.ValuesFunc(func(v Cacheable) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 {
+		t.Errorf("ValuesFunc did not stop early: visited %v", n)
+	}
+}
+
+func TestShardKeyUint64CapacityRoundTrip(t *testing.T) {
+	for _, shardCount := range []int{1, 2, 3, 7, 16} {
+		for _, capacity := range []int64{0, 1, 5, 15, 16, 17, 100, 1001} {
+			cache := NewShardLRUCacheKeyUint64(shardCount, capacity)
+			if c := cache.Capacity(); c != capacity {
+				t.Errorf("NewShardLRUCacheKeyUint64(%v, %v).Capacity() = %v", shardCount, capacity, c)
+			}
+			cache.SetCapacity(capacity + 3)
+			if c := cache.Capacity(); c != capacity+3 {
+				t.Errorf("shards %v: SetCapacity(%v) then Capacity() = %v", shardCount, capacity+3, c)
+			}
+		}
+	}
+}
+
+func TestShardKeyUint64MaxItems(t *testing.T) {
+	cache := NewShardLRUCacheKeyUint64MaxItems(4, 10)
+	for k := key.KeyUint64(0); k < 1000; k++ {
+		cache.Set(k, &CacheValue{100})
+	}
+	if c := cache.Capacity(); c != 10 {
+		t.Errorf("cache.Capacity() = %v, expected 10", c)
+	}
+	if l, sz := cache.Length(), cache.Size(); l > 10 || sz != l {
+		t.Errorf("cache.Length(), cache.Size() = %v, %v, expected at most 10 items weighing 1", l, sz)
+	}
+	for i, s := range cache.ShardStats() {
+		if s.Length > s.Capacity {
+			t.Errorf("shard %v holds %v items, over its limit of %v", i, s.Length, s.Capacity)
+		}
+	}
+}
+
+func TestShardKeyUint64Config(t *testing.T) {
+	cache := NewShardLRUCacheKeyUint64MaxItems(4, 102)
+	if c := cache.Config(); c.Capacity != 102 || c.ShardCount != 4 || c.CapacityMode != CapacityByCount {
+		t.Errorf("cache.Config() = %+v, expected Capacity 102, ShardCount 4 and CapacityByCount", c)
+	}
+}
+
+func TestShardKeyUint64LargeKeys(t *testing.T) {
+	cache := NewShardLRUCacheKeyUint64(7, 1000)
+	keys := []key.KeyUint64{0, 1, 1<<63 - 1, 1 << 63, 1<<63 + 5, 1<<64 - 1, 1<<64 - 7}
+	for _, k := range keys {
+		cache.Set(k, &CacheValue{1})
+	}
+	for _, k := range keys {
+		if _, ok := cache.Get(k); !ok {
+			t.Errorf("cache.Get(%v) missed", k)
+		}
+	}
+	if l := cache.Length(); l != int64(len(keys)) {
+		t.Errorf("cache.Length() = %v, expected %v", l, len(keys))
+	}
+}
+
+func TestShardKeyUint64SetShardHasher(t *testing.T) {
+	cache := NewShardLRUCacheKeyUint64(4, 1000)
+	// keys sharing their low bits all land in the first shard by default
+	for i := 0; i < 8; i++ {
+		if cache.GetShard(key.KeyUint64(i<<2)) != cache.GetShardByIndex(0) {
+			t.Fatalf("key %v not in shard 0 by default", i<<2)
+		}
+	}
+
+	cache.SetShardHasher(func(k key.KeyUint64) int {
+		return int(k >> 2)
+	})
+	for i := 0; i < 8; i++ {
+		k := key.KeyUint64(i << 2)
+		cache.Set(k, &CacheValue{1})
+		if cache.GetShard(k) != cache.GetShardByIndex(i%4) {
+			t.Errorf("key %v not in shard %v with the custom hasher", k, i%4)
+		}
+	}
+	for _, s := range cache.ShardStats() {
+		if s.Length != 2 {
+			t.Errorf("cache.ShardStats() = %v, expected 2 entries per shard", cache.ShardStats())
+			break
+		}
+	}
+}
+
+func TestShardKeyUint64Weighted(t *testing.T) {
+	cache := NewShardLRUCacheKeyUint64Weighted([]int64{1, 2, 3})
+	if c := cache.Capacity(); c != 6 {
+		t.Errorf("cache.Capacity() = %v, expected 6", c)
+	}
+	for i, s := range cache.ShardStats() {
+		if s.Capacity != int64(i+1) {
+			t.Errorf("shard %v capacity = %v, expected %v", i, s.Capacity, i+1)
+		}
+	}
+
+	cache.SetCapacity(61)
+	for i, expected := range []int64{10, 20, 31} {
+		if c := cache.GetShardByIndex(i).Capacity(); c != expected {
+			t.Errorf("shard %v capacity after SetCapacity(61) = %v, expected %v", i, c, expected)
+		}
+	}
+
+	for _, weights := range [][]int64{nil, {1, 0}, {-1}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewShardLRUCacheKeyUint64Weighted(%v) did not panic", weights)
+				}
+			}()
+			NewShardLRUCacheKeyUint64Weighted(weights)
+		}()
+	}
+}
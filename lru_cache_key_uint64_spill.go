@@ -0,0 +1,97 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lru
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	key "github.com/0studio/storage_key"
+	"io"
+	"sync"
+)
+
+// ExportEvicted returns a spill handler appending every entry it is called
+// with to w, in call order, as a length-prefixed gob-encoded KeyUint64Item.
+// Values are encoded as interfaces: their concrete types must be registered
+// with gob.Register. Install it with OnEvict, for the reasons to spill:
+//
+//	spill := lru.ExportEvicted(w)
+//	cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+//		if why == PURGE_REASON_CACHEFULL {
+//			spill(k, v)
+//		}
+//	})
+//
+// The first write or encoding error stops the export: the entries evicted
+// afterwards are dropped. Read the records back with ReadEvicted or
+// ImportEvicted.
+func ExportEvicted(w io.Writer) func(k key.KeyUint64, v Cacheable) {
+	var mu sync.Mutex
+	var failed bool
+	return func(k key.KeyUint64, v Cacheable) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failed {
+			return
+		}
+		var record bytes.Buffer
+		if err := gob.NewEncoder(&record).Encode(KeyUint64Item{Key: k, Value: v}); err != nil {
+			failed = true
+			return
+		}
+		var prefix [4]byte
+		binary.BigEndian.PutUint32(prefix[:], uint32(record.Len()))
+		if _, err := w.Write(prefix[:]); err != nil {
+			failed = true
+			return
+		}
+		if _, err := w.Write(record.Bytes()); err != nil {
+			failed = true
+		}
+	}
+}
+
+// ReadEvicted decodes the records written by ExportEvicted, in eviction
+// order.
+func ReadEvicted(r io.Reader) ([]KeyUint64Item, error) {
+	var items []KeyUint64Item
+	var prefix [4]byte
+	for {
+		if _, err := io.ReadFull(r, prefix[:]); err == io.EOF {
+			return items, nil
+		} else if err != nil {
+			return items, err
+		}
+		record := make([]byte, binary.BigEndian.Uint32(prefix[:]))
+		if _, err := io.ReadFull(r, record); err != nil {
+			return items, err
+		}
+		var item KeyUint64Item
+		if err := gob.NewDecoder(bytes.NewReader(record)).Decode(&item); err != nil {
+			return items, err
+		}
+		items = append(items, item)
+	}
+}
+
+// ImportEvicted reads the records written by ExportEvicted and returns an
+// onMiss handler replaying them, so that a cache re-imports spilled entries
+// lazily as they are requested. When a key was spilled more than once, its
+// last record wins.
+func ImportEvicted(r io.Reader) (OnMissHandlerKeyUint64, error) {
+	items, err := ReadEvicted(r)
+	if err != nil {
+		return nil, err
+	}
+	spilled := make(map[key.KeyUint64]Cacheable, len(items))
+	for _, item := range items {
+		spilled[item.Key] = item.Value
+	}
+	return func(k key.KeyUint64) (Cacheable, bool) {
+		v, ok := spilled[k]
+		return v, ok
+	}, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lru
+
+import (
+	"bytes"
+	key "github.com/0studio/storage_key"
+	"testing"
+)
+
+func TestKeyUint64ExportImportEvicted(t *testing.T) {
+	var buf bytes.Buffer
+	spill := ExportEvicted(&buf)
+	cache := NewLRUCacheKeyUint64(2)
+	cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+		if why == PURGE_REASON_CACHEFULL {
+			spill(k, v)
+		}
+	})
+	cache.Set(1, "one")
+	cache.Set(2, "two")
+	cache.Set(3, "three") // spills k1
+	cache.Set(4, "four")  // spills k2
+	cache.Delete(3)       // not spilled
+
+	items, err := ReadEvicted(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadEvicted() returned %v", err)
+	}
+	if len(items) != 2 || items[0].Key != 1 || items[0].Value != "one" || items[1].Key != 2 || items[1].Value != "two" {
+		t.Errorf("ReadEvicted() = %v, expected k1 then k2", items)
+	}
+
+	onMiss, err := ImportEvicted(&buf)
+	if err != nil {
+		t.Fatalf("ImportEvicted() returned %v", err)
+	}
+	fresh := NewLRUCacheKeyUint64(10)
+	fresh.OnMiss(onMiss)
+	if v, ok := fresh.Get(2); !ok || v != "two" {
+		t.Errorf("fresh.Get(2) = %v, %v, expected two", v, ok)
+	}
+	if _, ok := fresh.Get(3); ok {
+		t.Error("fresh.Get(3) found an entry that was never spilled")
+	}
+	if !fresh.Contains(2) {
+		t.Error("re-imported k2 not stored")
+	}
+}
+
+func TestKeyUint64ReadEvictedTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	ExportEvicted(&buf)(1, "one")
+	if _, err := ReadEvicted(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err == nil {
+		t.Error("ReadEvicted() of a truncated record did not return an error")
+	}
+}
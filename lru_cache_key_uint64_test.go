@@ -5,9 +5,15 @@
 package lru
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"encoding/json"
 	key "github.com/0studio/storage_key"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestKeyUint64InitialState(t *testing.T) {
@@ -91,14 +97,15 @@ func TestKeyUint64SetUpdatesSize(t *testing.T) {
 	emptyValue := &CacheValue{0}
 	k := key.KeyUint64(1)
 	cache.Set(k, emptyValue)
-	if _, sz, _ := cache.Stats(); sz != 0 {
-		t.Errorf("cache.Size() = %v, expected 0", sz)
+	// counted as defaultMinEntrySize
+	if _, sz, _ := cache.Stats(); sz != 1 {
+		t.Errorf("cache.Size() = %v, expected 1", sz)
 	}
 	someValue := &CacheValue{20}
 	k = key.KeyUint64(2)
 	cache.Set(k, someValue)
-	if _, sz, _ := cache.Stats(); sz != 20 {
-		t.Errorf("cache.Size() = %v, expected 20", sz)
+	if _, sz, _ := cache.Stats(); sz != 21 {
+		t.Errorf("cache.Size() = %v, expected 21", sz)
 	}
 }
 
@@ -122,8 +129,8 @@ func TestKeyUint64SetWithOldKeyUpdatesSize(t *testing.T) {
 	k := key.KeyUint64(1)
 	cache.Set(k, emptyValue)
 
-	if _, sz, _ := cache.Stats(); sz != 0 {
-		t.Errorf("cache.Size() = %v, expected %v", sz, 0)
+	if _, sz, _ := cache.Stats(); sz != 1 {
+		t.Errorf("cache.Size() = %v, expected %v", sz, 1)
 	}
 
 	someValue := &CacheValue{20}
@@ -322,6 +329,44 @@ func TestKeyUint64ClearOnPurge(t *testing.T) {
 
 }
 
+// countingPurgeValue counts its OnPurge calls in purged.
+type countingPurgeValue struct {
+	purged *int
+}
+
+func (v countingPurgeValue) Size() int {
+	return 1
+}
+
+func (v countingPurgeValue) OnPurge(why PurgeReason) {
+	*v.purged++
+}
+
+func TestKeyUint64ClearCallbacks(t *testing.T) {
+	for _, detached := range []bool{false, true} {
+		cache := NewLRUCacheKeyUint64(100)
+		cache.SetDetachedClear(detached)
+		purged, evicted := 0, 0
+		for i := 0; i < 10; i++ {
+			cache.Set(key.KeyUint64(i), countingPurgeValue{&purged})
+		}
+		cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+			if why != PURGE_REASON_CLEAR_ALL {
+				t.Errorf("OnEvict(%v) with %v, expected PURGE_REASON_CLEAR_ALL", k, why)
+			}
+			evicted++
+		})
+
+		cache.Clear()
+		if purged != 10 || evicted != 10 {
+			t.Errorf("detached %v: %v OnPurge and %v OnEvict calls, expected 10 each", detached, purged, evicted)
+		}
+		if l, sz := cache.Length(), cache.Size(); l != 0 || sz != 0 {
+			t.Errorf("detached %v: cache.Length(), cache.Size() = %v, %v after Clear, expected 0, 0", detached, l, sz)
+		}
+	}
+}
+
 func TestKeyUint64OnMiss(t *testing.T) {
 	fun := func(k key.KeyUint64) (Cacheable, bool) {
 		return 1, true
@@ -335,3 +380,1559 @@ func TestKeyUint64OnMiss(t *testing.T) {
 	}
 
 }
+
+func TestKeyUint64SizeApprox(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	if sz := cache.SizeApprox(); sz != 0 {
+		t.Errorf("cache.SizeApprox() = %v, expected 0", sz)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for k := key.KeyUint64(0); k < 1000; k++ {
+			cache.Set(k, &CacheValue{1})
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		if sz := cache.SizeApprox(); sz < 0 || sz > 100 {
+			t.Fatalf("cache.SizeApprox() = %v, expected it within [0, 100]", sz)
+		}
+	}
+	<-done
+	if sz, want := cache.SizeApprox(), cache.Size(); sz != want {
+		t.Errorf("cache.SizeApprox() = %v, expected %v", sz, want)
+	}
+}
+
+func TestKeyUint64EvictionChannel(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(2)
+	evicted := cache.EvictionChannel(2)
+	for k := key.KeyUint64(1); k <= 6; k++ {
+		cache.Set(k, &CacheValue{1})
+	}
+	cache.Delete(6) // not an eviction
+
+	for _, want := range []key.KeyUint64{1, 2} {
+		if item := <-evicted; item.Key != want {
+			t.Errorf("evicted %v, expected %v", item.Key, want)
+		}
+	}
+	select {
+	case item := <-evicted:
+		t.Errorf("evicted %v, expected the buffer to have been full", item.Key)
+	default:
+	}
+	if n := cache.DroppedNotifications(); n != 2 {
+		t.Errorf("cache.DroppedNotifications() = %v, expected 2", n)
+	}
+
+	cache.EvictionChannel(1)
+	if _, ok := <-evicted; ok {
+		t.Error("previous channel is still open")
+	}
+}
+
+func TestKeyUint64EvictionChannelOversize(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(2)
+	evicted := cache.EvictionChannel(1)
+	cache.Set(1, &CacheValue{3})
+	if item := <-evicted; item.Key != 1 {
+		t.Errorf("evicted %v, expected the oversize 1", item.Key)
+	}
+	if got := cache.SetReturningEvicted(2, &CacheValue{3}); len(got) != 1 || got[0].Key != 2 {
+		t.Errorf("cache.SetReturningEvicted(2) = %v, expected the oversize 2", got)
+	}
+	if s := cache.StatsStruct(); s.Evictions != 2 {
+		t.Errorf("cache.StatsStruct().Evictions = %v, expected 2", s.Evictions)
+	}
+}
+
+func TestKeyUint64Remove(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	value := &PurgeCacheValueKeyUint64{}
+	cache.Set(1, value)
+	cache.Set(2, &CacheValue{1})
+	purgeReasonFlag4TestKeyUint64 = PURGE_REASON_CACHEFULL // init
+
+	v, ok := cache.Remove(1)
+	if !ok || v.(*PurgeCacheValueKeyUint64) != value {
+		t.Errorf("cache.Remove(1) = %v, %v, expected %v, true", v, ok, value)
+	}
+	if purgeReasonFlag4TestKeyUint64 != PURGE_REASON_DELETE {
+		t.Errorf("after cache.Remove ,purgeReason should be %d ,but get %d", PURGE_REASON_DELETE, purgeReasonFlag4TestKeyUint64)
+	}
+	if v, ok := cache.Remove(1); ok || v != nil {
+		t.Errorf("second cache.Remove(1) = %v, %v, expected nil, false", v, ok)
+	}
+	if l, sz, _ := cache.Stats(); l != 1 || sz != 1 {
+		t.Errorf("cache.Stats() = %v, %v, expected 1, 1", l, sz)
+	}
+}
+
+func TestKeyUint64OnMissNil(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	cache.OnMiss(func(k key.KeyUint64) (Cacheable, bool) {
+		return nil, true
+	})
+	if v, ok := cache.Get(1); ok || v != nil {
+		t.Errorf("cache.Get(1) = %v, %v, expected nil, false", v, ok)
+	}
+	if results := cache.GetMultiCtx(context.Background(), []key.KeyUint64{2}); len(results) != 0 {
+		t.Errorf("cache.GetMultiCtx([2]) = %v, expected no results", results)
+	}
+	cache.Preload([]key.KeyUint64{3})
+	if l := cache.Length(); l != 0 {
+		t.Errorf("cache.Length() = %v, expected 0", l)
+	}
+}
+
+func TestKeyUint64ForEach(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	cache.Set(1, &CacheValue{1})
+	cache.Set(2, &CacheValue{2})
+	cache.Set(3, &CacheValue{3})
+	// lru: [k3, k2, k1]
+
+	var sum int
+	var visited []key.KeyUint64
+	cache.ForEach(func(k key.KeyUint64, v Cacheable) bool {
+		visited = append(visited, k)
+		sum += v.(*CacheValue).size
+		return true
+	})
+	if sum != 6 {
+		t.Errorf("ForEach sum = %v, expected 6", sum)
+	}
+	if len(visited) != 3 || visited[0] != 3 || visited[2] != 1 {
+		t.Errorf("ForEach visited %v, expected [3 2 1]", visited)
+	}
+
+	visited = visited[:0]
+	cache.ForEach(func(k key.KeyUint64, v Cacheable) bool {
+		visited = append(visited, k)
+		return false
+	})
+	if len(visited) != 1 {
+		t.Errorf("ForEach did not stop early: visited %v", visited)
+	}
+}
+
+func TestKeyUint64StatsStruct(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(2)
+	cache.Set(1, &CacheValue{1})
+	cache.Set(2, &CacheValue{1})
+	cache.Set(3, &CacheValue{1}) // evicts k1
+	cache.Get(2)
+	cache.Get(1)
+
+	expected := CacheStats{Length: 2, Size: 2, Capacity: 2, Hits: 1, Misses: 1, Evictions: 1}
+	if s := cache.StatsStruct(); s != expected {
+		t.Errorf("cache.StatsStruct() = %+v, expected %+v", s, expected)
+	}
+	if l, sz, c := cache.Stats(); l != 2 || sz != 2 || c != 2 {
+		t.Errorf("cache.Stats() = %v, %v, %v, expected 2, 2, 2", l, sz, c)
+	}
+}
+
+func TestKeyUint64StatsSince(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(2)
+	cache.Set(1, &CacheValue{1})
+	cache.Get(1)
+	cache.Get(2)
+	prev := cache.StatsStruct()
+	if prev.Hits != 1 || prev.Misses != 1 || prev.Evictions != 0 {
+		t.Errorf("StatsStruct() = %+v, expected 1 hit, 1 miss, 0 evictions", prev)
+	}
+
+	cache.Set(2, &CacheValue{1})
+	cache.Set(3, &CacheValue{1}) // evicts k1
+	cache.Get(2)
+	cache.Get(3)
+	cache.Get(1)
+
+	delta := cache.StatsSince(prev)
+	if delta.Hits != 2 || delta.Misses != 1 || delta.Evictions != 1 {
+		t.Errorf("StatsSince() = %+v, expected 2 hits, 1 miss, 1 eviction", delta)
+	}
+	if delta.Length != 2 || delta.Size != 2 || delta.Capacity != 2 {
+		t.Errorf("StatsSince() gauges = %+v, expected length 2, size 2, capacity 2", delta)
+	}
+}
+
+func TestKeyUint64Peek(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	cache.OnMiss(func(k key.KeyUint64) (Cacheable, bool) {
+		return &CacheValue{1}, true
+	})
+	data := &CacheValue{1}
+	cache.Set(1, data)
+	cache.Set(2, &CacheValue{1})
+	// lru: [k2, k1]
+
+	v, ok := cache.Peek(1)
+	if !ok || v.(*CacheValue) != data {
+		t.Errorf("Cache.Peek() returned incorrect value: %v != %v", data, v)
+	}
+	if keys := cache.Keys(); keys[0] != 2 {
+		t.Errorf("Cache.Peek() promoted the entry: %v", keys)
+	}
+	if _, ok := cache.Peek(3); ok {
+		t.Error("Cache.Peek() returned a value for a missing key")
+	}
+	if cache.Contains(3) || !cache.Contains(1) {
+		t.Error("Cache.Contains() returned incorrect result")
+	}
+	if l := cache.Len(); l != 2 {
+		t.Errorf("Cache.Len() = %v, expected 2 (Peek must not call onMiss)", l)
+	}
+}
+
+func TestKeyUint64GetMultiCtx(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	cache.Set(1, &CacheValue{1})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	release := make(chan struct{})
+	defer close(release)
+	cache.OnMiss(func(k key.KeyUint64) (Cacheable, bool) {
+		if k == 3 {
+			// still loading when ctx is done, once 2 is stored
+			for !cache.Contains(2) {
+				time.Sleep(time.Millisecond)
+			}
+			cancel()
+			<-release
+		}
+		return &CacheValue{1}, true
+	})
+
+	results := cache.GetMultiCtx(ctx, []key.KeyUint64{1, 2, 3})
+	if len(results) != 2 || results[1] == nil || results[2] == nil {
+		t.Errorf("GetMultiCtx returned %v, expected keys 1 and 2", results)
+	}
+	if _, ok := results[3]; ok {
+		t.Error("GetMultiCtx returned a key loaded after the deadline")
+	}
+	if !cache.Contains(2) {
+		t.Error("GetMultiCtx did not store the loaded key")
+	}
+}
+
+func TestKeyUint64MinResidency(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(3)
+	cache.Set(1, &CacheValue{1})
+	cache.Set(2, &CacheValue{1})
+	cache.SetMinResidency(time.Hour)
+	cache.Set(3, &CacheValue{1})
+	cache.Get(1)
+	cache.Get(2)
+	// lru: [k2, k1, k3], k3 is the only young entry
+
+	cache.Set(4, &CacheValue{1})
+	if !cache.Contains(3) {
+		t.Error("young entry was evicted despite min residency")
+	}
+	if cache.Contains(1) {
+		t.Error("oldest old-enough entry was not evicted")
+	}
+	if sz := cache.Size(); sz != 3 {
+		t.Errorf("cache.Size() = %v, expected 3", sz)
+	}
+
+	// all remaining candidates are young: overshoot rather than evict
+	cache.Set(5, &CacheValue{1})
+	cache.Set(6, &CacheValue{1})
+	if !cache.Contains(3) || !cache.Contains(5) || !cache.Contains(6) {
+		t.Error("young entries were evicted despite min residency")
+	}
+	if sz := cache.Size(); sz != 4 {
+		t.Errorf("cache.Size() = %v, expected 4", sz)
+	}
+}
+
+func TestKeyUint64PromoteAfterAccesses(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(4)
+	cache.SetPromoteAfterAccesses(2)
+	cache.Set(1, &CacheValue{1})
+	cache.Set(2, &CacheValue{1})
+	cache.Set(3, &CacheValue{1})
+	cache.Set(4, &CacheValue{1})
+	// lru: [k4, k3, k2, k1]
+
+	// hot keys, accessed twice
+	cache.Get(1)
+	cache.Get(1)
+	cache.Get(2)
+	cache.Get(2)
+	// scan, accessed once
+	cache.Get(3)
+	cache.Get(4)
+	// lru: [k2, k1, k4, k3]
+
+	cache.Set(5, &CacheValue{1})
+	cache.Set(6, &CacheValue{1})
+	if cache.Contains(3) || cache.Contains(4) {
+		t.Error("once-accessed scan entries were not evicted first")
+	}
+	if !cache.Contains(1) || !cache.Contains(2) {
+		t.Error("twice-accessed entries were evicted")
+	}
+}
+
+type loggedEventKeyUint64 struct {
+	event  string
+	fields map[string]interface{}
+}
+
+func TestKeyUint64Logger(t *testing.T) {
+	var events []loggedEventKeyUint64
+	cache := NewLRUCacheKeyUint64(1)
+	cache.SetLogger(func(event string, fields map[string]interface{}) {
+		events = append(events, loggedEventKeyUint64{event, fields})
+	})
+
+	cache.Set(1, &CacheValue{1})
+	cache.Delete(1)
+	cache.Set(2, &CacheValue{1})
+	cache.Set(3, &CacheValue{1}) // evicts k2
+	cache.Get(5)                 // misses are not logged by default
+	cache.SetLogMisses(true)
+	cache.Get(4)
+
+	expected := []loggedEventKeyUint64{
+		{"evict", map[string]interface{}{"key": key.KeyUint64(1), "size": int64(1), "reason": PURGE_REASON_DELETE}},
+		{"evict", map[string]interface{}{"key": key.KeyUint64(2), "size": int64(1), "reason": PURGE_REASON_CACHEFULL}},
+		{"miss", map[string]interface{}{"key": key.KeyUint64(4)}},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("logged %v, expected %v", events, expected)
+	}
+	for i := range expected {
+		if events[i].event != expected[i].event || len(events[i].fields) != len(expected[i].fields) {
+			t.Errorf("event %d = %v, expected %v", i, events[i], expected[i])
+			continue
+		}
+		for name, v := range expected[i].fields {
+			if events[i].fields[name] != v {
+				t.Errorf("event %d field %q = %v, expected %v", i, name, events[i].fields[name], v)
+			}
+		}
+	}
+
+	cache.SetLogger(nil)
+	cache.Delete(3) // must not panic
+}
+
+func TestKeyUint64ItemsWithSize(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	mutable := &CacheValue{5}
+	cache.Set(1, mutable)
+	cache.Set(2, &CacheValue{7})
+	mutable.size = 50 // not reported to the cache
+
+	items := cache.ItemsWithSize()
+	if len(items) != 2 {
+		t.Fatalf("ItemsWithSize() returned %v", items)
+	}
+	if items[0].Key != 2 || items[0].Size != 7 {
+		t.Errorf("ItemsWithSize()[0] = %+v, expected key 2 size 7", items[0])
+	}
+	if items[1].Key != 1 || items[1].Size != 5 || items[1].Value != mutable {
+		t.Errorf("ItemsWithSize()[1] = %+v, expected key 1 size 5", items[1])
+	}
+}
+
+func TestKeyUint64MaxItems(t *testing.T) {
+	cache := NewLRUCacheKeyUint64MaxItems(2)
+	cache.Set(1, &CacheValue{10})
+	cache.Set(2, &CacheValue{0})
+	if l, sz, _ := cache.Stats(); l != 2 || sz != 2 {
+		t.Errorf("cache length, size = %v, %v, expected 2, 2", l, sz)
+	}
+	cache.Set(3, &CacheValue{1})
+	if cache.Contains(1) {
+		t.Error("item budget was not enforced")
+	}
+}
+
+func TestKeyUint64ResetCount(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	cache.Set(1, &PurgeCacheValueKeyUint64{})
+	cache.Set(2, &CacheValue{50})
+	purgeReasonFlag4TestKeyUint64 = PURGE_REASON_DELETE // init
+
+	cache.ResetCount(3)
+	if purgeReasonFlag4TestKeyUint64 != PURGE_REASON_CLEAR_ALL {
+		t.Errorf("after cache.ResetCount ,purgeReason should be %d ,but get %d", PURGE_REASON_CLEAR_ALL, purgeReasonFlag4TestKeyUint64)
+	}
+	if l, sz, c := cache.Stats(); l != 0 || sz != 0 || c != 3 {
+		t.Errorf("cache stats = %v, %v, %v, expected 0, 0, 3", l, sz, c)
+	}
+
+	for k := key.KeyUint64(1); k <= 4; k++ {
+		cache.Set(k, &CacheValue{50})
+	}
+	if l, sz, _ := cache.Stats(); l != 3 || sz != 3 {
+		t.Errorf("cache length, size = %v, %v, expected 3, 3", l, sz)
+	}
+	if cache.Contains(1) {
+		t.Error("new item budget was not enforced")
+	}
+}
+
+func TestKeyUint64OnEvict(t *testing.T) {
+	type evicted struct {
+		k   key.KeyUint64
+		v   Cacheable
+		why PurgeReason
+	}
+	var got []evicted
+	cache := NewLRUCacheKeyUint64(2)
+	cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+		got = append(got, evicted{k, v, why})
+	})
+
+	v1, v2, v3, v4 := []byte("1"), []byte("2"), []byte("3"), []byte("4")
+	cache.Set(1, v1)
+	cache.Set(1, v2) // update
+	cache.Set(2, v3)
+	cache.Set(3, v4) // evicts k1
+	cache.Delete(2)
+	cache.Clear() // clears k3
+
+	expected := []evicted{
+		{1, v1, PURGE_REASON_UPDATE},
+		{1, v2, PURGE_REASON_CACHEFULL},
+		{2, v3, PURGE_REASON_DELETE},
+		{3, v4, PURGE_REASON_CLEAR_ALL},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("OnEvict called with %v, expected %v", got, expected)
+	}
+	for i := range expected {
+		if got[i].k != expected[i].k || string(got[i].v.([]byte)) != string(expected[i].v.([]byte)) || got[i].why != expected[i].why {
+			t.Errorf("OnEvict call %d = %v, expected %v", i, got[i], expected[i])
+		}
+	}
+}
+
+func TestKeyUint64SetReturningEvicted(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(4)
+	v1, v2 := &CacheValue{1}, &CacheValue{1}
+	cache.Set(1, v1)
+	cache.Set(2, v2)
+	cache.Set(3, &CacheValue{1})
+
+	if evicted := cache.SetReturningEvicted(4, &CacheValue{1}); len(evicted) != 0 {
+		t.Errorf("SetReturningEvicted() = %v, expected nothing evicted", evicted)
+	}
+	evicted := cache.SetReturningEvicted(5, &CacheValue{2})
+	if len(evicted) != 2 || evicted[0].Key != 1 || evicted[0].Value != v1 || evicted[1].Key != 2 || evicted[1].Value != v2 {
+		t.Errorf("SetReturningEvicted() = %v, expected k1 then k2", evicted)
+	}
+	if cache.Contains(1) || cache.Contains(2) {
+		t.Error("evicted entries are still in the cache")
+	}
+}
+
+func TestKeyUint64RestoreAdmission(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(3)
+	big := &CacheValue{4}
+	var rejected []key.KeyUint64
+	cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+		if why == PURGE_REASON_CACHEFULL {
+			rejected = append(rejected, k)
+		}
+	})
+	cache.Restore([]KeyUint64Item{{Key: 1, Value: &CacheValue{1}}, {Key: 2, Value: big}, {Key: 3, Value: &CacheValue{1}}})
+	if keys := cache.Keys(); len(keys) != 2 || keys[0] != 1 || keys[1] != 3 {
+		t.Errorf("cache.Keys() = %v, expected [1 3] without the oversize item", keys)
+	}
+	if len(rejected) != 1 || rejected[0] != 2 {
+		t.Errorf("rejected %v, expected [2]", rejected)
+	}
+
+	rejected = nil
+	cache.SetCapacity(0)
+	cache.Restore([]KeyUint64Item{{Key: 4, Value: &CacheValue{1}}})
+	if l, sz := cache.Length(), cache.Size(); l != 0 || sz != 0 {
+		t.Errorf("cache length, size = %v, %v, expected 0, 0 with a capacity of 0", l, sz)
+	}
+	if len(rejected) != 1 || rejected[0] != 4 {
+		t.Errorf("rejected %v, expected [4]", rejected)
+	}
+}
+
+func TestKeyUint64SnapshotRestore(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	cache.Set(1, "one")
+	cache.Set(2, "two")
+	cache.Set(3, "three")
+	cache.Get(1)
+	// lru: [k1, k3, k2]
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cache.Snapshot()); err != nil {
+		t.Fatalf("gob encoding of Snapshot() failed: %v", err)
+	}
+	var items []KeyUint64Item
+	if err := gob.NewDecoder(&buf).Decode(&items); err != nil {
+		t.Fatalf("gob decoding of Snapshot() failed: %v", err)
+	}
+
+	restored := NewLRUCacheKeyUint64(2)
+	restored.Set(9, &PurgeCacheValueKeyUint64{})
+	purgeReasonFlag4TestKeyUint64 = PURGE_REASON_DELETE // init
+	restored.Restore(items)
+	if purgeReasonFlag4TestKeyUint64 != PURGE_REASON_CLEAR_ALL {
+		t.Errorf("after cache.Restore ,purgeReason should be %d ,but get %d", PURGE_REASON_CLEAR_ALL, purgeReasonFlag4TestKeyUint64)
+	}
+
+	// k2, the least recently used, does not fit
+	keys := restored.Keys()
+	if len(keys) != 2 || keys[0] != 1 || keys[1] != 3 {
+		t.Errorf("restored keys = %v, expected [1 3]", keys)
+	}
+	if v, ok := restored.Peek(3); !ok || v.(string) != "three" {
+		t.Errorf("restored value = %v, expected three", v)
+	}
+	if sz := restored.Size(); sz != 2 {
+		t.Errorf("restored size = %v, expected 2", sz)
+	}
+}
+
+func TestKeyUint64MinEntrySize(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(10) // defaultMinEntrySize
+	for k := key.KeyUint64(0); k < 100; k++ {
+		cache.Set(k, &CacheValue{0})
+	}
+	if l, sz := cache.Length(), cache.Size(); l != 10 || sz != 10 {
+		t.Errorf("cache length, size = %v, %v, expected 10, 10", l, sz)
+	}
+	cache.Set(100, &CacheValue{5})
+	if l, sz := cache.Length(), cache.Size(); l != 6 || sz != 10 {
+		t.Errorf("cache length, size = %v, %v, expected 6, 10", l, sz)
+	}
+
+	cache.SetMinEntrySize(0)
+	for k := key.KeyUint64(200); k < 300; k++ {
+		cache.Set(k, &CacheValue{0})
+	}
+	if l, sz := cache.Length(), cache.Size(); l != 106 || sz != 10 {
+		t.Errorf("cache length, size = %v, %v, expected 106, 10 counting sizes as reported", l, sz)
+	}
+}
+
+// errAfterContext reports no error for its first n calls to Err, then
+// calls onDone and reports context.Canceled.
+type errAfterContext struct {
+	context.Context
+	n      int
+	onDone func()
+}
+
+func (ctx *errAfterContext) Err() error {
+	if ctx.n > 0 {
+		ctx.n--
+		return nil
+	}
+	if ctx.onDone != nil {
+		ctx.onDone()
+		ctx.onDone = nil
+		return nil
+	}
+	return context.Canceled
+}
+
+func TestKeyUint64ItemsCtx(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(10000)
+	for k := key.KeyUint64(0); k < 3*itemsCtxChunkSize; k++ {
+		cache.Set(k, &CacheValue{1})
+	}
+
+	items, err := cache.ItemsCtx(context.Background())
+	if err != nil || len(items) != 3*itemsCtxChunkSize || items[0].Key != 3*itemsCtxChunkSize-1 {
+		t.Errorf("ItemsCtx() returned %v items, %v", len(items), err)
+	}
+
+	// canceled after the first chunk
+	items, err = cache.ItemsCtx(&errAfterContext{Context: context.Background(), n: 1})
+	if err != context.Canceled || items != nil {
+		t.Errorf("ItemsCtx() = %v items, %v, expected context.Canceled", len(items), err)
+	}
+
+	// the entry starting the second chunk is deleted while the lock is released
+	cursorKey := key.KeyUint64(2*itemsCtxChunkSize - 1)
+	ctx := &errAfterContext{Context: context.Background(), n: 1, onDone: func() {
+		cache.Delete(cursorKey)
+	}}
+	if _, err = cache.ItemsCtx(ctx); err != ErrSnapshotInterrupted {
+		t.Errorf("ItemsCtx() error = %v, expected ErrSnapshotInterrupted", err)
+	}
+
+	// it is promoted instead, which used to list it twice
+	cursorKey--
+	ctx = &errAfterContext{Context: context.Background(), n: 1, onDone: func() {
+		cache.Get(cursorKey)
+	}}
+	if _, err = cache.ItemsCtx(ctx); err != ErrSnapshotInterrupted {
+		t.Errorf("ItemsCtx() error = %v after a promotion, expected ErrSnapshotInterrupted", err)
+	}
+
+	// promoting an entry already listed is harmless
+	cache = NewLRUCacheKeyUint64(10000)
+	for k := key.KeyUint64(0); k < 2*itemsCtxChunkSize; k++ {
+		cache.Set(k, &CacheValue{1})
+	}
+	ctx = &errAfterContext{Context: context.Background(), n: 1, onDone: func() {
+		cache.Get(2*itemsCtxChunkSize - 1)
+	}}
+	items, err = cache.ItemsCtx(ctx)
+	if err != nil || len(items) != 2*itemsCtxChunkSize {
+		t.Errorf("ItemsCtx() = %v items, %v, expected %v items", len(items), err, 2*itemsCtxChunkSize)
+	}
+}
+
+func TestKeyUint64Clone(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(3)
+	v1 := &CacheValue{1}
+	cache.Set(1, v1)
+	cache.Set(2, &CacheValue{1})
+	cache.Set(3, &CacheValue{1})
+
+	clone := cache.Clone()
+	if l, sz, c := clone.Stats(); l != 3 || sz != 3 || c != 3 {
+		t.Errorf("clone stats = %v, %v, %v, expected 3, 3, 3", l, sz, c)
+	}
+	if keys := clone.Keys(); keys[0] != 3 || keys[2] != 1 {
+		t.Errorf("clone keys = %v, expected [3 2 1]", keys)
+	}
+	if v, _ := clone.Peek(1); v != v1 {
+		t.Error("clone does not share the values")
+	}
+
+	// evictions in the clone don't touch the original, and vice versa
+	clone.Set(4, &CacheValue{1})
+	if clone.Contains(1) || !cache.Contains(1) {
+		t.Error("clone and original share their list/table")
+	}
+	cache.Delete(2)
+	if !clone.Contains(2) {
+		t.Error("deleting from the original removed the key from the clone")
+	}
+}
+
+func TestKeyUint64CloneConfig(t *testing.T) {
+	cache := NewLRUCacheKeyUint64MaxItems(10)
+	cache.SetMinEntrySize(2)
+	cache.SetMinResidency(time.Second)
+	cache.SetPromoteAfterAccesses(3)
+	cache.EnableNegativeCache(time.Minute)
+	cache.SetDetachedClear(true)
+	cache.SetCheckSizes(true)
+	cache.SetRecordWriters(true)
+	cache.PauseEviction()
+
+	if c, expected := cache.Clone().Config(), cache.Config(); c != expected {
+		t.Errorf("clone.Config() = %+v, expected %+v", c, expected)
+	}
+}
+
+func TestKeyUint64UpdateAll(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	for k := key.KeyUint64(1); k <= 6; k++ {
+		cache.Set(k, &CacheValue{int(k)})
+	}
+	// lru: [k6, k5, k4, k3, k2, k1]
+	deleted := map[key.KeyUint64]PurgeReason{}
+	cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+		if why != PURGE_REASON_UPDATE {
+			deleted[k] = why
+		}
+	})
+
+	// double every value and drop the odd keys
+	cache.UpdateAll(func(k key.KeyUint64, v Cacheable) (Cacheable, bool) {
+		if k%2 == 1 {
+			return nil, false
+		}
+		return &CacheValue{v.(*CacheValue).size * 2}, true
+	})
+	if len(deleted) != 3 || deleted[1] != PURGE_REASON_DELETE || deleted[3] != PURGE_REASON_DELETE || deleted[5] != PURGE_REASON_DELETE {
+		t.Errorf("deleted = %v, expected 1, 3 and 5 with PURGE_REASON_DELETE", deleted)
+	}
+	for _, k := range []key.KeyUint64{2, 4, 6} {
+		v, ok := cache.Peek(k)
+		if !ok || v.(*CacheValue).size != int(k)*2 {
+			t.Errorf("cache.Peek(%v) = %v, %v, expected %v", k, v, ok, k*2)
+		}
+	}
+	if sz := cache.Size(); sz != 24 {
+		t.Errorf("cache.Size() = %v, expected 24", sz)
+	}
+	// positions are preserved
+	if keys := cache.Keys(); len(keys) != 3 || keys[0] != 6 || keys[1] != 4 || keys[2] != 2 {
+		t.Errorf("cache.Keys() = %v, expected [6 4 2]", keys)
+	}
+
+	// growing past the capacity evicts the least recently used entries
+	cache.UpdateAll(func(k key.KeyUint64, v Cacheable) (Cacheable, bool) {
+		return &CacheValue{40}, true
+	})
+	if keys := cache.Keys(); len(keys) != 2 || keys[0] != 6 || keys[1] != 4 {
+		t.Errorf("cache.Keys() = %v, expected [6 4]", keys)
+	}
+	if deleted[2] != PURGE_REASON_CACHEFULL {
+		t.Errorf("k2 purge reason = %v, expected PURGE_REASON_CACHEFULL", deleted[2])
+	}
+}
+
+func TestKeyUint64UpdateAllSameOrNil(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	kept := &CacheValue{1}
+	cache.Set(1, kept)
+	cache.Set(2, &CacheValue{1})
+	cache.Set(3, make(MyValue, 2)) // not comparable
+	var purges []PurgeReason
+	cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+		purges = append(purges, why)
+	})
+
+	cache.UpdateAll(func(k key.KeyUint64, v Cacheable) (Cacheable, bool) {
+		switch k {
+		case 1:
+			v.(*CacheValue).size = 5 // updated in place
+			return v, true
+		case 2:
+			return nil, true
+		}
+		return v, true
+	})
+	if len(purges) != 2 || purges[0] != PURGE_REASON_UPDATE || purges[1] != PURGE_REASON_DELETE {
+		t.Errorf("purges = %v, expected an update of k3 then the deletion of k2", purges)
+	}
+	if v, ok := cache.Peek(1); !ok || v != kept {
+		t.Errorf("cache.Peek(1) = %v, %v, expected the same value", v, ok)
+	}
+	if cache.Contains(2) {
+		t.Error("entry updated to nil was kept")
+	}
+	if sz := cache.Size(); sz != 7 {
+		t.Errorf("cache.Size() = %v, expected 7", sz)
+	}
+}
+
+func TestKeyUint64DeleteMulti(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	for k := key.KeyUint64(1); k <= 5; k++ {
+		cache.Set(k, &CacheValue{1})
+	}
+	var purged []key.KeyUint64
+	cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+		if why != PURGE_REASON_DELETE {
+			t.Errorf("purge reason for %v = %v, expected PURGE_REASON_DELETE", k, why)
+		}
+		purged = append(purged, k)
+	})
+
+	// 9 is absent and 2 is listed twice
+	if n := cache.DeleteMulti([]key.KeyUint64{2, 4, 9, 2}); n != 2 {
+		t.Errorf("cache.DeleteMulti() = %v, expected 2", n)
+	}
+	if len(purged) != 2 || purged[0] != 2 || purged[1] != 4 {
+		t.Errorf("purged %v, expected [2 4]", purged)
+	}
+	if keys := cache.Keys(); len(keys) != 3 || keys[0] != 5 || keys[1] != 3 || keys[2] != 1 {
+		t.Errorf("cache.Keys() = %v, expected [5 3 1]", keys)
+	}
+	if sz := cache.Size(); sz != 3 {
+		t.Errorf("cache.Size() = %v, expected 3", sz)
+	}
+	if n := cache.DeleteMulti(nil); n != 0 {
+		t.Errorf("cache.DeleteMulti(nil) = %v, expected 0", n)
+	}
+}
+
+// blockingPurgeValue signals entered and then blocks in OnPurge until release
+// is closed.
+type blockingPurgeValue struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (v *blockingPurgeValue) Size() int {
+	return 1
+}
+
+func (v *blockingPurgeValue) OnPurge(why PurgeReason) {
+	v.entered <- struct{}{}
+	<-v.release
+}
+
+func TestKeyUint64DetachedClear(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	cache.SetDetachedClear(true)
+	value := &blockingPurgeValue{entered: make(chan struct{}, 3), release: make(chan struct{})}
+	cache.Set(1, value)
+	cache.Set(2, value)
+	cache.Set(3, value)
+
+	done := make(chan struct{})
+	go func() {
+		cache.Clear()
+		close(done)
+	}()
+	<-value.entered // Clear is stuck in the first OnPurge
+
+	got := make(chan bool)
+	go func() {
+		_, ok := cache.Get(1)
+		cache.Set(4, &CacheValue{1})
+		got <- ok
+	}()
+	select {
+	case ok := <-got:
+		if ok {
+			t.Error("cache.Get(1) hit after Clear")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cache operations blocked by OnPurge callbacks of Clear")
+	}
+
+	close(value.release)
+	<-done
+	if l := cache.Length(); l != 1 {
+		t.Errorf("cache.Length() = %v, expected 1", l)
+	}
+}
+
+func TestKeyUint64GetTypedOr(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	value := &CacheValue{1}
+	cache.Set(1, value)
+	def := &CacheValue{2}
+
+	if v := GetTypedOr(cache, 1, def); v != value {
+		t.Errorf("GetTypedOr(1) = %v, expected %v", v, value)
+	}
+	if v := GetTypedOr[MyValue](cache, 1, MyValue("def")); string(v) != "def" {
+		t.Errorf("GetTypedOr[MyValue](1) = %v, expected the default", v)
+	}
+	if v := GetTypedOr(cache, 2, def); v != def {
+		t.Errorf("GetTypedOr(2) = %v, expected the default", v)
+	}
+}
+
+func TestKeyUint64GetTyped(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	value := &CacheValue{1}
+	cache.Set(1, value)
+
+	if v, ok := GetTyped[*CacheValue](cache, 1); !ok || v != value {
+		t.Errorf("GetTyped(1) = %v, %v, expected %v, true", v, ok, value)
+	}
+	if v, ok := GetTyped[MyValue](cache, 1); ok || v != nil {
+		t.Errorf("GetTyped[MyValue](1) = %v, %v, expected nil, false", v, ok)
+	}
+	if v, ok := GetTyped[*CacheValue](cache, 2); ok || v != nil {
+		t.Errorf("GetTyped(2) = %v, %v, expected nil, false", v, ok)
+	}
+}
+
+func TestKeyUint64MustGetTyped(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	value := &CacheValue{1}
+	cache.Set(1, value)
+
+	if v, ok := MustGetTyped[*CacheValue](cache, 1); !ok || v != value {
+		t.Errorf("MustGetTyped(1) = %v, %v, expected %v, true", v, ok, value)
+	}
+	if v, ok := MustGetTyped[MyValue](cache, 2); ok || v != nil {
+		t.Errorf("MustGetTyped(2) = %v, %v, expected nil, false", v, ok)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("MustGetTyped[MyValue](1) did not panic on a *CacheValue")
+		}
+	}()
+	MustGetTyped[MyValue](cache, 1)
+}
+
+func TestKeyUint64DeleteFunc(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	for k := key.KeyUint64(1); k <= 6; k++ {
+		cache.Set(k, &CacheValue{int(k)})
+	}
+	purged := 0
+	cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+		if why != PURGE_REASON_DELETE {
+			t.Errorf("purge reason for %v = %v, expected PURGE_REASON_DELETE", k, why)
+		}
+		purged++
+	})
+
+	// adjacent matches exercise removal during the traversal
+	n := cache.DeleteFunc(func(k key.KeyUint64, v Cacheable) bool {
+		return k >= 3 && k <= 5 || v.(*CacheValue).size == 1
+	})
+	if n != 4 || purged != 4 {
+		t.Errorf("cache.DeleteFunc() = %v with %v purges, expected 4", n, purged)
+	}
+	if keys := cache.Keys(); len(keys) != 2 || keys[0] != 6 || keys[1] != 2 {
+		t.Errorf("cache.Keys() = %v, expected [6 2]", keys)
+	}
+	if sz := cache.Size(); sz != 8 {
+		t.Errorf("cache.Size() = %v, expected 8", sz)
+	}
+}
+
+func TestKeyUint64PauseEviction(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(3)
+	cache.PauseEviction()
+	for k := key.KeyUint64(1); k <= 5; k++ {
+		cache.Set(k, &CacheValue{1})
+	}
+	if l, sz, _ := cache.Stats(); l != 5 || sz != 5 {
+		t.Errorf("paused cache.Stats() = %v, %v, expected 5, 5", l, sz)
+	}
+
+	cache.ResumeEviction()
+	if sz := cache.Size(); sz != 3 {
+		t.Errorf("cache.Size() = %v, expected 3", sz)
+	}
+	if keys := cache.Keys(); len(keys) != 3 || keys[0] != 5 || keys[2] != 3 {
+		t.Errorf("cache.Keys() = %v, expected [5 4 3]", keys)
+	}
+	cache.Set(6, &CacheValue{1})
+	if sz := cache.Size(); sz != 3 {
+		t.Errorf("cache.Size() after resume = %v, expected 3", sz)
+	}
+}
+
+func TestKeyUint64GetMultiStats(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	v1, v3 := &CacheValue{1}, &CacheValue{3}
+	cache.Set(1, v1)
+	cache.Set(2, &CacheValue{2})
+	cache.Set(3, v3)
+
+	results, hits, misses := cache.GetMultiStats([]key.KeyUint64{1, 3, 4, 5, 1, 4})
+	if hits != 2 || misses != 2 {
+		t.Errorf("hits, misses = %v, %v, expected 2, 2", hits, misses)
+	}
+	if len(results) != 2 || results[1] != v1 || results[3] != v3 {
+		t.Errorf("results = %v, expected 1 and 3", results)
+	}
+	if s := cache.StatsStruct(); s.Hits != 2 || s.Misses != 2 {
+		t.Errorf("cache.StatsStruct() = %+v, expected 2 hits and 2 misses", s)
+	}
+	// hits are promoted, k2 is now the least recently used
+	if keys := cache.Keys(); keys[2] != 2 {
+		t.Errorf("cache.Keys() = %v, expected k2 last", keys)
+	}
+}
+
+func TestKeyUint64CapacityShrinkReason(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(3)
+	reasons := map[key.KeyUint64]PurgeReason{}
+	cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+		reasons[k] = why
+	})
+	for k := key.KeyUint64(1); k <= 4; k++ {
+		cache.Set(k, &CacheValue{1})
+	}
+	cache.SetCapacity(2)
+	if len(reasons) != 2 || reasons[1] != PURGE_REASON_CACHEFULL || reasons[2] != PURGE_REASON_CAPACITY_SHRINK {
+		t.Errorf("purge reasons = %v, expected k1 full and k2 shrink", reasons)
+	}
+}
+
+func TestKeyUint64NegativeCache(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	clock := time.Unix(0, 0)
+	cache.now = func() time.Time { return clock }
+	cache.EnableNegativeCache(time.Minute)
+	found := false
+	loads := 0
+	cache.OnMiss(func(k key.KeyUint64) (Cacheable, bool) {
+		loads++
+		if found {
+			return &CacheValue{1}, true
+		}
+		return nil, false
+	})
+	cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+		t.Errorf("OnEvict called for %v (%v)", k, why)
+	})
+
+	cache.Get(1)
+	if _, ok := cache.Get(1); ok || loads != 1 {
+		t.Errorf("second Get: ok = %v with %v loads, expected a miss with 1 load", ok, loads)
+	}
+	if l, sz, _ := cache.Stats(); l != 1 || sz != negativeTombstoneSize {
+		t.Errorf("cache.Stats() = %v, %v, expected the tombstone to count", l, sz)
+	}
+	if _, ok := cache.Peek(1); ok || cache.Contains(1) || len(cache.Keys()) != 0 || len(cache.Items()) != 0 {
+		t.Error("tombstone visible through the read APIs")
+	}
+
+	// once expired, onMiss is consulted again
+	clock = clock.Add(time.Minute)
+	found = true
+	if _, ok := cache.Get(1); !ok || loads != 2 {
+		t.Errorf("Get after expiry: ok = %v with %v loads, expected a hit with 2 loads", ok, loads)
+	}
+	if sz := cache.Size(); sz != 1 {
+		t.Errorf("cache.Size() = %v, expected 1", sz)
+	}
+
+	// Set replaces a tombstone
+	found = false
+	cache.Get(2)
+	value := &CacheValue{1}
+	cache.Set(2, value)
+	if v, ok := cache.Get(2); !ok || v != value || loads != 3 {
+		t.Errorf("Get after Set = %v, %v with %v loads, expected %v", v, ok, loads, value)
+	}
+	if cache.Delete(3) {
+		t.Error("cache.Delete(3) = true, expected false")
+	}
+}
+
+func TestKeyUint64NegativeCacheEviction(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(2)
+	cache.EnableNegativeCache(time.Hour)
+	cache.OnMiss(func(k key.KeyUint64) (Cacheable, bool) {
+		return nil, false
+	})
+	cache.Set(1, &CacheValue{1})
+	cache.Get(2)
+	cache.Get(3) // evicts k1
+	if cache.Contains(1) {
+		t.Error("k1 was not evicted by the tombstones")
+	}
+	cache.Set(4, &CacheValue{1}) // evicts the k2 tombstone
+	if s := cache.StatsStruct(); s.Length != 2 || s.Evictions != 1 {
+		t.Errorf("cache.StatsStruct() = %+v, expected 2 entries and 1 eviction", s)
+	}
+}
+
+func TestKeyUint64OnCapacityChange(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(10)
+	var changes [][2]int64
+	cache.OnCapacityChange(func(old, new int64) {
+		changes = append(changes, [2]int64{old, new})
+	})
+
+	cache.SetCapacity(20)
+	cache.SetCapacity(20) // unchanged
+	cache.SetCapacity(5)
+	cache.SetCapacityGradual(4, 1)
+	cache.ResetCount(3)
+	expected := [][2]int64{{10, 20}, {20, 5}, {5, 4}, {4, 3}}
+	if len(changes) != len(expected) {
+		t.Fatalf("capacity changes = %v, expected %v", changes, expected)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("capacity changes = %v, expected %v", changes, expected)
+			break
+		}
+	}
+}
+
+func TestKeyUint64Preload(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	cached := &CacheValue{1}
+	cache.Set(1, cached)
+	var mu sync.Mutex
+	loads := map[key.KeyUint64]int{}
+	cache.OnMiss(func(k key.KeyUint64) (Cacheable, bool) {
+		mu.Lock()
+		loads[k]++
+		mu.Unlock()
+		return &CacheValue{1}, k != 4
+	})
+
+	cache.Preload([]key.KeyUint64{1, 2, 3, 2, 4})
+	if len(loads) != 3 || loads[2] != 1 || loads[3] != 1 || loads[4] != 1 {
+		t.Errorf("loads = %v, expected 2, 3 and 4 once each", loads)
+	}
+	for _, k := range []key.KeyUint64{2, 3} {
+		if !cache.Contains(k) {
+			t.Errorf("k%v not resident after Preload", k)
+		}
+	}
+	if v, _ := cache.Peek(1); v != cached {
+		t.Error("Preload replaced a cached value")
+	}
+	if cache.Contains(4) {
+		t.Error("k4 cached although onMiss did not find it")
+	}
+	if s := cache.StatsStruct(); s.Hits != 0 || s.Misses != 0 {
+		t.Errorf("cache.StatsStruct() = %+v, expected no hits and misses", s)
+	}
+}
+
+func TestKeyUint64CheckSizes(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	cache.SetCheckSizes(true)
+	var logged []loggedEventKeyUint64
+	cache.SetLogger(func(event string, fields map[string]interface{}) {
+		if event == "size_mismatch" {
+			logged = append(logged, loggedEventKeyUint64{event, fields})
+		}
+	})
+	drifting := &CacheValue{1}
+	cache.Set(1, drifting)
+	cache.Set(2, &CacheValue{1})
+
+	drifting.size = 5
+	cache.Set(1, &CacheValue{1}) // replaces the drifted value
+	cache.Delete(2)              // did not drift
+	if n := cache.SizeMismatches(); n != 1 {
+		t.Errorf("cache.SizeMismatches() = %v, expected 1", n)
+	}
+	if len(logged) != 1 || logged[0].fields["recorded"] != int64(1) || logged[0].fields["reported"] != int64(5) {
+		t.Errorf("logged %v, expected one size_mismatch from 1 to 5", logged)
+	}
+
+	// values stored before the check was enabled are not checked
+	cache.SetCheckSizes(false)
+	unchecked := &CacheValue{1}
+	cache.Set(3, unchecked)
+	cache.SetCheckSizes(true)
+	unchecked.size = 2
+	cache.Delete(3)
+	if n := cache.SizeMismatches(); n != 1 {
+		t.Errorf("cache.SizeMismatches() = %v, expected 1", n)
+	}
+}
+
+func TestKeyUint64ResetPerKeyHits(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	for k := key.KeyUint64(1); k <= 3; k++ {
+		cache.Set(k, &CacheValue{1})
+		for i := key.KeyUint64(0); i < k; i++ {
+			cache.Get(k)
+		}
+	}
+	if hits := cache.table[3].Value.(*keyuint64Entry).hits; hits != 3 {
+		t.Fatalf("k3 hits = %v, expected 3", hits)
+	}
+	keys := cache.Keys()
+
+	cache.ResetPerKeyHits()
+	for k := key.KeyUint64(1); k <= 3; k++ {
+		if hits := cache.table[k].Value.(*keyuint64Entry).hits; hits != 0 {
+			t.Errorf("k%v hits = %v after ResetPerKeyHits, expected 0", k, hits)
+		}
+	}
+	if after := cache.Keys(); len(after) != len(keys) || after[0] != keys[0] || after[2] != keys[2] {
+		t.Errorf("cache.Keys() = %v after ResetPerKeyHits, expected %v", after, keys)
+	}
+	if s := cache.StatsStruct(); s.Hits != 6 {
+		t.Errorf("cache.StatsStruct().Hits = %v, expected the cache counter untouched", s.Hits)
+	}
+}
+
+func TestKeyUint64Drain(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	cache.Set(1, &CacheValue{1})
+	cache.Set(2, &CacheValue{1})
+	cache.Set(3, &CacheValue{1})
+	cache.Get(1)
+	// lru: [k1, k3, k2]
+
+	var drained []key.KeyUint64
+	cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+		if why != PURGE_REASON_CLEAR_ALL {
+			t.Errorf("purge reason for %v = %v, expected PURGE_REASON_CLEAR_ALL", k, why)
+		}
+		drained = append(drained, k)
+	})
+	cache.Drain()
+	if len(drained) != 3 || drained[0] != 2 || drained[1] != 3 || drained[2] != 1 {
+		t.Errorf("drained %v, expected [2 3 1]", drained)
+	}
+	if l, sz, _ := cache.Stats(); l != 0 || sz != 0 {
+		t.Errorf("cache.Stats() = %v, %v after Drain, expected 0, 0", l, sz)
+	}
+}
+
+func TestKeyUint64GetMultiCtxDuplicates(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	cache.Set(1, &CacheValue{1})
+	var mu sync.Mutex
+	loads := map[key.KeyUint64]int{}
+	cache.OnMiss(func(k key.KeyUint64) (Cacheable, bool) {
+		mu.Lock()
+		loads[k]++
+		mu.Unlock()
+		return &CacheValue{int(k)}, true
+	})
+
+	results := cache.GetMultiCtx(context.Background(), []key.KeyUint64{2, 1, 2, 3, 1, 2})
+	if len(loads) != 2 || loads[2] != 1 || loads[3] != 1 {
+		t.Errorf("loads = %v, expected 2 and 3 once each", loads)
+	}
+	if len(results) != 3 || results[2].(*CacheValue).size != 2 || results[3].(*CacheValue).size != 3 {
+		t.Errorf("results = %v, expected 1, 2 and 3", results)
+	}
+	if s := cache.StatsStruct(); s.Hits != 1 || s.Misses != 2 {
+		t.Errorf("cache.StatsStruct() = %+v, expected 1 hit and 2 misses", s)
+	}
+}
+
+func setFromHelperKeyUint64(cache *LRUCacheKeyUint64, k key.KeyUint64) {
+	cache.Set(k, &CacheValue{1})
+}
+
+func TestKeyUint64LastWriter(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	cache.Set(1, &CacheValue{1})
+	if name, ok := cache.LastWriter(1); ok {
+		t.Errorf("cache.LastWriter(1) = %v before SetRecordWriters, expected nothing", name)
+	}
+
+	cache.SetRecordWriters(true)
+	setFromHelperKeyUint64(cache, 2)
+	if name, ok := cache.LastWriter(2); !ok || !strings.HasSuffix(name, ".setFromHelperKeyUint64") {
+		t.Errorf("cache.LastWriter(2) = %v, %v, expected setFromHelperKeyUint64", name, ok)
+	}
+	cache.SetIfAbsent(3, &CacheValue{1})
+	if name, ok := cache.LastWriter(3); !ok || !strings.HasSuffix(name, ".TestKeyUint64LastWriter") {
+		t.Errorf("cache.LastWriter(3) = %v, %v, expected TestKeyUint64LastWriter", name, ok)
+	}
+	if _, ok := cache.LastWriter(4); ok {
+		t.Error("cache.LastWriter(4) found a writer for a missing key")
+	}
+}
+
+func TestKeyUint64GetWithMeta(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	value := &CacheValue{1}
+	cache.Set(1, value)
+	cache.Get(1)
+	cache.Get(1)
+	if v, hits, ok := cache.GetWithMeta(1); !ok || v != value || hits != 3 {
+		t.Errorf("cache.GetWithMeta(1) = %v, %v, %v, expected %v, 3, true", v, hits, ok, value)
+	}
+	// an update keeps the count
+	cache.Set(1, &CacheValue{2})
+	if _, hits, _ := cache.GetWithMeta(1); hits != 4 {
+		t.Errorf("hits after update = %v, expected 4", hits)
+	}
+
+	if _, hits, ok := cache.GetWithMeta(2); ok || hits != 0 {
+		t.Errorf("cache.GetWithMeta(2) = %v, %v, expected a miss", hits, ok)
+	}
+	cache.OnMiss(func(k key.KeyUint64) (Cacheable, bool) {
+		return &CacheValue{1}, true
+	})
+	if _, hits, ok := cache.GetWithMeta(2); !ok || hits != 0 {
+		t.Errorf("cache.GetWithMeta(2) = %v, %v, expected a load with 0 hits", hits, ok)
+	}
+}
+
+func TestKeyUint64SetCapacityGradualSet(t *testing.T) {
+	cache := NewLRUCacheKeyUint64MaxItems(10)
+	for i := 0; i < 10; i++ {
+		cache.Set(key.KeyUint64(i), &CacheValue{1})
+	}
+	var reasons []PurgeReason
+	cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+		reasons = append(reasons, why)
+	})
+
+	cache.SetCapacityGradual(5, 2)
+	cache.Set(10, &CacheValue{1})
+	cache.Set(11, &CacheValue{1})
+	if len(reasons) != 6 {
+		t.Fatalf("%v entries evicted, expected 6", len(reasons))
+	}
+	for i, why := range reasons {
+		if why != PURGE_REASON_CAPACITY_SHRINK {
+			t.Errorf("eviction %v purged with %v, expected PURGE_REASON_CAPACITY_SHRINK", i, why)
+		}
+	}
+}
+
+func TestKeyUint64SetCapacityGradual(t *testing.T) {
+	cache := NewLRUCacheKeyUint64MaxItems(100)
+	for i := 0; i < 100; i++ {
+		cache.Set(key.KeyUint64(i), &CacheValue{1})
+	}
+	evicted := 0
+	cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+		if why != PURGE_REASON_CAPACITY_SHRINK {
+			t.Errorf("evicted %v with %v, expected PURGE_REASON_CAPACITY_SHRINK", k, why)
+		}
+		evicted++
+	})
+
+	cache.SetCapacityGradual(10, 5)
+	if c := cache.Capacity(); c != 10 {
+		t.Errorf("cache.Capacity() = %v, expected 10", c)
+	}
+	ops := 1
+	for cache.Length() > 10 {
+		if evicted > 5 {
+			t.Fatalf("operation %v evicted %v entries, expected at most 5", ops, evicted)
+		}
+		evicted = 0
+		cache.Get(99)
+		ops++
+	}
+	if ops != 18 {
+		t.Errorf("shrinking took %v operations, expected 18", ops)
+	}
+	if _, ok := cache.Get(99); !ok {
+		t.Error("the most recently used entry was evicted")
+	}
+
+	// done shrinking: later operations evict as usual
+	cache.OnEvict(nil)
+	for i := 100; i < 120; i++ {
+		cache.Set(key.KeyUint64(i), &CacheValue{1})
+	}
+	if l := cache.Length(); l != 10 {
+		t.Errorf("cache.Length() = %v, expected 10", l)
+	}
+}
+
+func TestKeyUint64RecentKeys(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	for i := 1; i <= 5; i++ {
+		cache.Set(key.KeyUint64(i), &CacheValue{1})
+	}
+	cache.Get(2)
+	// lru: [k2, k5, k4, k3, k1]
+
+	if keys := cache.RecentKeys(3); len(keys) != 3 || keys[0] != 2 || keys[1] != 5 || keys[2] != 4 {
+		t.Errorf("cache.RecentKeys(3) = %v, expected [2 5 4]", keys)
+	}
+	if keys := cache.RecentKeys(10); len(keys) != 5 {
+		t.Errorf("cache.RecentKeys(10) = %v, expected all 5 keys", keys)
+	}
+	if keys := cache.RecentKeys(0); keys == nil || len(keys) != 0 {
+		t.Errorf("cache.RecentKeys(0) = %#v, expected an empty slice", keys)
+	}
+}
+
+func TestKeyUint64Config(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	if c := cache.Config(); c != (CacheConfig{Capacity: 100, ShardCount: 1, MinEntrySize: defaultMinEntrySize}) {
+		t.Errorf("cache.Config() = %+v, expected the defaults", c)
+	}
+
+	cache = NewLRUCacheKeyUint64MaxItems(10)
+	cache.SetMinEntrySize(2)
+	cache.SetMinResidency(time.Second)
+	cache.SetPromoteAfterAccesses(3)
+	cache.EnableNegativeCache(time.Minute)
+	cache.SetCheckSizes(true)
+	cache.PauseEviction()
+	expected := CacheConfig{
+		Capacity:             10,
+		ShardCount:           1,
+		CapacityMode:         CapacityByCount,
+		MinEntrySize:         2,
+		MinResidency:         time.Second,
+		PromoteAfterAccesses: 3,
+		NegativeTTL:          time.Minute,
+		CheckSizes:           true,
+		EvictionPaused:       true,
+	}
+	if c := cache.Config(); c != expected {
+		t.Errorf("cache.Config() = %+v, expected %+v", c, expected)
+	}
+}
+
+func TestKeyUint64ColdKeys(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	for i := 1; i <= 5; i++ {
+		cache.Set(key.KeyUint64(i), &CacheValue{1})
+	}
+	cache.Get(1)
+	// lru: [k1, k5, k4, k3, k2]
+
+	if keys := cache.ColdKeys(3); len(keys) != 3 || keys[0] != 2 || keys[1] != 3 || keys[2] != 4 {
+		t.Errorf("cache.ColdKeys(3) = %v, expected [2 3 4]", keys)
+	}
+	if keys := cache.ColdKeys(10); len(keys) != 5 || keys[4] != 1 {
+		t.Errorf("cache.ColdKeys(10) = %v, expected all 5 keys ending with 1", keys)
+	}
+	if keys := cache.ColdKeys(-1); keys == nil || len(keys) != 0 {
+		t.Errorf("cache.ColdKeys(-1) = %#v, expected an empty slice", keys)
+	}
+}
+
+func TestKeyUint64GetMultiOrLoad(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	cache.Set(1, &CacheValue{1})
+	calls := 0
+	var asked []key.KeyUint64
+	loader := func(missing []key.KeyUint64) map[key.KeyUint64]Cacheable {
+		calls++
+		asked = missing
+		return map[key.KeyUint64]Cacheable{2: &CacheValue{2}, 3: &CacheValue{3}, 9: &CacheValue{9}}
+	}
+
+	results := cache.GetMultiOrLoad([]key.KeyUint64{1, 2, 3, 4, 2}, loader)
+	if calls != 1 {
+		t.Fatalf("loader called %v times, expected 1", calls)
+	}
+	if len(asked) != 3 || asked[0] != 2 || asked[1] != 3 || asked[2] != 4 {
+		t.Errorf("loader called with %v, expected [2 3 4]", asked)
+	}
+	if len(results) != 3 || results[1] == nil || results[2] == nil || results[3] == nil {
+		t.Errorf("results = %v, expected keys 1, 2 and 3", results)
+	}
+	if _, ok := cache.Peek(2); !ok {
+		t.Error("loaded value for 2 was not stored")
+	}
+	if cache.Contains(9) {
+		t.Error("value for 9, which was not asked for, was stored")
+	}
+
+	cache.GetMultiOrLoad([]key.KeyUint64{1, 2, 3}, loader)
+	if calls != 1 {
+		t.Errorf("loader called %v times when every key hits, expected 1", calls)
+	}
+}
+
+func TestKeyUint64GetMultiOrLoadNil(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	cache.EnableNegativeCache(time.Hour)
+	results := cache.GetMultiOrLoad([]key.KeyUint64{1, 2}, func(missing []key.KeyUint64) map[key.KeyUint64]Cacheable {
+		return map[key.KeyUint64]Cacheable{1: nil, 2: &CacheValue{1}}
+	})
+	if _, ok := results[1]; ok || len(results) != 1 {
+		t.Errorf("results = %v, expected only key 2", results)
+	}
+	if cache.Contains(1) {
+		t.Error("nil value for 1 was stored")
+	}
+	cache.OnMiss(func(k key.KeyUint64) (Cacheable, bool) {
+		t.Errorf("onMiss(%v) called for a remembered miss", k)
+		return nil, false
+	})
+	cache.Get(1)
+}
+
+func TestKeyUint64ItemsOldestFirst(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	for i := 1; i <= 3; i++ {
+		cache.Set(key.KeyUint64(i), &CacheValue{i})
+	}
+	cache.Get(1)
+	// lru: [k1, k3, k2]
+
+	items := cache.ItemsOldestFirst()
+	if len(items) != 3 || items[0].Key != 2 || items[1].Key != 3 || items[2].Key != 1 {
+		t.Fatalf("cache.ItemsOldestFirst() = %v, expected keys [2 3 1]", items)
+	}
+	if v := items[2].Value.(*CacheValue); v.size != 1 {
+		t.Errorf("items[2].Value = %v, expected the value of k1", v)
+	}
+}
+
+func TestKeyUint64RangeSnapshot(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(100)
+	for i := 1; i <= 3; i++ {
+		cache.Set(key.KeyUint64(i), &CacheValue{1})
+	}
+	var visited []key.KeyUint64
+	cache.RangeSnapshot(func(k key.KeyUint64, v Cacheable) {
+		visited = append(visited, k)
+		// would deadlock under ForEach
+		cache.Delete(k)
+		cache.Set(k+10, &CacheValue{1})
+	})
+	if len(visited) != 3 || visited[0] != 3 || visited[1] != 2 || visited[2] != 1 {
+		t.Errorf("RangeSnapshot visited %v, expected [3 2 1]", visited)
+	}
+	if keys := cache.Keys(); len(keys) != 3 || keys[0] != 11 {
+		t.Errorf("cache.Keys() = %v, expected [11 12 13]", keys)
+	}
+}
+
+func TestKeyUint64EntryReuse(t *testing.T) {
+	cache := NewLRUCacheKeyUint64MaxItems(1)
+	cache.SetRecordWriters(true)
+	for i := 0; i < 100; i++ {
+		k := key.KeyUint64(i)
+		if i%2 == 0 {
+			cache.Set(k, &CacheValue{1})
+		} else {
+			cache.SetIfAbsent(k, &CacheValue{1})
+		}
+		if _, hits, _ := cache.GetWithMeta(k); hits != 1 {
+			t.Fatalf("hits of new entry %v = %v, expected 1", k, hits)
+		}
+		cache.Get(k)
+	}
+	if err := cache.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKeyUint64WithHint(t *testing.T) {
+	cache := NewLRUCacheKeyUint64WithHint(3, 100)
+	for i := 0; i < 5; i++ {
+		cache.Set(key.KeyUint64(i), &CacheValue{1})
+	}
+	if l, sz, c := cache.Stats(); l != 3 || sz != 3 || c != 3 {
+		t.Errorf("cache.Stats() = %v, %v, %v, expected 3, 3, 3", l, sz, c)
+	}
+	cache.Clear()
+	cache.Set(1, &CacheValue{1})
+	if _, ok := cache.Get(1); !ok {
+		t.Error("cache.Get(1) missed after Clear")
+	}
+}
+
+func TestKeyUint64ZeroCapacity(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(10)
+	cache.Set(1, &CacheValue{1})
+	cache.SetCapacity(0)
+	var reasons []PurgeReason
+	cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+		reasons = append(reasons, why)
+	})
+	cache.Set(2, &CacheValue{0})
+	cache.Set(3, &CacheValue{1})
+	if l := cache.Length(); l != 0 {
+		t.Errorf("cache.Length() = %v, expected 0", l)
+	}
+	if len(reasons) != 2 || reasons[0] != PURGE_REASON_CACHEFULL || reasons[1] != PURGE_REASON_CACHEFULL {
+		t.Errorf("OnEvict reasons = %v, expected 2 PURGE_REASON_CACHEFULL", reasons)
+	}
+	if _, ok := cache.Get(2); ok {
+		t.Error("cache.Get(2) hit on a disabled cache")
+	}
+	if err := cache.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKeyUint64OversizeValue(t *testing.T) {
+	cache := NewLRUCacheKeyUint64(10)
+	cache.Set(1, &CacheValue{4})
+	var evicted []key.KeyUint64
+	cache.OnEvict(func(k key.KeyUint64, v Cacheable, why PurgeReason) {
+		if why != PURGE_REASON_CACHEFULL {
+			t.Errorf("OnEvict(%v) with %v, expected PURGE_REASON_CACHEFULL", k, why)
+		}
+		evicted = append(evicted, k)
+	})
+	cache.Set(2, &CacheValue{11})
+	if len(evicted) != 1 || evicted[0] != 2 {
+		t.Errorf("evicted %v, expected only the oversize value", evicted)
+	}
+	if l, sz := cache.Length(), cache.Size(); l != 1 || sz != 4 {
+		t.Errorf("cache.Length(), cache.Size() = %v, %v, expected 1, 4", l, sz)
+	}
+}
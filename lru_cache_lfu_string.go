@@ -0,0 +1,302 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cache implements a LRU cache.
+//
+// LFUCacheString evicts the least frequently used element instead of the
+// least recently used one. Elements are grouped in buckets by access count;
+// the buckets are kept in a list ordered by increasing count, and each bucket
+// holds its elements most recently used first, so that ties between equally
+// used elements are broken by recency. Every operation is O(1).
+package lru
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// LFUCacheString is a LFU cache. If the cache reaches the capacity, the
+// least frequently used item is deleted from the cache; among items used
+// equally often, the least recently used one goes first. Note the capacity is
+// not the number of items, but the total sum of the Size() of each item.
+type LFUCacheString struct {
+	mu sync.Mutex
+
+	// buckets of *lfuStringBucket ordered by increasing freq, and table of
+	// *lfuStringEntry
+	buckets *list.List
+	table   map[string]*lfuStringEntry
+
+	// Our current size. Obviously a gross simplification and
+	// low-grade approximation.
+	size int64
+
+	// How much we are limiting the cache to.
+	capacity int64
+	onMiss   OnMissHandlerString
+}
+
+type lfuStringBucket struct {
+	freq    int64
+	entries *list.List // of *lfuStringEntry, most recently used first
+}
+
+type lfuStringEntry struct {
+	key    string
+	value  Cacheable
+	size   int64
+	bucket *list.Element // in LFUCacheString.buckets
+	elem   *list.Element // in bucket.entries
+}
+
+// NewLFUCacheString creates a new empty cache with the given capacity.
+func NewLFUCacheString(capacity int64) *LFUCacheString {
+	return &LFUCacheString{
+		buckets:  list.New(),
+		table:    make(map[string]*lfuStringEntry),
+		capacity: capacity,
+	}
+}
+
+// Get returns a value from the cache, and increments its use count.
+func (lru *LFUCacheString) Get(k string) (v Cacheable, ok bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	entry := lru.table[k]
+	if entry == nil {
+		if lru.onMiss == nil {
+			return nil, false
+		}
+		v, ok = lru.onMiss(k)
+		if v == nil {
+			// a nil value is reported as a miss rather than cached
+			ok = false
+		}
+		if ok {
+			lru.set(k, v)
+		}
+		return
+	}
+	lru.touch(entry)
+	return entry.value, true
+}
+
+// Set sets a value in the cache.
+func (lru *LFUCacheString) Set(k string, value Cacheable) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.set(k, value)
+}
+func (lru *LFUCacheString) set(k string, value Cacheable) {
+	if entry := lru.table[k]; entry != nil {
+		lru.updateInplace(entry, value)
+	} else {
+		lru.addNew(k, value)
+	}
+}
+
+// SetIfAbsent will set the value in the cache if not present. If the
+// value exists in the cache, we don't set it.
+func (lru *LFUCacheString) SetIfAbsent(k string, value Cacheable) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	if entry := lru.table[k]; entry != nil {
+		lru.touch(entry)
+	} else {
+		lru.addNew(k, value)
+	}
+}
+
+// Delete removes an lfuStringEntry from the cache, and returns if the lfuStringEntry existed.
+func (lru *LFUCacheString) Delete(k string) bool {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	entry := lru.table[k]
+	if entry == nil {
+		return false
+	}
+
+	lru.remove(entry)
+	safeOnPurge(entry.value, PURGE_REASON_DELETE)
+	return true
+}
+
+// Clear will clear the entire cache.
+func (lru *LFUCacheString) Clear() {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	for _, entry := range lru.table {
+		safeOnPurge(entry.value, PURGE_REASON_CLEAR_ALL)
+	}
+
+	lru.buckets.Init()
+	lru.table = make(map[string]*lfuStringEntry)
+	lru.size = 0
+}
+
+// SetCapacity will set the capacity of the cache. If the capacity is
+// smaller, and the current cache size exceed that capacity, the cache
+// will be shrank, purging the evicted elements with
+// PURGE_REASON_CAPACITY_SHRINK.
+func (lru *LFUCacheString) SetCapacity(capacity int64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.capacity = capacity
+	lru.checkCapacity(PURGE_REASON_CAPACITY_SHRINK)
+}
+func (lru *LFUCacheString) OnMiss(onMiss OnMissHandlerString) {
+	lru.onMiss = onMiss
+}
+
+// Stats
+func (lru *LFUCacheString) Stats() (length, size, capacity int64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return int64(len(lru.table)), lru.size, lru.capacity
+}
+
+// StatsJSON returns stats as a JSON object in a string.
+func (lru *LFUCacheString) StatsJSON() string {
+	if lru == nil {
+		return "{}"
+	}
+	l, s, c := lru.Stats()
+	return fmt.Sprintf("{\"Length\": %v, \"Size\": %v, \"Capacity\": %v }", l, s, c)
+}
+
+// Length returns how many elements are in the cache
+func (lru *LFUCacheString) Length() int64 {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return int64(len(lru.table))
+}
+
+// Size returns the sum of the objects' Size() method.
+func (lru *LFUCacheString) Size() int64 {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return lru.size
+}
+
+// Capacity returns the cache maximum capacity.
+func (lru *LFUCacheString) Capacity() int64 {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return lru.capacity
+}
+
+// Keys returns all the ks for the cache, ordered from most frequently
+// used to least frequently used.
+func (lru *LFUCacheString) Keys() []string {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	ks := make([]string, 0, len(lru.table))
+	lru.walk(func(entry *lfuStringEntry) {
+		ks = append(ks, entry.key)
+	})
+	return ks
+}
+
+// Items returns all the values for the cache, ordered from most frequently
+// used to least frequently used.
+func (lru *LFUCacheString) Items() []StringItem {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	items := make([]StringItem, 0, len(lru.table))
+	lru.walk(func(entry *lfuStringEntry) {
+		items = append(items, StringItem{Key: entry.key, Value: entry.value})
+	})
+	return items
+}
+
+func (lru *LFUCacheString) Values() []Cacheable {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	values := make([]Cacheable, 0, len(lru.table))
+	lru.walk(func(entry *lfuStringEntry) {
+		values = append(values, entry.value)
+	})
+	return values
+}
+
+// walk visits the entries in eviction order, reversed.
+func (lru *LFUCacheString) walk(fn func(entry *lfuStringEntry)) {
+	for b := lru.buckets.Back(); b != nil; b = b.Prev() {
+		for e := b.Value.(*lfuStringBucket).entries.Front(); e != nil; e = e.Next() {
+			fn(e.Value.(*lfuStringEntry))
+		}
+	}
+}
+
+func (lru *LFUCacheString) updateInplace(entry *lfuStringEntry, value Cacheable) {
+	valueSize := getSize(value)
+	sizeDiff := valueSize - entry.size
+	safeOnPurge(entry.value, PURGE_REASON_UPDATE)
+	entry.value = value
+	entry.size = valueSize
+	lru.size += sizeDiff
+	lru.touch(entry)
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+// touch moves entry to the front of the bucket for the next use count.
+func (lru *LFUCacheString) touch(entry *lfuStringEntry) {
+	cur := entry.bucket
+	curBucket := cur.Value.(*lfuStringBucket)
+	next := cur.Next()
+	if next == nil || next.Value.(*lfuStringBucket).freq != curBucket.freq+1 {
+		next = lru.buckets.InsertAfter(&lfuStringBucket{freq: curBucket.freq + 1, entries: list.New()}, cur)
+	}
+	curBucket.entries.Remove(entry.elem)
+	if curBucket.entries.Len() == 0 {
+		lru.buckets.Remove(cur)
+	}
+	entry.bucket = next
+	entry.elem = next.Value.(*lfuStringBucket).entries.PushFront(entry)
+}
+
+func (lru *LFUCacheString) addNew(k string, value Cacheable) {
+	size := getSize(value)
+	if lru.capacity <= 0 || size > lru.capacity {
+		// it would only be evicted right away, along with everything else
+		safeOnPurge(value, PURGE_REASON_CACHEFULL)
+		return
+	}
+	first := lru.buckets.Front()
+	if first == nil || first.Value.(*lfuStringBucket).freq != 1 {
+		first = lru.buckets.PushFront(&lfuStringBucket{freq: 1, entries: list.New()})
+	}
+	newEntry := &lfuStringEntry{key: k, value: value, size: size, bucket: first}
+	newEntry.elem = first.Value.(*lfuStringBucket).entries.PushFront(newEntry)
+	lru.table[k] = newEntry
+	lru.size += newEntry.size
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+func (lru *LFUCacheString) remove(entry *lfuStringEntry) {
+	bucket := entry.bucket.Value.(*lfuStringBucket)
+	bucket.entries.Remove(entry.elem)
+	if bucket.entries.Len() == 0 {
+		lru.buckets.Remove(entry.bucket)
+	}
+	delete(lru.table, entry.key)
+	lru.size -= entry.size
+}
+
+func (lru *LFUCacheString) checkCapacity(why PurgeReason) {
+	for lru.size > lru.capacity && lru.buckets.Len() > 0 {
+		delValue := lru.buckets.Front().Value.(*lfuStringBucket).entries.Back().Value.(*lfuStringEntry)
+		lru.remove(delValue)
+		safeOnPurge(delValue.value, why)
+	}
+}
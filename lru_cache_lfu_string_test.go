@@ -0,0 +1,209 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lru
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func TestLFUInitialState(t *testing.T) {
+	cache := NewLFUCacheString(5)
+	l, sz, c := cache.Stats()
+	if l != 0 {
+		t.Errorf("length = %v, want 0", l)
+	}
+	if sz != 0 {
+		t.Errorf("size = %v, want 0", sz)
+	}
+	if c != 5 {
+		t.Errorf("capacity = %v, want 5", c)
+	}
+}
+
+func TestLFUSetInsertsValue(t *testing.T) {
+	cache := NewLFUCacheString(100)
+	data := &CacheValue{0}
+	k := "k"
+	cache.Set(k, data)
+
+	v, ok := cache.Get(k)
+	if !ok || v.(*CacheValue) != data {
+		t.Errorf("Cache has incorrect value: %v != %v", data, v)
+	}
+
+	keys := cache.Keys()
+	if len(keys) != 1 || keys[0] != k {
+		t.Errorf("Cache.Keys() returned incorrect items: %v", k)
+	}
+	items := cache.Items()
+	if len(items) != 1 || items[0].Key != k {
+		t.Errorf("Cache.Values() returned incorrect items: %v", items)
+	}
+	values := cache.Values()
+	if len(values) != 1 {
+		t.Errorf("Cache.Values() returned incorrect values: %v", values)
+	}
+}
+
+func TestLFUSetIfAbsent(t *testing.T) {
+	cache := NewLFUCacheString(100)
+	data := &CacheValue{0}
+	k := "k"
+	cache.SetIfAbsent(k, data)
+	cache.SetIfAbsent(k, &CacheValue{1})
+
+	v, ok := cache.Get(k)
+	if !ok || v.(*CacheValue) != data {
+		t.Errorf("Cache has incorrect value: %v != %v", data, v)
+	}
+}
+
+func TestLFUSetWithOldKeyUpdatesSize(t *testing.T) {
+	cache := NewLFUCacheString(100)
+	k := "k"
+	cache.Set(k, &CacheValue{0})
+	someValue := &CacheValue{20}
+	cache.Set(k, someValue)
+
+	v, ok := cache.Get(k)
+	if !ok || v.(*CacheValue) != someValue {
+		t.Errorf("Cache has incorrect value: %v != %v", someValue, v)
+	}
+	if _, sz, _ := cache.Stats(); sz != 20 {
+		t.Errorf("cache.Size() = %v, expected 20", sz)
+	}
+}
+
+func TestLFUDelete(t *testing.T) {
+	cache := NewLFUCacheString(100)
+	value := &PurgeCacheValue{}
+	k := "k"
+
+	if cache.Delete(k) {
+		t.Error("Item unexpectedly already in cache.")
+	}
+	cache.Set(k, value)
+	purgeReasonFlag4Test = PURGE_REASON_CACHEFULL // init
+	if !cache.Delete(k) {
+		t.Error("Expected item to be in cache.")
+	}
+	if purgeReasonFlag4Test != PURGE_REASON_DELETE {
+		t.Errorf("after cache.Delete ,purgeReason should be %d ,but get %d", PURGE_REASON_DELETE, purgeReasonFlag4Test)
+	}
+	if _, sz, _ := cache.Stats(); sz != 0 {
+		t.Errorf("cache.Size() = %v, expected 0", sz)
+	}
+	if _, ok := cache.Get(k); ok {
+		t.Error("Cache returned a value after deletion.")
+	}
+}
+
+func TestLFUClear(t *testing.T) {
+	cache := NewLFUCacheString(100)
+	purgeReasonFlag4Test = PURGE_REASON_DELETE // init
+	cache.Set("k", &PurgeCacheValue{})
+	cache.Clear()
+
+	if l, sz, _ := cache.Stats(); l != 0 || sz != 0 {
+		t.Errorf("cache length, size = %v, %v, expected 0 after Clear()", l, sz)
+	}
+	if purgeReasonFlag4Test != PURGE_REASON_CLEAR_ALL {
+		t.Errorf("after cache.Clear ,purgeReason should be %d ,but get %d", PURGE_REASON_CLEAR_ALL, purgeReasonFlag4Test)
+	}
+}
+
+func TestLFUCapacityIsObeyed(t *testing.T) {
+	size := int64(3)
+	cache := NewLFUCacheString(100)
+	cache.SetCapacity(size)
+	value := &CacheValue{1}
+
+	cache.Set("k1", value)
+	cache.Set("k2", value)
+	cache.Set("k3", value)
+	cache.Set("k4", value)
+	if _, sz, _ := cache.Stats(); sz != size {
+		t.Errorf("post-evict cache.Size() = %v, expected %v", sz, size)
+	}
+
+	data := cache.StatsJSON()
+	m := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		t.Errorf("cache.StatsJSON() returned bad json data: %v %v", data, err)
+	}
+	if m["Size"].(float64) != float64(size) {
+		t.Errorf("cache.StatsJSON() returned bad size: %v", m)
+	}
+}
+
+func TestLFUIsEvicted(t *testing.T) {
+	cache := NewLFUCacheString(3)
+	cache.Set("k1", &CacheValue{1})
+	cache.Set("k2", &CacheValue{1})
+	cache.Set("k3", &CacheValue{1})
+
+	cache.Get("k1")
+	cache.Get("k1")
+	cache.Get("k3")
+	// uses: k1=3, k3=2, k2=1
+
+	cache.Set("k0", &CacheValue{1})
+	if _, ok := cache.Get("k2"); ok {
+		t.Error("Least frequently used element was not evicted.")
+	}
+	if keys := cache.Keys(); len(keys) != 3 || keys[0] != "k1" || keys[1] != "k3" {
+		t.Errorf("cache.Keys() = %v, expected most frequently used first", keys)
+	}
+}
+
+func TestLFUTiesBrokenByRecency(t *testing.T) {
+	cache := NewLFUCacheString(2)
+	cache.Set("k1", &CacheValue{1})
+	cache.Set("k2", &CacheValue{1})
+	cache.Get("k2")
+	cache.Get("k1")
+	// both used twice, k2 is the least recently used
+
+	cache.SetCapacity(1)
+	if _, ok := cache.Get("k1"); !ok {
+		t.Error("Most recently used of equally used elements was evicted.")
+	}
+	if _, ok := cache.Get("k2"); ok {
+		t.Error("Least recently used of equally used elements was not evicted.")
+	}
+}
+
+func TestLFUHotKeySurvivesFlood(t *testing.T) {
+	cache := NewLFUCacheString(10)
+	cache.Set("hot", &CacheValue{1})
+	for i := 0; i < 5; i++ {
+		cache.Get("hot")
+	}
+	for i := 0; i < 1000; i++ {
+		cache.Set(strconv.Itoa(i), &CacheValue{1})
+	}
+	if _, ok := cache.Get("hot"); !ok {
+		t.Error("hot key was evicted by a flood of one-hit keys")
+	}
+	if l := cache.Length(); l != 10 {
+		t.Errorf("cache.Length() = %v, expected 10", l)
+	}
+}
+
+func TestLFUOnMiss(t *testing.T) {
+	cache := NewLFUCacheString(1)
+	cache.OnMiss(func(k string) (Cacheable, bool) {
+		return 1, true
+	})
+	v, ok := cache.Get("k1")
+	if !ok || v != 1 {
+		t.Errorf("lru.onMiss is errror")
+	}
+	if l := cache.Length(); l != 1 {
+		t.Errorf("cache.Length() = %v, expected 1", l)
+	}
+}
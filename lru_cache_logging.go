@@ -0,0 +1,52 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lru
+
+// LoggingCache wraps a Cache, logging each Get, Set, SetIfAbsent and Delete
+// before returning. The logger has the signature of
+// LRUCacheKeyUint64.SetLogger and is called with the events:
+//
+//	"get"    fields "key", "hit"
+//	"set"    fields "key", "ifAbsent"
+//	"delete" fields "key", "found"
+//
+// Unlike with SetLogger, logger is called after the wrapped cache returns,
+// so it may call back into the cache. Every other method is passed through
+// unlogged.
+type LoggingCache[K any] struct {
+	Cache[K]
+	logger func(event string, fields map[string]interface{})
+}
+
+// NewLoggingCache returns c wrapped to log its operations to logger.
+func NewLoggingCache[K any](c Cache[K], logger func(event string, fields map[string]interface{})) *LoggingCache[K] {
+	return &LoggingCache[K]{Cache: c, logger: logger}
+}
+
+// Get is c.Get, logged.
+func (c *LoggingCache[K]) Get(k K) (v Cacheable, ok bool) {
+	v, ok = c.Cache.Get(k)
+	c.logger("get", map[string]interface{}{"key": k, "hit": ok})
+	return
+}
+
+// Set is c.Set, logged.
+func (c *LoggingCache[K]) Set(k K, value Cacheable) {
+	c.Cache.Set(k, value)
+	c.logger("set", map[string]interface{}{"key": k, "ifAbsent": false})
+}
+
+// SetIfAbsent is c.SetIfAbsent, logged.
+func (c *LoggingCache[K]) SetIfAbsent(k K, value Cacheable) {
+	c.Cache.SetIfAbsent(k, value)
+	c.logger("set", map[string]interface{}{"key": k, "ifAbsent": true})
+}
+
+// Delete is c.Delete, logged.
+func (c *LoggingCache[K]) Delete(k K) bool {
+	found := c.Cache.Delete(k)
+	c.logger("delete", map[string]interface{}{"key": k, "found": found})
+	return found
+}
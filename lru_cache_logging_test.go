@@ -0,0 +1,43 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lru
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLoggingCache(t *testing.T) {
+	var logged []string
+	var cache Cache[string] = NewLoggingCache[string](NewLRUCacheString(100), func(event string, fields map[string]interface{}) {
+		logged = append(logged, fmt.Sprintf("%s %v", event, fields))
+	})
+	cache.Set("a", &CacheValue{1})
+	cache.SetIfAbsent("a", &CacheValue{1})
+	cache.Get("a")
+	cache.Get("b")
+	cache.Delete("a")
+	cache.Delete("a")
+
+	expected := []string{
+		"set map[ifAbsent:false key:a]",
+		"set map[ifAbsent:true key:a]",
+		"get map[hit:true key:a]",
+		"get map[hit:false key:b]",
+		"delete map[found:true key:a]",
+		"delete map[found:false key:a]",
+	}
+	if len(logged) != len(expected) {
+		t.Fatalf("logged %q, expected %q", logged, expected)
+	}
+	for i := range expected {
+		if logged[i] != expected[i] {
+			t.Errorf("logged[%v] = %q, expected %q", i, logged[i], expected[i])
+		}
+	}
+	if l := cache.Length(); l != 0 {
+		t.Errorf("cache.Length() = %v, expected 0", l)
+	}
+}
@@ -15,6 +15,8 @@ import (
 	"container/list"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // StringItem is what is stored in the cache
@@ -28,7 +30,8 @@ type OnMissHandlerString func(k string) (Cacheable, bool)
 // LRUCacheString is a typical LRU cache implementation.  If the cache
 // reaches the capacity, the least recently used item is deleted from
 // the cache. Note the capacity is not the number of items, but the
-// total sum of the Size() of each item.
+// total sum of the Size() of each item, unless the cache was created with
+// CapacityByCount.
 type LRUCacheString struct {
 	mu sync.Mutex
 
@@ -41,43 +44,130 @@ type LRUCacheString struct {
 	size int64
 
 	// How much we are limiting the cache to.
-	capacity int64
-	onMiss   OnMissHandlerString
+	capacity     int64
+	capacityMode CapacityMode
+	onMiss       OnMissHandlerString
+
+	// see SetEvictBatchLimit
+	evictBatchLimit    int
+	evictBatchOverruns int64
+
+	// see OnHighWater
+	highWater      float64
+	onHighWater    func(size, capacity int64)
+	aboveHighWater bool
+
+	// Entries younger than this are evicted last, see SetMinResidency.
+	minResidency time.Duration
+
+	// Copy of the front entry once hit twice in a row, for the fast path
+	// of Get. Cleared, before any OnPurge, whenever the front entry changes.
+	hot atomic.Pointer[stringHot]
 }
-type stringEntry struct {
+
+// stringHot is an immutable copy of the most recently used entry. Get can
+// return it without a table lookup, as there is nothing to promote.
+type stringHot struct {
 	key   string
 	value Cacheable
-	size  int64
+}
+type stringEntry struct {
+	key      string
+	value    Cacheable
+	size     int64
+	inserted time.Time // only recorded when minResidency is set
+}
+
+// StringOptions configures a cache created with
+// NewLRUCacheStringWithOptions.
+type StringOptions struct {
+	Capacity int64
+
+	// CapacityMode tells whether Capacity bounds the sum of the Size() of
+	// the items, the default, or their number.
+	CapacityMode CapacityMode
 }
 
 // NewLRUCacheString creates a new empty cache with the given capacity.
+// A value larger than the capacity is purged with PURGE_REASON_CACHEFULL
+// instead of being stored, rather than evicting every other entry to no
+// avail, and a capacity <= 0 disables the cache.
 func NewLRUCacheString(capacity int64) *LRUCacheString {
+	return NewLRUCacheStringWithOptions(StringOptions{Capacity: capacity})
+}
+
+// NewLRUCacheStringWithOptions creates a new empty cache configured by opts.
+// With CapacityByCount, Size() is never called and every entry weighs 1,
+// including those stored with SetWithSize.
+func NewLRUCacheStringWithOptions(opts StringOptions) *LRUCacheString {
 	return &LRUCacheString{
-		list:     list.New(),
-		table:    make(map[string]*list.Element),
-		capacity: capacity,
+		list:         list.New(),
+		table:        make(map[string]*list.Element),
+		capacity:     opts.Capacity,
+		capacityMode: opts.CapacityMode,
 	}
 }
 
 // Get returns a value from the cache, and marks the stringEntry as most
-// recently used.
+// recently used. Getting the most recently used entry again, as in a loop
+// over a single hot key, skips the table lookup and the promotion.
 func (lru *LRUCacheString) Get(k string) (v Cacheable, ok bool) {
+	hot := lru.hot.Load()
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
+	if hot != nil && hot.key == k && lru.hot.Load() == hot {
+		// still the front entry, not dropped while we waited for the lock
+		return hot.value, true
+	}
+	return lru.get(k, lru.onMiss)
+}
 
+// GetOrLoad is like Get, but on a miss calls loader instead of onMiss. A
+// successful result is stored. Like onMiss, loader is called with the cache
+// locked and must not call back into it.
+func (lru *LRUCacheString) GetOrLoad(k string, loader func(string) (Cacheable, bool)) (Cacheable, bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return lru.get(k, loader)
+}
+func (lru *LRUCacheString) get(k string, onMiss OnMissHandlerString) (v Cacheable, ok bool) {
 	element := lru.table[k]
 	if element == nil {
-		if lru.onMiss == nil {
+		if onMiss == nil {
 			return nil, false
 		}
-		v, ok = lru.onMiss(k)
-		if ok { // should check v==nil ???
+		v, ok = onMiss(k)
+		if v == nil {
+			// a nil value is reported as a miss rather than cached
+			ok = false
+		}
+		if ok {
 			lru.set(k, v)
 		}
 		return
 	}
+	entry := element.Value.(*stringEntry)
+	if lru.list.Front() != element {
+		lru.moveToFront(element)
+	} else if hot := lru.hot.Load(); hot == nil || hot.key != k {
+		// hit again while in front: worth a copy for the next Gets
+		lru.hot.Store(&stringHot{key: k, value: entry.value})
+	}
+	return entry.value, true
+}
+
+// Touch marks the stringEntry as most recently used without returning its
+// value, and returns if it existed. onMiss is not consulted.
+func (lru *LRUCacheString) Touch(k string) bool {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element := lru.table[k]
+	if element == nil {
+		return false
+	}
 	lru.moveToFront(element)
-	return element.Value.(*stringEntry).value, true
+	return true
 }
 
 // Set sets a value in the cache.
@@ -87,11 +177,35 @@ func (lru *LRUCacheString) Set(k string, value Cacheable) {
 	lru.set(k, value)
 }
 func (lru *LRUCacheString) set(k string, value Cacheable) {
+	lru.setWithSize(k, value, lru.entrySize(value))
+}
+
+// SetX is like Set, but returns true if k was inserted, and false if it was
+// already cached and its value updated.
+func (lru *LRUCacheString) SetX(k string, value Cacheable) (inserted bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return lru.setWithSize(k, value, lru.entrySize(value))
+}
+
+// SetWithSize is like Set, but accounts value as size instead of asking its
+// Size(), for values that don't implement SizeAware. A later Set of the same
+// k goes back to Size(). size is ignored with CapacityByCount.
+func (lru *LRUCacheString) SetWithSize(k string, value Cacheable, size int64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.setWithSize(k, value, size)
+}
+func (lru *LRUCacheString) setWithSize(k string, value Cacheable, size int64) (inserted bool) {
+	if lru.capacityMode == CapacityByCount {
+		size = 1
+	}
 	if element := lru.table[k]; element != nil {
-		lru.updateInplace(element, value)
-	} else {
-		lru.addNew(k, value)
+		lru.updateInplace(element, value, size)
+		return false
 	}
+	lru.addNew(k, value, size)
+	return true
 }
 
 // SetIfAbsent will set the value in the cache if not present. If the
@@ -103,8 +217,22 @@ func (lru *LRUCacheString) SetIfAbsent(k string, value Cacheable) {
 	if element := lru.table[k]; element != nil {
 		lru.moveToFront(element)
 	} else {
-		lru.addNew(k, value)
+		lru.addNew(k, value, lru.entrySize(value))
+	}
+}
+
+// SetIfPresent will set the value in the cache only if k is already
+// present, and returns if it was. Unlike Set, it never admits a new k.
+func (lru *LRUCacheString) SetIfPresent(k string, value Cacheable) bool {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element := lru.table[k]
+	if element == nil {
+		return false
 	}
+	lru.updateInplace(element, value, lru.entrySize(value))
+	return true
 }
 
 // Delete removes an stringEntry from the cache, and returns if the stringEntry existed.
@@ -118,36 +246,133 @@ func (lru *LRUCacheString) Delete(k string) bool {
 	}
 
 	lru.list.Remove(element)
+	lru.dropHot()
 	delete(lru.table, k)
 	lru.size -= element.Value.(*stringEntry).size
 	safeOnPurge(element.Value.(*stringEntry).value, PURGE_REASON_DELETE)
 	return true
 }
 
+// UpdateSize re-reads the Size() of the value cached under k and adjusts the
+// cache size accordingly, for values that grew or shrank after insertion.
+// The entry keeps its position in the LRU list. The cache is shrunk if the
+// new size exceeds the capacity.
+func (lru *LRUCacheString) UpdateSize(k string) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element := lru.table[k]
+	if element == nil {
+		return
+	}
+	entry := element.Value.(*stringEntry)
+	valueSize := lru.entrySize(entry.value)
+	lru.size += valueSize - entry.size
+	entry.size = valueSize
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+// SizeOf returns the size the cache accounts for the value under k, as
+// computed when it was stored, without marking it as recently used.
+func (lru *LRUCacheString) SizeOf(k string) (int64, bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element := lru.table[k]
+	if element == nil {
+		return 0, false
+	}
+	return element.Value.(*stringEntry).size, true
+}
+
 // Clear will clear the entire cache.
 func (lru *LRUCacheString) Clear() {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
+	lru.dropHot()
 	for e := lru.list.Front(); e != nil; e = e.Next() {
 		safeOnPurge(e.Value.(*stringEntry).value, PURGE_REASON_CLEAR_ALL)
 	}
 
+	lru.clear()
+}
+
+// ClearNoPurge is a faster Clear for values that need no cleanup: OnPurge is
+// not called.
+func (lru *LRUCacheString) ClearNoPurge() {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.clear()
+}
+
+func (lru *LRUCacheString) clear() {
 	lru.list.Init()
+	lru.dropHot()
 	lru.table = make(map[string]*list.Element)
 	lru.size = 0
 }
 
 // SetCapacity will set the capacity of the cache. If the capacity is
 // smaller, and the current cache size exceed that capacity, the cache
-// will be shrank.
+// will be shrank, purging the evicted elements with
+// PURGE_REASON_CAPACITY_SHRINK.
 func (lru *LRUCacheString) SetCapacity(capacity int64) {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
 	lru.capacity = capacity
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CAPACITY_SHRINK)
+}
+
+// SetEvictBatchLimit sets how many entries a single operation is expected to
+// evict at most. Operations evicting more still evict as many entries as
+// needed, with the cache locked and calling OnPurge for each, but are counted
+// by EvictBatchOverruns so that pathological inserts can be detected. 0, the
+// default, disables the count.
+func (lru *LRUCacheString) SetEvictBatchLimit(n int) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.evictBatchLimit = n
+}
+
+// EvictBatchOverruns returns how many operations evicted more entries than
+// the limit set with SetEvictBatchLimit.
+func (lru *LRUCacheString) EvictBatchOverruns() int64 {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return lru.evictBatchOverruns
+}
+
+// OnHighWater sets cb to be called when the size goes past threshold times
+// the capacity, for example 0.9, as an early warning before entries get
+// evicted. cb is called once per crossing: it fires again only after the
+// size has gone back under the line. It is called with the cache locked and
+// must not call back into it. A nil cb removes the hook.
+func (lru *LRUCacheString) OnHighWater(threshold float64, cb func(size, capacity int64)) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.highWater = threshold
+	lru.onHighWater = cb
+	lru.aboveHighWater = false
 }
+
+// SetMinResidency makes capacity eviction skip entries inserted less than d
+// ago, evicting the least recently used entry old enough instead, so that a
+// burst of inserts does not evict entries before they are ever read. If
+// every entry is too young, the least recently used one is evicted anyway.
+// It only applies to entries stored afterwards. A zero d disables it.
+func (lru *LRUCacheString) SetMinResidency(d time.Duration) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.minResidency = d
+}
+
+// OnMiss sets the handler loading the values missing from the cache. The
+// values it finds are stored, except nil ones, which are reported as misses.
 func (lru *LRUCacheString) OnMiss(onMiss OnMissHandlerString) {
 	lru.onMiss = onMiss
 }
@@ -230,37 +455,107 @@ func (lru *LRUCacheString) Values() []Cacheable {
 	}
 	return values
 }
-func (lru *LRUCacheString) updateInplace(element *list.Element, value Cacheable) {
-	valueSize := getSize(value)
+func (lru *LRUCacheString) updateInplace(element *list.Element, value Cacheable, valueSize int64) {
+	lru.dropHot()
 	sizeDiff := valueSize - element.Value.(*stringEntry).size
 	safeOnPurge(element.Value.(*stringEntry).value, PURGE_REASON_UPDATE)
 	element.Value.(*stringEntry).value = value
 	element.Value.(*stringEntry).size = valueSize
 	lru.size += sizeDiff
 	lru.moveToFront(element)
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+// dropHot clears the copy of the front entry, see stringHot.
+func (lru *LRUCacheString) dropHot() {
+	if lru.hot.Load() != nil {
+		lru.hot.Store(nil)
+	}
 }
 
 func (lru *LRUCacheString) moveToFront(element *list.Element) {
+	if lru.list.Front() != element {
+		lru.dropHot()
+	}
 	lru.list.MoveToFront(element)
 }
 
-func (lru *LRUCacheString) addNew(k string, value Cacheable) {
-	newEntry := &stringEntry{k, value, getSize(value)}
+func (lru *LRUCacheString) addNew(k string, value Cacheable, size int64) {
+	newEntry := &stringEntry{key: k, value: value, size: size}
+	if lru.capacity <= 0 || newEntry.size > lru.capacity {
+		// it would only be evicted right away, along with everything else
+		safeOnPurge(value, PURGE_REASON_CACHEFULL)
+		return
+	}
+	if lru.minResidency > 0 {
+		newEntry.inserted = time.Now()
+	}
+	lru.dropHot()
 	element := lru.list.PushFront(newEntry)
 	lru.table[k] = element
 	lru.size += newEntry.size
-	lru.checkCapacity()
+	lru.checkCapacity(PURGE_REASON_CACHEFULL)
+}
+
+// entrySize is the weight of value toward the capacity.
+func (lru *LRUCacheString) entrySize(value Cacheable) int64 {
+	if lru.capacityMode == CapacityByCount {
+		return 1
+	}
+	return getSize(value)
 }
 
-func (lru *LRUCacheString) checkCapacity() {
+func (lru *LRUCacheString) checkCapacity(why PurgeReason) {
+	evicted := 0
+	var now time.Time
+	if lru.minResidency > 0 {
+		now = time.Now()
+	}
 	// Partially duplicated from Delete
 	for lru.size > lru.capacity {
 		delElem := lru.list.Back()
+		if lru.minResidency > 0 {
+			delElem = lru.oldestEvictable(now)
+		}
+		if delElem == nil {
+			// empty, yet over a negative capacity
+			break
+		}
 		delValue := delElem.Value.(*stringEntry)
+		if delElem == lru.list.Front() {
+			lru.dropHot()
+		}
 		lru.list.Remove(delElem)
 		delete(lru.table, delValue.key)
 		lru.size -= delValue.size
-		safeOnPurge(delValue.value, PURGE_REASON_CACHEFULL)
+		safeOnPurge(delValue.value, why)
+		evicted++
+	}
+	if lru.evictBatchLimit > 0 && evicted > lru.evictBatchLimit {
+		lru.evictBatchOverruns++
+	}
+	lru.checkHighWater()
+}
+
+// oldestEvictable returns the least recently used element that has been
+// resident for at least minResidency, or the least recently used element if
+// there is none.
+func (lru *LRUCacheString) oldestEvictable(now time.Time) *list.Element {
+	for e := lru.list.Back(); e != nil; e = e.Prev() {
+		if now.Sub(e.Value.(*stringEntry).inserted) >= lru.minResidency {
+			return e
+		}
+	}
+	return lru.list.Back()
+}
+
+func (lru *LRUCacheString) checkHighWater() {
+	if lru.onHighWater == nil {
+		return
+	}
+	above := float64(lru.size) > lru.highWater*float64(lru.capacity)
+	if above && !lru.aboveHighWater {
+		lru.onHighWater(lru.size, lru.capacity)
 	}
+	lru.aboveHighWater = above
 }
@@ -0,0 +1,32 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lru
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// expvarMu makes the check for an existing name and expvar.Publish atomic.
+var expvarMu sync.Mutex
+
+// PublishExpvar publishes the cache stats under name in expvar, so that they
+// show up live in /debug/vars as the same object StatsJSON returns. Unlike
+// expvar.Publish it does not panic when name is already taken, but returns
+// an error.
+func (lru *LRUCacheString) PublishExpvar(name string) error {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("lru: expvar %q already published", name)
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		l, s, c := lru.Stats()
+		return map[string]int64{"Length": l, "Size": s, "Capacity": c}
+	}))
+	return nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lru
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"testing"
+)
+
+// expvarRuns makes the names published by the tests unique across runs, as
+// expvar names cannot be unpublished.
+var expvarRuns int
+
+func TestPublishExpvar(t *testing.T) {
+	expvarRuns++
+	name := fmt.Sprintf("%s-%d", t.Name(), expvarRuns)
+
+	cache := NewLRUCacheString(100)
+	cache.Set("k1", &CacheValue{3})
+	if err := cache.PublishExpvar(name); err != nil {
+		t.Fatalf("cache.PublishExpvar() returned %v", err)
+	}
+	cache.Set("k2", &CacheValue{4})
+
+	var m map[string]int64
+	data := expvar.Get(name).String()
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		t.Fatalf("expvar returned bad json data: %v %v", data, err)
+	}
+	if m["Length"] != 2 || m["Size"] != 7 || m["Capacity"] != 100 {
+		t.Errorf("expvar returned %v, expected the live stats", m)
+	}
+
+	if err := NewLRUCacheString(1).PublishExpvar(name); err == nil {
+		t.Error("duplicate cache.PublishExpvar() did not return an error")
+	}
+}
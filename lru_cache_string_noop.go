@@ -0,0 +1,90 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lru
+
+// NoopStringCache is a StringCache storing nothing, for tests and for
+// disabling caching without touching the callers. It behaves like a
+// LRUCacheString of capacity 0: Get always misses, unless an OnMiss handler
+// provides the value, and every value it is given is purged right away with
+// PURGE_REASON_CACHEFULL.
+type NoopStringCache struct {
+	onMiss OnMissHandlerString
+}
+
+// NewNoopStringCache creates a cache storing nothing.
+func NewNoopStringCache() *NoopStringCache {
+	return &NoopStringCache{}
+}
+
+// Get returns the value provided by onMiss, if any, without storing it.
+func (c *NoopStringCache) Get(k string) (v Cacheable, ok bool) {
+	if c.onMiss == nil {
+		return nil, false
+	}
+	v, ok = c.onMiss(k)
+	if v == nil {
+		ok = false
+	}
+	if ok {
+		safeOnPurge(v, PURGE_REASON_CACHEFULL)
+	}
+	return
+}
+
+// Set purges value.
+func (c *NoopStringCache) Set(k string, value Cacheable) {
+	safeOnPurge(value, PURGE_REASON_CACHEFULL)
+}
+
+// SetIfAbsent purges value.
+func (c *NoopStringCache) SetIfAbsent(k string, value Cacheable) {
+	safeOnPurge(value, PURGE_REASON_CACHEFULL)
+}
+
+// Delete returns false, as nothing is ever cached.
+func (c *NoopStringCache) Delete(k string) bool {
+	return false
+}
+
+func (c *NoopStringCache) Clear() {}
+
+// SetCapacity is ignored, the capacity stays 0.
+func (c *NoopStringCache) SetCapacity(capacity int64) {}
+
+func (c *NoopStringCache) OnMiss(onMiss OnMissHandlerString) {
+	c.onMiss = onMiss
+}
+
+func (c *NoopStringCache) Stats() (length, size, capacity int64) {
+	return 0, 0, 0
+}
+
+func (c *NoopStringCache) StatsJSON() string {
+	return "{\"Length\": 0, \"Size\": 0, \"Capacity\": 0 }"
+}
+
+func (c *NoopStringCache) Length() int64 {
+	return 0
+}
+
+func (c *NoopStringCache) Size() int64 {
+	return 0
+}
+
+func (c *NoopStringCache) Capacity() int64 {
+	return 0
+}
+
+func (c *NoopStringCache) Keys() []string {
+	return []string{}
+}
+
+func (c *NoopStringCache) Items() []StringItem {
+	return []StringItem{}
+}
+
+func (c *NoopStringCache) Values() []Cacheable {
+	return []Cacheable{}
+}
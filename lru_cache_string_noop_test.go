@@ -0,0 +1,50 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lru
+
+import (
+	"testing"
+)
+
+func TestNoopStringCache(t *testing.T) {
+	var cache StringCache = NewNoopStringCache()
+	purged := 0
+	cache.Set("a", countingPurgeValue{&purged})
+	cache.SetIfAbsent("b", countingPurgeValue{&purged})
+	if purged != 2 {
+		t.Errorf("%v values purged, expected 2", purged)
+	}
+	if v, ok := cache.Get("a"); ok {
+		t.Errorf("Get(a) = %v, expected a miss", v)
+	}
+	if cache.Delete("a") {
+		t.Error("Delete(a) = true, expected false")
+	}
+	cache.SetCapacity(100)
+	if l, sz, c := cache.Stats(); l != 0 || sz != 0 || c != 0 {
+		t.Errorf("cache.Stats() = %v, %v, %v, expected 0, 0, 0", l, sz, c)
+	}
+	if keys := cache.Keys(); keys == nil || len(keys) != 0 {
+		t.Errorf("cache.Keys() = %#v, expected an empty slice", keys)
+	}
+}
+
+func TestNoopStringCacheOnMiss(t *testing.T) {
+	cache := NewNoopStringCache()
+	value := &CacheValue{1}
+	loads := 0
+	cache.OnMiss(func(k string) (Cacheable, bool) {
+		loads++
+		return value, true
+	})
+	for i := 0; i < 2; i++ {
+		if v, ok := cache.Get("a"); !ok || v != value {
+			t.Errorf("Get(a) = %v, %v, expected %v, true", v, ok, value)
+		}
+	}
+	if loads != 2 {
+		t.Errorf("onMiss called %v times, expected 2", loads)
+	}
+}
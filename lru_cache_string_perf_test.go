@@ -39,3 +39,33 @@ func BenchmarkMapGet(b *testing.B) {
 		_ = val
 	}
 }
+
+func BenchmarkGetSameKeyParallel(b *testing.B) {
+	cache := NewLRUCacheString(64 * 1024 * 1024)
+	value := make(MyValue, 1000)
+	cache.Set("http://example.com/some/hot/key", value)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, ok := cache.Get("http://example.com/some/hot/key"); !ok {
+				panic("error")
+			}
+		}
+	})
+}
+
+func BenchmarkGetAlternatingKeys(b *testing.B) {
+	cache := NewLRUCacheString(64 * 1024 * 1024)
+	value := make(MyValue, 1000)
+	keys := []string{"stuff", "other stuff"}
+	for _, k := range keys {
+		cache.Set(k, value)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := cache.Get(keys[i&1]); !ok {
+			panic("error")
+		}
+	}
+}
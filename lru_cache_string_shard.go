@@ -0,0 +1,181 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cache implements a LRU cache.
+//
+// The implementation borrows heavily from SmallLRUCacheString
+// (originally by Nathan Schrenk). The object maintains a doubly-linked list of
+// elements. When an element is accessed, it is promoted to the head of the
+// list. When space is needed, the element at the tail of the list
+// (the least recently used element) is evicted.
+package lru
+
+import (
+	"fmt"
+)
+
+// FNV-1a 32-bit parameters, see GetShard.
+const (
+	fnv32Offset = 2166136261
+	fnv32Prime  = 16777619
+)
+
+// ShardLRUCacheString is a typical LRU cache implementation.  If the cache
+// reaches the capacity, the least recently used item is deleted from
+// the cache. Note the capacity is not the number of items, but the
+// total sum of the Size() of each item.
+type ShardLRUCacheString struct {
+	shardCount int
+	cachelist  []*LRUCacheString
+}
+
+// NewShardLRUCacheString creates a new empty cache with the given capacity,
+// split evenly across shardCount shards.
+func NewShardLRUCacheString(shardCount int, capacity int64) *ShardLRUCacheString {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	c := &ShardLRUCacheString{shardCount: shardCount, cachelist: make([]*LRUCacheString, shardCount)}
+	for i, shardCap := range shardCapacities(capacity, shardCount, nil) {
+		c.cachelist[i] = NewLRUCacheString(shardCap)
+	}
+
+	return c
+}
+
+// GetShard returns the shard k belongs to, chosen by the FNV-1a hash of k.
+// The hash is computed inline rather than with hash/fnv, which allocates.
+func (lru *ShardLRUCacheString) GetShard(k string) *LRUCacheString {
+	h := uint32(fnv32Offset)
+	for i := 0; i < len(k); i++ {
+		h ^= uint32(k[i])
+		h *= fnv32Prime
+	}
+	return lru.cachelist[h%uint32(lru.shardCount)]
+}
+
+// Get returns a value from the cache, and marks the stringEntry as most
+// recently used.
+func (lru *ShardLRUCacheString) Get(k string) (v Cacheable, ok bool) {
+	return lru.GetShard(k).Get(k)
+}
+
+// Set sets a value in the cache.
+func (lru *ShardLRUCacheString) Set(k string, value Cacheable) {
+	lru.GetShard(k).Set(k, value)
+}
+
+// SetIfAbsent will set the value in the cache if not present. If the
+// value exists in the cache, we don't set it.
+func (lru *ShardLRUCacheString) SetIfAbsent(k string, value Cacheable) {
+	lru.GetShard(k).SetIfAbsent(k, value)
+}
+
+// Delete removes an stringEntry from the cache, and returns if the stringEntry existed.
+func (lru *ShardLRUCacheString) Delete(k string) bool {
+	return lru.GetShard(k).Delete(k)
+}
+
+// Clear will clear the entire cache.
+func (lru *ShardLRUCacheString) Clear() {
+	for idx, _ := range lru.cachelist {
+		lru.cachelist[idx].Clear()
+	}
+}
+
+// SetCapacity will set the capacity of the cache. If the capacity is
+// smaller, and the current cache size exceed that capacity, the cache
+// will be shrank.
+func (lru *ShardLRUCacheString) SetCapacity(capacity int64) {
+	for i, shardCap := range shardCapacities(capacity, lru.shardCount, nil) {
+		lru.cachelist[i].SetCapacity(shardCap)
+	}
+
+}
+func (lru *ShardLRUCacheString) OnMiss(onMiss OnMissHandlerString) {
+	for idx, _ := range lru.cachelist {
+		lru.cachelist[idx].OnMiss(onMiss)
+	}
+}
+
+// Stats
+func (lru *ShardLRUCacheString) Stats() (length, size, capacity int64) {
+	for idx, _ := range lru.cachelist {
+		l, s, c := lru.cachelist[idx].Stats()
+		length += l
+		size += s
+		capacity += c
+	}
+	return
+}
+
+// StatsJSON returns stats as a JSON object in a string.
+func (lru *ShardLRUCacheString) StatsJSON() string {
+	if lru == nil {
+		return "{}"
+	}
+	l, s, c := lru.Stats()
+	return fmt.Sprintf("{\"Length\": %v, \"Size\": %v, \"Capacity\": %v }", l, s, c)
+}
+
+// Length returns how many elements are in the cache
+func (lru *ShardLRUCacheString) Length() (length int64) {
+	for idx, _ := range lru.cachelist {
+		l := lru.cachelist[idx].Length()
+		length += l
+	}
+	return
+}
+
+// Size returns the sum of the objects' Size() method.
+func (lru *ShardLRUCacheString) Size() (size int64) {
+	for idx, _ := range lru.cachelist {
+		s := lru.cachelist[idx].Size()
+		size += s
+	}
+	return
+}
+
+// Capacity returns the cache maximum capacity.
+func (lru *ShardLRUCacheString) Capacity() (capacity int64) {
+	for idx, _ := range lru.cachelist {
+		c := lru.cachelist[idx].Capacity()
+		capacity += c
+	}
+	return
+}
+
+// Keys returns all the ks for the cache, ordered from most recently
+// used to last recently used.
+func (lru *ShardLRUCacheString) Keys() (ks []string) {
+	ks = make([]string, 0, lru.Length()+int64(lru.shardCount))
+	for idx, _ := range lru.cachelist {
+		tmp := lru.cachelist[idx].Keys()
+		ks = append(ks, tmp...)
+
+	}
+	return ks
+}
+
+// Items returns all the values for the cache, ordered from most recently
+// used to last recently used.
+func (lru *ShardLRUCacheString) Items() (items []StringItem) {
+	items = make([]StringItem, 0, lru.Length()+int64(lru.shardCount))
+	for idx, _ := range lru.cachelist {
+		tmp := lru.cachelist[idx].Items()
+		items = append(items, tmp...)
+
+	}
+	return items
+}
+
+func (lru *ShardLRUCacheString) Values() []Cacheable {
+	values := make([]Cacheable, 0, lru.Length()+int64(lru.shardCount))
+	for idx, _ := range lru.cachelist {
+		tmp := lru.cachelist[idx].Values()
+		values = append(values, tmp...)
+
+	}
+	return values
+}
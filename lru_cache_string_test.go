@@ -7,6 +7,7 @@ package lru
 import (
 	"encoding/json"
 	"testing"
+	"time"
 )
 
 type CacheValue struct {
@@ -76,6 +77,55 @@ func TestSetIfAbsent(t *testing.T) {
 	}
 }
 
+func TestOnMissNil(t *testing.T) {
+	cache := NewLRUCacheString(100)
+	cache.OnMiss(func(k string) (Cacheable, bool) {
+		return nil, true
+	})
+	if v, ok := cache.Get("k"); ok || v != nil {
+		t.Errorf("cache.Get(k) = %v, %v, expected nil, false", v, ok)
+	}
+	if l := cache.Length(); l != 0 {
+		t.Errorf("cache.Length() = %v, expected 0", l)
+	}
+}
+
+func TestSetX(t *testing.T) {
+	cache := NewLRUCacheString(100)
+	if !cache.SetX("k", &CacheValue{1}) {
+		t.Error("cache.SetX(k) = false for a new key")
+	}
+	data := &CacheValue{2}
+	if cache.SetX("k", data) {
+		t.Error("cache.SetX(k) = true for an update")
+	}
+	if v, ok := cache.Get("k"); !ok || v.(*CacheValue) != data {
+		t.Errorf("Cache has incorrect value: %v != %v", data, v)
+	}
+}
+
+func TestSetIfPresent(t *testing.T) {
+	cache := NewLRUCacheString(100)
+	if cache.SetIfPresent("k", &CacheValue{1}) {
+		t.Error("cache.SetIfPresent(k) = true on an empty cache")
+	}
+	if _, ok := cache.Get("k"); ok {
+		t.Error("cache.SetIfPresent(k) inserted a missing key")
+	}
+
+	cache.Set("k", &CacheValue{1})
+	data := &CacheValue{2}
+	if !cache.SetIfPresent("k", data) {
+		t.Error("cache.SetIfPresent(k) = false for a cached key")
+	}
+	if v, ok := cache.Get("k"); !ok || v.(*CacheValue) != data {
+		t.Errorf("Cache has incorrect value: %v != %v", data, v)
+	}
+	if sz := cache.Size(); sz != 2 {
+		t.Errorf("cache.Size() = %v, expected 2", sz)
+	}
+}
+
 func TestGetValueWithMultipleTypes(t *testing.T) {
 	cache := NewLRUCacheString(100)
 	data := &CacheValue{0}
@@ -316,6 +366,19 @@ func TestCacheFullOnPurge(t *testing.T) {
 
 }
 
+func TestCapacityShrinkOnPurge(t *testing.T) {
+	cache := NewLRUCacheString(2)
+	value := &PurgeCacheValue{}
+
+	cache.Set("k1", value)
+	cache.Set("k2", &CacheValue{1})
+	purgeReasonFlag4Test = PURGE_REASON_DELETE // init
+	cache.SetCapacity(1)                       // k1 is evicted by the shrink
+	if purgeReasonFlag4Test != PURGE_REASON_CAPACITY_SHRINK {
+		t.Errorf("after cache.SetCapacity ,purgeReason should be %d ,but get %d", PURGE_REASON_CAPACITY_SHRINK, purgeReasonFlag4Test)
+	}
+}
+
 func TestClearOnPurge(t *testing.T) {
 	cache := NewLRUCacheString(1)
 	value := &PurgeCacheValue{}
@@ -342,3 +405,422 @@ func TestOnMiss(t *testing.T) {
 	}
 
 }
+
+func TestUpdateSize(t *testing.T) {
+	cache := NewLRUCacheString(100)
+	value := &CacheValue{10}
+	cache.Set("k1", value)
+	cache.Set("k2", &CacheValue{1})
+
+	value.size = 30
+	cache.UpdateSize("k1")
+	if sz := cache.Size(); sz != 31 {
+		t.Errorf("cache.Size() = %v, expected 31", sz)
+	}
+	// recency is preserved: k2 is still the most recently used.
+	if keys := cache.Keys(); keys[0] != "k2" {
+		t.Errorf("cache.Keys() = %v, expected k2 first", keys)
+	}
+
+	value.size = 200
+	cache.UpdateSize("k1")
+	if _, ok := cache.Get("k1"); ok {
+		t.Error("oversized entry was not evicted after UpdateSize")
+	}
+	if sz := cache.Size(); sz != 1 {
+		t.Errorf("cache.Size() = %v, expected 1", sz)
+	}
+
+	cache.UpdateSize("missing") // no-op
+}
+
+func TestSizeOf(t *testing.T) {
+	cache := NewLRUCacheString(100)
+	value := &CacheValue{10}
+	cache.Set("k1", value)
+	cache.Set("k2", &CacheValue{1})
+
+	// the accounted size is the one at insert time
+	value.size = 30
+	if sz, ok := cache.SizeOf("k1"); !ok || sz != 10 {
+		t.Errorf("cache.SizeOf(k1) = %v, %v, expected 10, true", sz, ok)
+	}
+	// no promotion: k2 is still the most recently used.
+	if keys := cache.Keys(); keys[0] != "k2" {
+		t.Errorf("cache.Keys() = %v, expected k2 first", keys)
+	}
+	if sz, ok := cache.SizeOf("missing"); ok || sz != 0 {
+		t.Errorf("cache.SizeOf(missing) = %v, %v, expected 0, false", sz, ok)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	cache := NewLRUCacheString(2)
+	cache.OnMiss(func(k string) (Cacheable, bool) {
+		t.Errorf("onMiss called for %v", k)
+		return nil, false
+	})
+	cache.Set("k1", &CacheValue{1})
+	cache.Set("k2", &CacheValue{1})
+
+	if !cache.Touch("k1") {
+		t.Error("cache.Touch(k1) = false, expected true")
+	}
+	if cache.Touch("missing") {
+		t.Error("cache.Touch(missing) = true, expected false")
+	}
+	// k2 is now the least recently used
+	cache.Set("k3", &CacheValue{1})
+	if keys := cache.Keys(); len(keys) != 2 || keys[0] != "k3" || keys[1] != "k1" {
+		t.Errorf("cache.Keys() = %v, expected [k3 k1]", keys)
+	}
+}
+
+func TestSetWithSize(t *testing.T) {
+	cache := NewLRUCacheString(10)
+	value := &CacheValue{1}
+	cache.SetWithSize("k1", value, 6)
+	if sz, ok := cache.SizeOf("k1"); !ok || sz != 6 {
+		t.Errorf("cache.SizeOf(k1) = %v, %v, expected 6, true", sz, ok)
+	}
+	cache.SetWithSize("k2", "not SizeAware", 3)
+	if sz := cache.Size(); sz != 9 {
+		t.Errorf("cache.Size() = %v, expected 9", sz)
+	}
+
+	// the override is honoured for eviction
+	cache.SetWithSize("k3", &CacheValue{1}, 2)
+	if _, ok := cache.Get("k1"); ok {
+		t.Error("k1 was not evicted")
+	}
+
+	// a plain Set goes back to Size()
+	cache.Set("k2", &CacheValue{4})
+	if sz, _ := cache.SizeOf("k2"); sz != 4 {
+		t.Errorf("cache.SizeOf(k2) = %v, expected 4", sz)
+	}
+	if sz := cache.Size(); sz != 6 {
+		t.Errorf("cache.Size() = %v, expected 6", sz)
+	}
+}
+
+func TestGetOrLoad(t *testing.T) {
+	cache := NewLRUCacheString(100)
+	cache.OnMiss(func(k string) (Cacheable, bool) {
+		t.Errorf("global onMiss called for %v", k)
+		return nil, false
+	})
+	loaded := &CacheValue{1}
+	loads := 0
+	loader := func(k string) (Cacheable, bool) {
+		loads++
+		return loaded, k == "k1"
+	}
+
+	if v, ok := cache.GetOrLoad("k1", loader); !ok || v != loaded {
+		t.Errorf("cache.GetOrLoad(k1) = %v, %v, expected %v", v, ok, loaded)
+	}
+	if v, ok := cache.GetOrLoad("k1", loader); !ok || v != loaded || loads != 1 {
+		t.Errorf("second cache.GetOrLoad(k1) = %v, %v with %v loads, expected a hit", v, ok, loads)
+	}
+	if _, ok := cache.GetOrLoad("k2", loader); ok {
+		t.Error("cache.GetOrLoad(k2) found a value the loader did not")
+	}
+	if l := cache.Length(); l != 1 {
+		t.Errorf("cache.Length() = %v, expected 1", l)
+	}
+}
+
+func TestEvictBatchLimit(t *testing.T) {
+	cache := NewLRUCacheString(10)
+	cache.SetEvictBatchLimit(2)
+	for i := 0; i < 10; i++ {
+		cache.Set(string(rune('a'+i)), &CacheValue{1})
+	}
+	cache.Set("k1", &CacheValue{2}) // evicts 2: within the limit
+	if n := cache.EvictBatchOverruns(); n != 0 {
+		t.Errorf("cache.EvictBatchOverruns() = %v, expected 0", n)
+	}
+	cache.Set("k2", &CacheValue{5}) // evicts 5
+	if n := cache.EvictBatchOverruns(); n != 1 {
+		t.Errorf("cache.EvictBatchOverruns() = %v, expected 1", n)
+	}
+	if sz := cache.Size(); sz != 10 {
+		t.Errorf("cache.Size() = %v, expected the overrun to still evict down to 10", sz)
+	}
+}
+
+func TestOnHighWater(t *testing.T) {
+	cache := NewLRUCacheString(10)
+	fired := 0
+	cache.OnHighWater(0.8, func(size, capacity int64) {
+		fired++
+		if size != 9 || capacity != 10 {
+			t.Errorf("OnHighWater callback with %v, %v, expected 9, 10", size, capacity)
+		}
+	})
+	for i := 0; i < 8; i++ {
+		cache.Set(string(rune('a'+i)), &CacheValue{1})
+	}
+	if fired != 0 {
+		t.Errorf("fired %v times at 80%%, expected 0", fired)
+	}
+	cache.Set("i", &CacheValue{1})
+	cache.Set("j", &CacheValue{1})
+	cache.Set("k", &CacheValue{1}) // evicts a
+	if fired != 1 {
+		t.Errorf("fired %v times above the line, expected 1", fired)
+	}
+
+	cache.Delete("b")
+	cache.Delete("c")
+	cache.Set("c", &CacheValue{1}) // 9 again, but without going under the line
+	cache.Delete("c")
+	cache.Delete("d")
+	cache.Set("d", &CacheValue{1}) // 8: back under the line
+	cache.Set("x", &CacheValue{1})
+	if fired != 2 {
+		t.Errorf("fired %v times after crossing again, expected 2", fired)
+	}
+}
+
+func TestMinResidency(t *testing.T) {
+	cache := NewLRUCacheString(3)
+	cache.SetMinResidency(time.Hour)
+	cache.Set("a", &CacheValue{1})
+	cache.Set("b", &CacheValue{1})
+	cache.Set("c", &CacheValue{1})
+	// lru: [c, b, a], all too young
+
+	cache.Set("d", &CacheValue{1})
+	if _, ok := cache.Get("a"); ok {
+		t.Error("the least recently used entry was not evicted when all are too young")
+	}
+	// lru: [d, c, b]
+
+	cache.mu.Lock()
+	cache.table["c"].Value.(*stringEntry).inserted = time.Now().Add(-2 * time.Hour)
+	cache.mu.Unlock()
+	cache.Set("e", &CacheValue{1})
+	if keys := cache.Keys(); len(keys) != 3 || keys[0] != "e" || keys[1] != "d" || keys[2] != "b" {
+		t.Errorf("cache.Keys() = %v, expected [e d b]: c is the only entry old enough", keys)
+	}
+}
+
+func TestClearNoPurge(t *testing.T) {
+	cache := NewLRUCacheString(100)
+	purged := 0
+	cache.Set("a", countingPurgeValue{&purged})
+	cache.Set("b", countingPurgeValue{&purged})
+	cache.Get("b")
+	cache.Get("b")
+
+	cache.ClearNoPurge()
+	if purged != 0 {
+		t.Errorf("OnPurge called %v times, expected 0", purged)
+	}
+	if l, sz := cache.Length(), cache.Size(); l != 0 || sz != 0 {
+		t.Errorf("cache.Length(), cache.Size() = %v, %v, expected 0, 0", l, sz)
+	}
+	if _, ok := cache.Get("b"); ok {
+		t.Error("cache.Get(b) hit after ClearNoPurge")
+	}
+}
+
+func TestOversizeValue(t *testing.T) {
+	cache := NewLRUCacheString(10)
+	cache.Set("a", &CacheValue{4})
+	cache.Set("b", &CacheValue{4})
+	purged := 0
+	cache.Set("big", &CacheValue{11})
+	cache.SetWithSize("bigger", countingPurgeValue{&purged}, 11)
+	if purged != 1 {
+		t.Errorf("oversize value purged %v times, expected 1", purged)
+	}
+	if keys := cache.Keys(); len(keys) != 2 || keys[0] != "b" || keys[1] != "a" {
+		t.Errorf("cache.Keys() = %v, expected the other entries untouched", keys)
+	}
+	if _, ok := cache.Get("bigger"); ok {
+		t.Error("oversize value was stored")
+	}
+}
+
+func TestNegativeCapacity(t *testing.T) {
+	cache := NewLRUCacheString(100)
+	cache.SetCapacity(-1) // used to panic on the empty list
+
+	cache.SetCapacity(100)
+	cache.Set("a", &CacheValue{1})
+	cache.Set("b", &CacheValue{1})
+	cache.SetCapacity(-1)
+	if l, sz := cache.Length(), cache.Size(); l != 0 || sz != 0 {
+		t.Errorf("cache.Length(), cache.Size() = %v, %v, expected 0, 0", l, sz)
+	}
+	cache.Set("c", &CacheValue{1})
+	if _, ok := cache.Get("c"); ok {
+		t.Error("cache.Get(c) hit on a disabled cache")
+	}
+}
+
+func TestZeroCapacity(t *testing.T) {
+	cache := NewLRUCacheString(0)
+	purged := 0
+	for i := 0; i < 100; i++ {
+		// zero sized values used to pile up, never exceeding the capacity
+		cache.Set(string(rune('a'+i%26)), &CacheValue{0})
+		cache.SetIfAbsent("k", countingPurgeValue{&purged})
+	}
+	if l, sz := cache.Length(), cache.Size(); l != 0 || sz != 0 {
+		t.Errorf("cache.Length(), cache.Size() = %v, %v, expected 0, 0", l, sz)
+	}
+	if purged != 100 {
+		t.Errorf("%v values purged, expected 100", purged)
+	}
+	if _, ok := cache.Get("a"); ok {
+		t.Error("cache.Get(a) hit on a disabled cache")
+	}
+}
+
+func TestCapacityByCount(t *testing.T) {
+	cache := NewLRUCacheStringWithOptions(StringOptions{Capacity: 3, CapacityMode: CapacityByCount})
+	cache.Set("a", &CacheValue{100})
+	cache.Set("b", &CacheValue{100})
+	cache.SetWithSize("c", &CacheValue{0}, 50)
+	if l, sz := cache.Length(), cache.Size(); l != 3 || sz != 3 {
+		t.Errorf("cache.Length(), cache.Size() = %v, %v, expected 3, 3", l, sz)
+	}
+	cache.Set("d", &CacheValue{1})
+	if keys := cache.Keys(); len(keys) != 3 || keys[0] != "d" || keys[1] != "c" || keys[2] != "b" {
+		t.Errorf("cache.Keys() = %v, expected [d c b]", keys)
+	}
+
+	v, _ := cache.Get("b")
+	v.(*CacheValue).size = 1000
+	cache.UpdateSize("b")
+	if sz, _ := cache.SizeOf("b"); sz != 1 {
+		t.Errorf("cache.SizeOf(b) = %v, expected 1", sz)
+	}
+	if sz := cache.Size(); sz != 3 {
+		t.Errorf("cache.Size() = %v, expected 3", sz)
+	}
+}
+
+func TestCapacityBySizeIsDefault(t *testing.T) {
+	cache := NewLRUCacheStringWithOptions(StringOptions{Capacity: 10})
+	cache.Set("a", &CacheValue{4})
+	cache.Set("b", &CacheValue{4})
+	cache.Set("c", &CacheValue{4})
+	if l, sz := cache.Length(), cache.Size(); l != 2 || sz != 8 {
+		t.Errorf("cache.Length(), cache.Size() = %v, %v, expected 2, 8", l, sz)
+	}
+}
+
+func TestGetHotKey(t *testing.T) {
+	cache := NewLRUCacheString(100)
+	cache.Set("a", &CacheValue{1})
+	cache.Set("b", &CacheValue{1})
+	for i := 0; i < 3; i++ {
+		cache.Get("b")
+	}
+
+	data := &CacheValue{2}
+	cache.Set("b", data)
+	if v, ok := cache.Get("b"); !ok || v.(*CacheValue) != data {
+		t.Errorf("cache.Get(b) = %v after an update, expected %v", v, data)
+	}
+	cache.Get("b")
+	cache.SetWithSize("b", data, 5)
+	if sz, _ := cache.SizeOf("b"); sz != 5 {
+		t.Errorf("cache.SizeOf(b) = %v, expected 5", sz)
+	}
+
+	cache.Get("b")
+	cache.Get("b")
+	cache.Get("a")
+	if keys := cache.Keys(); keys[0] != "a" {
+		t.Errorf("cache.Keys() = %v, expected a to be promoted", keys)
+	}
+	cache.Get("b")
+	cache.Get("b")
+	if keys := cache.Keys(); keys[0] != "b" {
+		t.Errorf("cache.Keys() = %v, expected b to be promoted", keys)
+	}
+
+	cache.Delete("b")
+	if _, ok := cache.Get("b"); ok {
+		t.Error("cache.Get(b) hit after Delete")
+	}
+	cache.Get("a")
+	cache.Get("a")
+	cache.Clear()
+	if _, ok := cache.Get("a"); ok {
+		t.Error("cache.Get(a) hit after Clear")
+	}
+
+	cache = NewLRUCacheString(1)
+	cache.Set("a", &CacheValue{1})
+	cache.Get("a")
+	cache.Get("a")
+	cache.SetCapacity(0)
+	if _, ok := cache.Get("a"); ok {
+		t.Error("cache.Get(a) hit after being evicted")
+	}
+}
+
+func TestGetHotKeyConcurrent(t *testing.T) {
+	cache := NewLRUCacheString(100)
+	values := []*CacheValue{{1}, {2}}
+	cache.Set("k", values[0])
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			cache.Set("k", values[i%2])
+		}
+		cache.Set("k", values[0])
+	}()
+	for i := 0; i < 10000; i++ {
+		if v, ok := cache.Get("k"); !ok || (v != values[0] && v != values[1]) {
+			t.Fatalf("cache.Get(k) = %v, %v", v, ok)
+		}
+	}
+	<-done
+	cache.Get("k")
+	if v, _ := cache.Get("k"); v != values[0] {
+		t.Errorf("cache.Get(k) = %v, expected the last value set", v)
+	}
+}
+
+// purgeFuncValue calls onPurge when purged.
+type purgeFuncValue struct {
+	onPurge func()
+}
+
+func (v *purgeFuncValue) OnPurge(why PurgeReason) {
+	v.onPurge()
+}
+
+func TestGetConcurrentClear(t *testing.T) {
+	cache := NewLRUCacheString(100)
+	got := make(chan bool, 1)
+	value := &purgeFuncValue{}
+	value.onPurge = func() {
+		// Get the value being purged, while Clear still holds the cache
+		go func() {
+			_, ok := cache.Get("k")
+			got <- ok
+		}()
+		select {
+		case <-got:
+			t.Error("cache.Get(k) returned during Clear, after OnPurge")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	cache.Set("k", value)
+	cache.Get("k")
+	cache.Get("k") // now the hot entry
+	cache.Clear()
+	if ok := <-got; ok {
+		t.Error("cache.Get(k) returned a purged value")
+	}
+}